@@ -0,0 +1,290 @@
+package brute
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/rrborja/brute/log"
+)
+
+// AccessLogConfig is the access_log section of .brute.yml. Every request
+// routed to an endpoint is written to File, rotated once it grows past
+// MaxSize megabytes:
+//
+//	access_log:
+//	  format: combined
+//	  file: bin/access.log
+//	  max_size: 100
+//	  max_backups: 5
+//
+// The common and combined formats are followed by the fields brute adds:
+// the route, session, time to first byte, duration, authorizer outcome
+// and replica.
+type AccessLogConfig struct {
+	Format     string `yaml:"format"`
+	File       string `yaml:"file"`
+	MaxSize    int64  `yaml:"max_size"`
+	MaxBackups int    `yaml:"max_backups"`
+}
+
+const (
+	AccessLogCommon   = "common"
+	AccessLogCombined = "combined"
+	AccessLogJSON     = "json"
+)
+
+// Authorizer outcomes of an access record.
+const (
+	AuthorizerAllowed = "allowed"
+	AuthorizerDenied  = "denied"
+)
+
+var defaultAccessLogFile = filepath.Join("bin", "access.log")
+
+// AccessRecord is what happened to a single request.
+type AccessRecord struct {
+	Time       time.Time
+	RemoteAddr string
+	Method     string
+	Path       string
+	Proto      string
+	Referer    string
+	UserAgent  string
+
+	Route      string
+	SessionId  string
+	Status     int
+	Bytes      int64
+	FirstByte  time.Duration
+	Duration   time.Duration
+	Authorizer string
+	Replica    string
+}
+
+type accessRecordKey struct{}
+
+// accessRecordOf is the record of the request being served, nil when
+// access logs are off.
+func accessRecordOf(r *http.Request) *AccessRecord {
+	record, _ := r.Context().Value(accessRecordKey{}).(*AccessRecord)
+	return record
+}
+
+// withoutAccessRecord hides the record from handlers serving r on behalf
+// of another one, such as the authorizer.
+func withoutAccessRecord(r *http.Request) *http.Request {
+	if accessRecordOf(r) == nil {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), accessRecordKey{}, (*AccessRecord)(nil)))
+}
+
+// AccessLogger writes access records to a file.
+type AccessLogger struct {
+	format string
+	writer io.WriteCloser
+	mutex  sync.Mutex
+}
+
+// accessLog is set by New when the access log is configured.
+var accessLog *AccessLogger
+
+var unknownAccessLogFormatError = errors.New("unknown access log format")
+
+func OpenAccessLog(config *AccessLogConfig) (*AccessLogger, error) {
+	format := strings.ToLower(config.Format)
+	switch format {
+	case "":
+		format = AccessLogCombined
+	case AccessLogCommon, AccessLogCombined, AccessLogJSON:
+	default:
+		return nil, fmt.Errorf("%v: %q", unknownAccessLogFormatError, config.Format)
+	}
+
+	file := config.File
+	if file == "" {
+		file = defaultAccessLogFile
+	}
+
+	writer, err := OpenRotatingFile(file, config.MaxSize<<20, config.MaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	return &AccessLogger{format: format, writer: writer}, nil
+}
+
+// recordRequests fills an access record for every request served by next
+// and hands it to each of done once the request is served.
+func recordRequests(route Route, next http.HandlerFunc, done ...func(*AccessRecord)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		record := &AccessRecord{
+			Time:       time.Now(),
+			RemoteAddr: r.RemoteAddr,
+			Method:     r.Method,
+			Path:       r.URL.RequestURI(),
+			Proto:      r.Proto,
+			Referer:    r.Referer(),
+			UserAgent:  r.UserAgent(),
+			Route:      route.Directory,
+		}
+
+		recorder := &accessWriter{ResponseWriter: w, record: record}
+		next(recorder, r.WithContext(context.WithValue(r.Context(), accessRecordKey{}, record)))
+
+		record.Duration = time.Since(record.Time)
+		if record.Status == 0 {
+			record.Status = http.StatusOK
+		}
+		for _, fn := range done {
+			fn(record)
+		}
+	}
+}
+
+func (logger *AccessLogger) Write(record *AccessRecord) {
+	var line []byte
+	switch logger.format {
+	case AccessLogJSON:
+		line = record.json()
+	default:
+		line = record.text(logger.format == AccessLogCombined)
+	}
+
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+
+	if _, err := logger.writer.Write(line); err != nil {
+		LogError(ErrorLog{err, fmt.Sprintf("Could not write the access log: %v", err)})
+	}
+}
+
+func (logger *AccessLogger) Close() error {
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+
+	return logger.writer.Close()
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func (record *AccessRecord) host() string {
+	if host, _, err := net.SplitHostPort(record.RemoteAddr); err == nil {
+		return host
+	}
+	return orDash(record.RemoteAddr)
+}
+
+// text is the line of the Common Log Format, or of the Combined one,
+// followed by the brute fields.
+func (record *AccessRecord) text(combined bool) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s - - [%s] %q %d %d",
+		record.host(),
+		record.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		record.Method+" "+record.Path+" "+record.Proto,
+		record.Status,
+		record.Bytes)
+	if combined {
+		fmt.Fprintf(&buf, " %q %q", orDash(record.Referer), orDash(record.UserAgent))
+	}
+	fmt.Fprintf(&buf, " route=%s session=%s ttfb=%s duration=%s authorizer=%s replica=%s\n",
+		orDash(record.Route),
+		orDash(record.SessionId),
+		record.FirstByte,
+		record.Duration,
+		orDash(record.Authorizer),
+		orDash(record.Replica))
+	return buf.Bytes()
+}
+
+func (record *AccessRecord) json() []byte {
+	data, _ := json.Marshal(struct {
+		Time       string  `json:"time"`
+		Remote     string  `json:"remote"`
+		Method     string  `json:"method"`
+		Path       string  `json:"path"`
+		Proto      string  `json:"proto"`
+		Referer    string  `json:"referer,omitempty"`
+		UserAgent  string  `json:"user_agent,omitempty"`
+		Route      string  `json:"route"`
+		SessionId  string  `json:"session,omitempty"`
+		Status     int     `json:"status"`
+		Bytes      int64   `json:"bytes"`
+		FirstByte  float64 `json:"ttfb_ms"`
+		Duration   float64 `json:"duration_ms"`
+		Authorizer string  `json:"authorizer,omitempty"`
+		Replica    string  `json:"replica,omitempty"`
+	}{
+		record.Time.Format(time.RFC3339Nano),
+		record.host(),
+		record.Method,
+		record.Path,
+		record.Proto,
+		record.Referer,
+		record.UserAgent,
+		record.Route,
+		record.SessionId,
+		record.Status,
+		record.Bytes,
+		milliseconds(record.FirstByte),
+		milliseconds(record.Duration),
+		record.Authorizer,
+		record.Replica,
+	})
+	return append(data, '\n')
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// accessWriter fills the status, size and time to first byte of a record.
+type accessWriter struct {
+	http.ResponseWriter
+	record *AccessRecord
+}
+
+func (w *accessWriter) firstByte() {
+	if w.record.FirstByte == 0 {
+		w.record.FirstByte = time.Since(w.record.Time)
+	}
+}
+
+func (w *accessWriter) WriteHeader(statusCode int) {
+	if w.record.Status == 0 {
+		w.record.Status = statusCode
+		w.firstByte()
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *accessWriter) Write(data []byte) (int, error) {
+	if w.record.Status == 0 {
+		w.record.Status = http.StatusOK
+	}
+	w.firstByte()
+	n, err := w.ResponseWriter.Write(data)
+	w.record.Bytes += int64(n)
+	return n, err
+}
+
+func (w *accessWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,111 @@
+package brute
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rrborja/brute/trace"
+	"github.com/stretchr/testify/assert"
+)
+
+func serveLogged(t *testing.T, format string, handler http.HandlerFunc) string {
+	dir, err := ioutil.TempDir("", "brute")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "access.log")
+	logger, err := OpenAccessLog(&AccessLogConfig{Format: format, File: file})
+	assert.NoError(t, err)
+
+	r := httptest.NewRequest("POST", "/users/42?full=1", nil)
+	r.Header.Set("User-Agent", "curl/7.58")
+	recordRequests(Route{Directory: "users"}, handler, logger.Write)(httptest.NewRecorder(), r)
+	assert.NoError(t, logger.Close())
+
+	data, err := ioutil.ReadFile(file)
+	assert.NoError(t, err)
+	return string(data)
+}
+
+func TestCombinedAccessLog(t *testing.T) {
+	line := serveLogged(t, "", func(w http.ResponseWriter, r *http.Request) {
+		record := accessRecordOf(r)
+		record.SessionId = "ab12"
+		record.Authorizer = AuthorizerAllowed
+		record.Replica = "2"
+
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	})
+
+	assert.True(t, strings.HasPrefix(line, "192.0.2.1 - - ["))
+	assert.Contains(t, line, `] "POST /users/42?full=1 HTTP/1.1" 201 7 "-" "curl/7.58" route=users session=ab12 ttfb=`)
+	assert.Contains(t, line, " authorizer=allowed replica=2\n")
+}
+
+func TestJSONAccessLog(t *testing.T) {
+	line := serveLogged(t, AccessLogJSON, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	var entry map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(line), &entry))
+	assert.Equal(t, "users", entry["route"])
+	assert.Equal(t, "/users/42?full=1", entry["path"])
+	assert.Equal(t, float64(200), entry["status"])
+	assert.Equal(t, float64(5), entry["bytes"])
+	assert.NotNil(t, entry["ttfb_ms"])
+	assert.Nil(t, entry["authorizer"])
+}
+
+func TestAuthorizerDoesNotShareTheAccessRecord(t *testing.T) {
+	serveLogged(t, AccessLogCommon, func(w http.ResponseWriter, r *http.Request) {
+		assert.NotNil(t, accessRecordOf(r))
+		assert.Nil(t, accessRecordOf(withoutAccessRecord(r)))
+	})
+}
+
+func TestProtectedRoutesKeepTheirBody(t *testing.T) {
+	route := Route{Path: "/users", Directory: "users"}
+
+	// The authorizer reads the body, then answers while still loading
+	authorizeHandler = &ControllerEndpoint{Route: Route{Directory: "auth"}}
+	endpoints.Store("auth", newReplicaSet(authorizeHandler.Route))
+	defer func() {
+		authorizeHandler = nil
+		endpoints.Delete("auth")
+	}()
+
+	var body, name string
+	protected := (&auth{protected: true}).Success(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		body, name = string(data), r.FormValue("name")
+	}).Handler()
+
+	post := func(handler http.Handler) {
+		body, name = "", ""
+		r := httptest.NewRequest("POST", "/users", strings.NewReader("name=ana"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+
+		assert.Equal(t, "name=ana", body)
+		assert.Equal(t, "ana", name)
+	}
+
+	post(recordRequests(route, protected))
+
+	tracer = trace.NewTracer("shop", &recordingExporter{})
+	defer func() { tracer = nil }()
+	post(traceRequests(traceRoute(route, protected)))
+}
+
+func TestUnknownAccessLogFormat(t *testing.T) {
+	_, err := OpenAccessLog(&AccessLogConfig{Format: "apache"})
+	assert.Error(t, err)
+}
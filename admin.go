@@ -0,0 +1,65 @@
+package brute
+
+import (
+	"fmt"
+	"net/http"
+
+	. "github.com/rrborja/brute/log"
+)
+
+// AdminConfig is the admin section of .brute.yml. The admin listener is off
+// unless the section is there, and serves the metrics of the master in the
+// Prometheus text format on /metrics, its liveness on /healthz and its
+// readiness on /readyz:
+//
+//	admin:
+//	  listen: 127.0.0.1:9100
+type AdminConfig struct {
+	Listen string `yaml:"listen"`
+}
+
+const defaultAdminAddress = "127.0.0.1:9100"
+
+func (config *AdminConfig) address() string {
+	if config.Listen == "" {
+		return defaultAdminAddress
+	}
+	return config.Listen
+}
+
+func adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := WriteMetrics(w); err != nil {
+			LogError(ErrorLog{err, fmt.Sprintf("Could not write the metrics: %v", err)})
+		}
+	})
+	mux.HandleFunc("/healthz", livenessHandler)
+	mux.HandleFunc("/readyz", readinessHandler)
+	return mux
+}
+
+// serveAdmin starts the admin listener if it is configured.
+func serveAdmin(config *Config) {
+	if config.Admin == nil {
+		return
+	}
+
+	address := config.Admin.address()
+	l, err := Listen(address)
+	if err != nil {
+		LogError(ErrorLog{err, fmt.Sprintf("Can't listen for the admin on %s: %v", address, err)})
+		return
+	}
+
+	srv := &http.Server{Handler: adminHandler()}
+	trackServer(srv)
+
+	Log(fmt.Sprintf("Serving the admin on %s", address))
+	go func() {
+		if err := srv.Serve(l); err != http.ErrServerClosed {
+			LogError(ErrorLog{err, fmt.Sprintf("Admin server on %s stopped: %v", address, err)})
+		}
+	}()
+}
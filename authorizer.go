@@ -1,9 +1,11 @@
 package brute
 
 import (
+	"bytes"
+	"io/ioutil"
 	"net/http"
-	"path/filepath"
 	"context"
+	"time"
 )
 
 var authorizeHandler *ControllerEndpoint
@@ -25,7 +27,7 @@ func LoadAuthorizer(route Route) AuthorizeHandler {
 		authorizeHandler = &ControllerEndpoint{
 				ProjectName: projectName,
 				Route: route,
-				runtimeFile: filepath.Join(cwd, "bin", "endpoints", route.Directory),
+				runtimeFile: endpointBinary(route.Directory),
 			}
 	}
 
@@ -65,12 +67,35 @@ func (auth *auth) Handler() http.HandlerFunc {
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
+		// The authorizer is served a copy of r: the body and the form are
+		// read on r itself so that they are left for the route.
+		body, ok := readBody(w, r, authorizeHandler.Route)
+		if !ok {
+			return
+		}
+
 		authContext := &MiddlewareWriterContext{header: r.Header}
-		authorizeHandler.ServeHTTP(authContext, r) //This blocks until remote endpoint finishes execution
+		start := time.Now()
+		span := spanOf(r).Child("authorize")
+		authorizeHandler.ServeHTTP(authContext, withSpan(withoutAccessRecord(r), span)) //This blocks until remote endpoint finishes execution
+		if r.Body != nil {
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		span.SetAttribute("brute.authorizer", authContext.httpCode != 403)
+		span.Finish()
+		record := accessRecordOf(r)
 		if authContext.httpCode != 403 {
+			authorizerDuration.ObserveSince(start, AuthorizerAllowed)
+			if record != nil {
+				record.Authorizer = AuthorizerAllowed
+			}
 			r.WithContext(context.WithValue(r.Context(), "policy", authContext))
 			auth.next(w, r)
 		} else {
+			authorizerDuration.ObserveSince(start, AuthorizerDenied)
+			if record != nil {
+				record.Authorizer = AuthorizerDenied
+			}
 			auth.unauthorizedPage(w, r)
 		}
 	}
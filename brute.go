@@ -18,8 +18,8 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/rjeczalik/notify"
 
+	"bytes"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
@@ -34,11 +34,12 @@ import (
 	"path/filepath"
 	"runtime"
 	"runtime/debug"
-	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 	"github.com/elazarl/go-bindata-assetfs"
 	"github.com/rrborja/brute/assets"
+	"github.com/rrborja/brute/protocol"
 	"strings"
 	"net/url"
 	. "github.com/rrborja/brute/log"
@@ -50,7 +51,9 @@ var gotool = filepath.Join(runtime.GOROOT(), "bin", "go")
 
 var projectName string
 
-var magicNumber = []byte{0x62, 0x72, 0x75, 0x74, 0x65}
+// registrationTokenEnv is the environment variable through which a spawned
+// endpoint receives its registration token.
+const registrationTokenEnv = "BRUTE_TOKEN"
 
 var (
 	noSuchRouteError = errors.New("no such route")
@@ -68,9 +71,23 @@ var (
 )
 
 type ConnWrite struct {
+	// inFlight counts the sessions dispatched to the endpoint and not yet
+	// closed. It comes first to stay 64-bit aligned for sync/atomic.
+	inFlight int64
+
 	io.Reader
 	net.Conn
 	*sync.Mutex
+
+	// Hello is what the endpoint reported about itself when it registered.
+	Hello *protocol.Hello
+	// Welcome is what the master agreed to serve it with.
+	Welcome *protocol.Welcome
+
+	// id names the replica within its ReplicaSet.
+	id string
+	// connected is when the replica joined its ReplicaSet.
+	connected time.Time
 }
 
 type CustomConcurrentMap struct {
@@ -88,7 +105,7 @@ func SetSecureHttpPort(port int) {
 func (customConcurrentMap *CustomConcurrentMap) Load(key string) (ConnWriter, bool) {
 	value, ok := customConcurrentMap.Map.Load(key)
 	if !ok {
-		Log(fmt.Sprintf("the endpoint %s is off. please restart brute.io", key))
+		Log(fmt.Sprintf("the endpoint %s is %s", key, RouteStateOf(key)))
 		return nil, false
 	}
 	return value.(ConnWriter), ok
@@ -119,6 +136,32 @@ type Config struct {
 	Remote     string  `yaml:"remote"`
 	Authorizer *string  `yaml:authorizer`
 	Routes     []Route `yaml:,flow`
+	Server     *ServerConfig `yaml:"server,omitempty"`
+	Internal   *InternalConfig `yaml:"internal,omitempty"`
+	Log        *LogConfig `yaml:"log,omitempty"`
+	AccessLog  *AccessLogConfig `yaml:"access_log,omitempty"`
+	EndpointLogs *EndpointLogConfig `yaml:"endpoint_logs,omitempty"`
+	Admin      *AdminConfig `yaml:"admin,omitempty"`
+	Tracing    *TracingConfig `yaml:"tracing,omitempty"`
+	RemoteControl *RemoteControlConfig `yaml:"remote_control,omitempty"`
+}
+
+// LogConfig is the log section of .brute.yml. BRUTE_LOG_LEVEL in the
+// environment overrides the level:
+//
+//	log:
+//	  level: debug
+//	  format: json
+//	  file: bin/brute.log
+//	  max_size: 10
+//	  max_backups: 5
+type LogConfig struct {
+	Level      string `yaml:"level"`
+	Format     string `yaml:"format"`
+	File       string `yaml:"file"`
+	// MaxSize is in megabytes.
+	MaxSize    int64  `yaml:"max_size"`
+	MaxBackups int    `yaml:"max_backups"`
 }
 
 type Route struct {
@@ -133,6 +176,21 @@ type RouteConfig struct {
 	Protected bool `yaml:"protected"`
 	Timeout   string `yaml:"timeout"`
 	Activate  string `yaml:"activate"`
+
+	// MaxInFlight limits the requests the endpoint serves at once, zero
+	// meaning no limit. Up to QueueLength more wait for at most QueueWait,
+	// the route timeout by default, before being shed with a 503.
+	MaxInFlight int    `yaml:"max_in_flight"`
+	QueueLength int    `yaml:"queue_length"`
+	QueueWait   string `yaml:"queue_wait"`
+
+	// Replicas is the number of processes started for the endpoint. The
+	// sessions are spread across them by Balance, round_robin by default
+	// or least_in_flight, and Sticky pins every client to one replica with
+	// a cookie.
+	Replicas int    `yaml:"replicas"`
+	Balance  string `yaml:"balance"`
+	Sticky   bool   `yaml:"sticky"`
 }
 
 type ControllerEndpoint struct {
@@ -141,60 +199,122 @@ type ControllerEndpoint struct {
 	runtimeFile string
 }
 
-type RequestSession struct {
-	store map[[32]byte]*ContextHolder
-	mutex sync.RWMutex
-}
 type ContextHolder struct {
 	RpcArguments map[string]string
+	PathVars     map[string]string
 	Stream       chan *EchoPacket
-	End          chan bool
 	Message		 url.Values
 	Method		 string
+	Request      *http.Request
+	Body         []byte
 	Route
+
+	// Traceparent is the trace context forwarded to the endpoint
+	Traceparent string
+
+	done    chan struct{}
+	once    sync.Once
+	mutex   sync.Mutex
+	closed  bool
+	expired bool
+	timer   *time.Timer
+	timeout time.Duration
 }
 
+// RpcRequest is what an endpoint receives for a session when it calls
+// RequestSession.AcceptRpc. It carries enough of the original request for
+// the endpoint to rebuild an *http.Request.
+type RpcRequest struct {
+	Method     string
+	Message    url.Values
+	Arguments  map[string]string
+	Vars       map[string]string
+	URI        string
+	Proto      string
+	Host       string
+	RemoteAddr string
+	Header     http.Header
+	Body       []byte
+
+	// Traceparent, when tracing, is the context of the span the endpoint's
+	// spans are children of. It replaces the traceparent of Header too.
+	Traceparent string
+}
+
+const maxRequestBody = 32 << 20
+
 type EchoPacket struct {
 	SessionId [32]byte
 	Body      []byte
 	Code	  int
+
+	// delivered, when set, is called once Delegate has handled the packet
+	delivered func()
 }
 
-func (sessions *RequestSession) AcceptRpc(id [32]byte, ack *struct{Method string; Message url.Values; Arguments map[string]string}) error {
-	sessions.mutex.RLock()
-	defer sessions.mutex.RUnlock()
+func (sessions *RequestSession) AcceptRpc(id [32]byte, ack *RpcRequest) (err error) {
+	defer observeRpc("AcceptRpc", &err)
+
+	session, err := sessions.Get(id)
+	if err != nil {
+		return err
+	}
+
+	session.fill(ack)
+	return nil
+}
 
-	session := sessions.store[id]
+func (session *ContextHolder) fill(ack *RpcRequest) {
 	ack.Method = session.Method
 	ack.Message = session.Message
 	ack.Arguments = session.RpcArguments
-	return nil
+	ack.Vars = session.PathVars
+	if r := session.Request; r != nil {
+		ack.URI = r.RequestURI
+		ack.Proto = r.Proto
+		ack.Host = r.Host
+		ack.RemoteAddr = r.RemoteAddr
+		ack.Header = forwardedHeader(r.Header, session.Traceparent)
+	}
+	ack.Body = session.Body
+	ack.Traceparent = session.Traceparent
 }
 
-func (sessions *RequestSession) Write(packet *EchoPacket, ack *bool) error {
-	sessions.mutex.RLock()
-	defer sessions.mutex.RUnlock()
+func (sessions *RequestSession) Write(packet *EchoPacket, ack *bool) (err error) {
+	defer observeRpc("Write", &err)
+
+	session, err := sessions.Get(packet.SessionId)
+	if err != nil {
+		return err
+	}
 
-	session := sessions.store[packet.SessionId]
-	session.Stream <- packet
+	if err := session.send(packet); err != nil {
+		return err
+	}
 
 	*ack = true
 	return nil
 }
 
-func (sessions *RequestSession) Close(packet *EchoPacket, ack *bool) error {
-	sessions.mutex.RLock()
-	defer sessions.mutex.RUnlock()
+func (sessions *RequestSession) Close(packet *EchoPacket, ack *bool) (err error) {
+	defer observeRpc("Close", &err)
 
-	session := sessions.store[packet.SessionId]
-	close(session.Stream)
-	session.End <- true
+	session, err := sessions.Get(packet.SessionId)
+	if err != nil {
+		return err
+	}
+
+	if !session.end(false) {
+		return sessionClosedError
+	}
 
 	*ack = true
 	return nil
 }
 
-func Delegate(w http.ResponseWriter, stream <-chan *EchoPacket) {
+// Delegate writes the packets of a session to w until the stream closes,
+// and reports whether the status code was written.
+func Delegate(w http.ResponseWriter, stream <-chan *EchoPacket) (wroteHeader bool) {
 	for buf := range stream {
 		switch buf.Code {
 		case 700:
@@ -202,7 +322,8 @@ func Delegate(w http.ResponseWriter, stream <-chan *EchoPacket) {
 				ProjectName string
 				Message string
 			}{projectName, string(buf.Body)})
-		case 40:
+			wroteHeader = true
+		case 40, 41:
 			buffer := buf.Body
 			delimit := len(buffer)
 			for i, c := range buffer {
@@ -211,16 +332,31 @@ func Delegate(w http.ResponseWriter, stream <-chan *EchoPacket) {
 					break
 				}
 			}
-			w.Header().Set(string(buffer[:delimit]), string(buffer[delimit+1:]))
+			var value string
+			if delimit < len(buffer) {
+				value = string(buffer[delimit+1:])
+			}
+			if buf.Code == 40 {
+				w.Header().Set(string(buffer[:delimit]), value)
+			} else {
+				w.Header().Add(string(buffer[:delimit]), value)
+			}
 		default:
 			if len(buf.Body) >= 3 && string(buf.Body[:3]) == "~ct" {
 				w.Header().Set("Content-Type", string(buf.Body[3:]))
 			} else {
-				w.WriteHeader(buf.Code)
+				if !wroteHeader {
+					w.WriteHeader(buf.Code)
+					wroteHeader = true
+				}
 				w.Write(buf.Body)
 			}
 		}
+		if buf.delivered != nil {
+			buf.delivered()
+		}
 	}
+	return
 }
 
 func init() {
@@ -229,10 +365,40 @@ func init() {
 		log.Fatal(err)
 	}
 	cwd = _cwd
-	requestSession.store = make(map[[32]byte]*ContextHolder)
 }
 
 func New(config *Config) {
+	if config.Log != nil {
+		if err := Configure(Options{
+			Level:      config.Log.Level,
+			Format:     config.Log.Format,
+			File:       config.Log.File,
+			MaxSize:    config.Log.MaxSize << 20,
+			MaxBackups: config.Log.MaxBackups,
+		}); err != nil {
+			LogError(ErrorLog{err, fmt.Sprintf("Invalid log configuration: %v", err)})
+		}
+	}
+
+	if config.EndpointLogs != nil {
+		endpointLogs = config.EndpointLogs
+	}
+
+	if config.Tracing != nil {
+		if err := startTracing(config.Tracing); err != nil {
+			LogError(ErrorLog{err, fmt.Sprintf("Could not start tracing: %v", err)})
+		}
+	}
+
+	if config.AccessLog != nil {
+		logger, err := OpenAccessLog(config.AccessLog)
+		if err != nil {
+			LogError(ErrorLog{err, fmt.Sprintf("Could not open the access log: %v", err)})
+		} else {
+			accessLog = logger
+		}
+	}
+
 	//os.Mkdir("bin", 0700)
 	os.MkdirAll("bin/endpoints", 0700)
 	//os.Mkdir("bin/hosted", 0700)
@@ -243,6 +409,14 @@ func New(config *Config) {
 	os.MkdirAll("bin/temp/broken", 0700)
 	os.MkdirAll("bin/build", 0700)
 
+	activeConfig = config
+	for _, route := range config.Routes {
+		requireRoutes(route.Directory)
+	}
+	if config.Authorizer != nil {
+		requireRoutes(*config.Authorizer)
+	}
+
 	for i := range config.Routes {
 		config.Routes[i].config = config
 		buildEndpoint(config.Routes[i])
@@ -250,17 +424,15 @@ func New(config *Config) {
 
 	r = mux.NewRouter()
 
-	addy, err := net.ResolveTCPAddr("tcp", "localhost:12000")
-	if err != nil {
-		log.Fatal(err)
-	}
+	internalServices = config.internal()
 
-	inbound, err := net.ListenTCP("tcp", addy)
+	inbound, err := Listen(internalServices.Rpc)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	rpc.Register(&requestSession)
+	closeOnShutdown(inbound)
 	go rpc.Accept(inbound)
 }
 
@@ -273,12 +445,9 @@ func SetProjectName(name string) {
 	projectName = name
 }
 
-func CleanUp() {
-	os.Remove("bin")
-}
-
 func rebuildRootEndpoint(route Route) (string, error) {
 	Log("Building " + route.Directory)
+	setRouteState(route.Directory, StateBuilding, "")
 
 	tmpBuilds := filepath.Join("bin", "build")
 	endpointBuilds := filepath.Join("bin", "endpoints")
@@ -289,6 +458,7 @@ func rebuildRootEndpoint(route Route) (string, error) {
 		routeDirectory = filepath.Join(cwd, "src", route.Directory)
 
 		if _, err := os.Stat(routeDirectory); os.IsNotExist(err) {
+			setRouteState(route.Directory, StateBroken, noSuchRouteError.Error())
 			return "", noSuchRouteError
 		}
 	} else if route.config != nil {
@@ -302,6 +472,9 @@ func rebuildRootEndpoint(route Route) (string, error) {
 
 	sourceFile := filepath.Join(routeDirectory, "main.go")
 
+	start := time.Now()
+	defer buildDuration.ObserveSince(start, route.Directory)
+
 	cmd := exec.Command(gotool, "build", "-o", out, sourceFile)
 
 	stdout, err := cmd.StderrPipe()
@@ -322,13 +495,17 @@ func rebuildRootEndpoint(route Route) (string, error) {
 	}
 
 	if err := cmd.Wait(); err != nil {
+		buildFailures.Inc(route.Directory)
+		setRouteState(route.Directory, StateBroken, buildFailure(reason, err))
 		return "", err
 	} else {
 		Log("Done!\n")
-		err := os.Rename(out, filepath.Join(cwd, endpointBuilds, route.Directory))
+		binary := filepath.Join(cwd, endpointBuilds, route.Directory)
+		err := os.Rename(out, binary)
 		if err != nil {
 			panic(err)
 		}
+		recordBuild(route.Directory, binary)
 		return routeDirectory, nil
 	}
 
@@ -338,7 +515,30 @@ func rebuildEndpoint(route Route) (string, error) {
 	return rebuildRootEndpoint(route)
 }
 
+// watchers are the channels of the sources watched for changes.
+var watchers struct {
+	sync.Mutex
+	channels []chan notify.EventInfo
+}
+
+// stopWatching stops rebuilding the endpoints when their sources change.
+func stopWatching() {
+	watchers.Lock()
+	defer watchers.Unlock()
+
+	for _, c := range watchers.channels {
+		notify.Stop(c)
+		close(c)
+	}
+	watchers.channels = nil
+}
+
 func buildEndpoint(route Route) {
+	if runsPrebuilt() {
+		recordBuild(route.Directory, endpointBinary(route.Directory))
+		return
+	}
+
 	sourceEndpointDirectory, err := rebuildEndpoint(route)
 	if err != nil {
 		LogError(ErrorLog{err, err.Error()})
@@ -349,15 +549,21 @@ func buildEndpoint(route Route) {
 	if err := notify.Watch(sourceEndpointDirectory, c, notify.All); err != nil {
 		log.Fatal(err)
 	}
+	watchers.Lock()
+	watchers.channels = append(watchers.channels, c)
+	watchers.Unlock()
 	go func(c <-chan notify.EventInfo) {
 		for range c {
 			Log(fmt.Sprintf("Attempting to restart %s due to code changes...\n", route.Directory))
 			if endpoint, ok := endpoints.Load(route.Directory); ok {
 				_, err := rebuildEndpoint(route)
 				if err == nil {
+					hotReloads.Inc(route.Directory, "success")
+					endpointRestarts.Inc(route.Directory)
 					endpoints.Delete(route.Directory)
 					StartEndpoint(route)
 				} else {
+					hotReloads.Inc(route.Directory, "failure")
 					log.Println(err)
 				}
 
@@ -372,25 +578,46 @@ func buildEndpoint(route Route) {
 	}(c)
 }
 
-func HostRootEndpoint() {
+func HostRootEndpoint(config *Config) {
 	root := Route{Path: "", Directory: "root"}
+	source := endpointBinary(root.Directory)
+
+	if runsPrebuilt() && !regularFile(source) {
+		// The bundle was built without a root endpoint
+		return
+	}
 
 	buildEndpoint(root)
+	startingRoute(root.Directory)
 	StartRootEndpoint(root)
 
-	source := filepath.Join(cwd, "bin", "endpoints", "root")
 	endpoint := &ControllerEndpoint{projectName, root, source}
 
-	r.Handle("/", endpoint).Name("root")
+	r.Handle("/", instrumentRoute(config, root, endpoint.ServeHTTP)).Name("root")
 }
 
-func Deploy(config *Config) {
-	CleanUp()
+// instrumentRoute records the requests served by handleFunc in the access
+// log and the metrics, and traces them, as far as config enables them.
+func instrumentRoute(config *Config, route Route, handleFunc http.HandlerFunc) http.HandlerFunc {
+	var done []func(*AccessRecord)
+	if accessLog != nil {
+		done = append(done, accessLog.Write)
+	}
+	if config.Admin != nil {
+		done = append(done, observeRequest)
+	}
+	if len(done) > 0 {
+		handleFunc = recordRequests(route, handleFunc, done...)
+	}
+	if tracer != nil {
+		handleFunc = traceRoute(route, handleFunc)
+	}
+	return handleFunc
+}
 
+func Deploy(config *Config) {
 	for _, route := range config.Routes {
-		build := filepath.Join(cwd, "bin", "endpoints", route.Directory)
-
-		endpoint := &ControllerEndpoint{config.Name, route, build}
+		endpoint := &ControllerEndpoint{config.Name, route, endpointBinary(route.Directory)}
 		handleFunc := endpoint.ServeHTTP
 		if config.Authorizer != nil && route.RouteConfig != nil {
 			handleFunc = LoadAuthorizer(route).
@@ -398,7 +625,12 @@ func Deploy(config *Config) {
 					Failed(defaultUnauthorizedHandler).
 						Handler()
 		}
-		r.HandleFunc(route.Path, handleFunc).Name(route.Directory)
+		r.HandleFunc(route.Path, instrumentRoute(config, route, handleFunc)).Name(route.Directory)
+	}
+
+	if config.Admin == nil {
+		r.HandleFunc(LivenessPath, livenessHandler)
+		r.HandleFunc(ReadinessPath, readinessHandler)
 	}
 
 	r.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
@@ -414,46 +646,83 @@ func Deploy(config *Config) {
 	r.NotFoundHandler = http.HandlerFunc(defaultNotFoundHandler)
 	HostStaticFiles()
 
-	HostRootEndpoint()
+	HostRootEndpoint(config)
 
-	srv := &http.Server{Addr: ":"+strconv.Itoa(httpPort), Handler: http.HandlerFunc(func (w http.ResponseWriter, req *http.Request) {
-		target := fmt.Sprintf("https://%s:%d%s", req.Host, httpsPort, req.URL.Path)
-		if len(req.URL.RawQuery) > 0 {
-			target += "?" + req.URL.RawQuery
-		}
-		w.Header().Set("server", "brute.io")
-		w.Header().Add("X-comment", "You must use HTTPS next time.")
-		http.Redirect(w, req, target,
-			http.StatusTemporaryRedirect)
-	})}
+	serveAdmin(config)
+	serveRemoteControl(config)
 
-	srv.SetKeepAlivesEnabled(true)
+	var handler http.Handler = r
+	if tracer != nil {
+		handler = traceRequests(r)
+	}
+	listenAndServe(config, handler)
+}
 
-	go srv.ListenAndServe()
+func AddEndpoint(route *Route) {
 
-	secureSrv := &http.Server{Addr: ":" + strconv.Itoa(httpsPort), Handler: r}
-	secureSrv.SetKeepAlivesEnabled(true)
-	secureSrv.ListenAndServeTLS("cert.pem", "tls.key")
 }
 
-func AddEndpoint(route *Route) {
+// removedEndpoints holds the directories of the routes removed while the
+// master runs, answered with 404 until it restarts.
+var removedEndpoints sync.Map
+
+// RemoveEndpoint stops serving the route of directory. Its replicas exit
+// once their sessions are closed.
+func RemoveEndpoint(directory string) error {
+	val, ok := endpoints.Map.Load(directory)
+	if !ok {
+		return noSuchRouteError
+	}
+
+	removedEndpoints.Store(directory, true)
+	endpoints.Delete(directory)
+	forgetRoute(directory)
 
+	reloading.Lock()
+	delete(reloading.sets, directory)
+	reloading.Unlock()
+
+	if set, ok := val.(*ReplicaSet); ok {
+		set.Shutdown()
+	}
+
+	Log(fmt.Sprintf("Removed endpoint %s", directory))
+	return nil
 }
 
+// RandomSessionId is kept for compatibility; the ID no longer depends on
+// its arguments. Use NewSessionId instead.
 func RandomSessionId(ip string, unixSeconds int64) [32]byte {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(unixSeconds))
-
-	r := make([]byte, 4)
-	binary.LittleEndian.PutUint16(r, RandomNumber())
+	sid, err := NewSessionId()
+	if err != nil {
+		panic(err)
+	}
+	return sid
+}
 
-	hash := sha256.New()
-	hash.Write(append([]byte(ip), append(b, r...)...))
+// readBody reads the body of r, up to maxRequestBody, and parses its form.
+// r.Body is then left to be read again from the start. It answers the
+// request and returns false when the body cannot be read.
+func readBody(w http.ResponseWriter, r *http.Request, route Route) ([]byte, bool) {
+	if r.Body == nil {
+		r.ParseForm()
+		return nil, true
+	}
 
-	var finalHash [32]byte
-	copy(finalHash[:], hash.Sum(nil))
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBody))
+	if tooLarge := new(http.MaxBytesError); errors.As(err, &tooLarge) {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return nil, false
+	} else if err != nil {
+		LogError(ErrorLog{err, fmt.Sprintf("Could not read the request body for %s: %v", route.Directory, err)})
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return nil, false
+	}
 
-	return finalHash
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ParseForm()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, true
 }
 
 func (controller *ControllerEndpoint) RedirectEndpointOnLoading(w http.ResponseWriter, r *http.Request) {
@@ -465,11 +734,27 @@ func (controller *ControllerEndpoint) RedirectEndpointOnError(w http.ResponseWri
 }
 
 func (controller *ControllerEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	sid := RandomSessionId(r.RemoteAddr, time.Now().Unix())
+	sid, err := NewSessionId()
+	if err != nil {
+		LogError(ErrorLog{err, fmt.Sprintf("Could not create a session for %s: %v", controller.Route.Directory, err)})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("X-Brute-Session-ID", hex.EncodeToString(sid[:]))
 	w.Header().Set("Server", "brute.io")
 
+	record := accessRecordOf(r)
+	if record != nil {
+		record.SessionId = hex.EncodeToString(sid[:])
+	}
+
+	if _, removed := removedEndpoints.Load(controller.Route.Directory); removed {
+		defaultNotFoundHandler(w, r)
+		return
+	}
+
+	var set *ReplicaSet
 	if val, ok := endpoints.Load(controller.Route.Directory); !ok {
 		controller.RedirectEndpointOnLoading(w, r)
 		return
@@ -478,19 +763,33 @@ func (controller *ControllerEndpoint) ServeHTTP(w http.ResponseWriter, r *http.R
 		case EndpointFunc:
 			controller.RedirectEndpointOnError(w, r, v)
 			return
+		case *ReplicaSet:
+			set = v
 		}
 	}
 
-	context := &ContextHolder{Stream: make(chan *EchoPacket, 100), End: make(chan bool, 1)}
-	defer close(context.End)
+	if limiter := limiterFor(controller.Route); limiter != nil {
+		if err := limiter.Acquire(r.Context().Done()); err != nil {
+			if err != clientGoneError {
+				Log(fmt.Sprintf("Shedding a request to endpoint %s: %v", controller.Route.Directory, err))
+			}
+			w.Header().Set("Retry-After", limiter.RetryAfter())
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		defer limiter.Release()
+	}
 
-	requestSession.mutex.Lock()
-	requestSession.store[sid] = context
-	requestSession.mutex.Unlock()
+	context := newContextHolder(controller.Route)
 
-	context.Route = controller.Route
+	requestSession.Add(sid, context)
+	defer requestSession.Remove(sid)
 
-	pathArgs := mux.Vars(r)
+	pathVars := mux.Vars(r)
+	pathArgs := make(map[string]string, len(pathVars))
+	for k, v := range pathVars {
+		pathArgs[k] = v
+	}
 	for k, v := range r.URL.Query() {
 		if existing, ok := pathArgs[k]; ok {
 			log.Printf("Path through key %s already exists. [existing: %v, this: %v]", k, existing, v)
@@ -501,17 +800,60 @@ func (controller *ControllerEndpoint) ServeHTTP(w http.ResponseWriter, r *http.R
 
 	context.Method = r.Method
 	context.RpcArguments = pathArgs
+	context.PathVars = pathVars
+	context.Request = r
 
-	r.ParseForm()
+	body, ok := readBody(w, r, controller.Route)
+	if !ok {
+		return
+	}
+	context.Body = body
 	context.Message = r.Form
 
-	if endpoint, ok := endpoints.Load(controller.Route.Directory); ok {
-		endpoint.Write(sid[:])
+	dispatch := spanOf(r).Child("dispatch")
+	dispatch.SetAttribute("brute.route", controller.Route.Directory)
+
+	var replica *ConnWrite
+	if set != nil {
+		replica = set.Pick(w, r)
+	}
+	if replica == nil {
+		dispatch.SetAttribute("brute.loading", true)
+		dispatch.Finish()
+		controller.RedirectEndpointOnLoading(w, r)
+		return
+	}
+	dispatch.SetAttribute("brute.replica", replica.id)
+	context.Traceparent = dispatch.Traceparent()
+
+	if record != nil {
+		record.Replica = replica.id
 	}
 
-	Delegate(w, context.Stream)
+	atomic.AddInt64(&replica.inFlight, 1)
+	defer atomic.AddInt64(&replica.inFlight, -1)
 
-	<-context.End
+	stop := context.watch(r.Context().Done())
+	defer stop()
+
+	err = replica.Dispatch(sid, context)
+	dispatch.SetError(err)
+	dispatch.Finish()
+	if err != nil {
+		LogError(ErrorLog{err, fmt.Sprintf("Could not dispatch a request to endpoint %s: %v", controller.Route.Directory, err)})
+		set.Remove(replica)
+		replica.Close()
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	delegate := spanOf(r).Child("delegate")
+	defer delegate.Finish()
+
+	if !Delegate(w, context.Stream) && context.expired {
+		delegate.SetError(sessionExpiredError)
+		http.Error(w, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+	}
 }
 
 func StartAuthorizer(config *Config) {
@@ -537,84 +879,163 @@ func StartRootEndpoint(route Route) {
 
 	var out string
 	var env string
+	var name string
 	if len(route.Path) > 0 {
-		out = filepath.Join(cwd, "bin", "endpoints", route.Directory)
-		env = fmt.Sprintf("ROUTE=%s", route.Directory)
+		out = endpointBinary(route.Directory)
+		name = route.Directory
+		env = fmt.Sprintf("ROUTE=%s", name)
 	} else {
 		if route.config == nil {
-			out = filepath.Join(cwd, "bin", "endpoints", "root")
-			env = fmt.Sprintf("ROUTE=%s", "root")
+			out = endpointBinary("root")
+			name = "root"
+			env = fmt.Sprintf("ROUTE=%s", name)
 		} else {
-			env = fmt.Sprintf("ROUTE=%s;AUTHORIZER=true", route.Directory)
-			out = filepath.Join(cwd, "bin", "endpoints", route.Directory)
+			name = route.Directory
+			env = fmt.Sprintf("ROUTE=%s;AUTHORIZER=true", name)
+			out = endpointBinary(route.Directory)
 		}
 	}
 
+	token := registrationTokens.Issue(name)
+	env += fmt.Sprintf(";%s=%s", registrationTokenEnv, token)
+	env += fmt.Sprintf(";%s=%s;%s=%s",
+		protocol.EndpointServiceEnv, endpointAddress(internalServices.Endpoints),
+		protocol.RpcServiceEnv, endpointAddress(internalServices.Rpc))
+	if tracing != nil {
+		env += tracing.endpointEnv(name)
+	}
+
+	generation := routeGeneration(name)
+
 	cmd := exec.Command(out)
 	cmd.Env = strings.Split(env, ";")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	//cmdOut, _ := cmd.StdoutPipe()
+	output := outputOf(name)
+	stdout, stderr := output.Writer(cmd, "stdout"), output.Writer(cmd, "stderr")
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
 	err := cmd.Start()
 	if err != nil {
+		registrationTokens.Revoke(token)
 		LogError(ErrorLog{err, fmt.Sprintf("Could not run endpoint daemon %s", route.Directory)})
+		routeExited(name, generation, err)
+		return
 	}
+	children.Track(cmd, func(err error) {
+		// A process exiting before it registered leaves its token unused
+		registrationTokens.Revoke(token)
+
+		// The last line of a crash often lacks its newline
+		stdout.Flush()
+		stderr.Flush()
+		routeExited(name, generation, err)
+	})
 }
 
+// StartEndpoint starts the processes of route, one per replica.
 func StartEndpoint(route Route) {
-	StartRootEndpoint(route)
+	if _, ok := endpoints.Map.Load(route.Directory); !ok {
+		endpoints.Store(route.Directory, newReplicaSet(route))
+	}
+	startingRoute(route.Directory)
+
+	for i := 0; i < route.replicas(); i++ {
+		StartRootEndpoint(route)
+	}
 }
 
 func RunEndpointService() net.Listener {
 	Log("Starting Endpoint Service...")
 
-	l, err := net.Listen("tcp", ":11000")
+	l, err := Listen(internalServices.Endpoints)
 	if err != nil {
 		LogError(ErrorLog{err, fmt.Sprintf("Can't start listening for endpoints: %v", err)})
+		CloseLogger()
 		os.Exit(1)
 	}
 
+	closeOnShutdown(l)
+
 	go func() {
 		for {
 			// Listen for an incoming connection.
 			conn, err := l.Accept()
 
 			if err != nil {
+				if ShuttingDown() {
+					return
+				}
 				LogError(ErrorLog{err, fmt.Sprintf("Error accepting: %v", err.Error())})
 				continue
 			}
 
 			Log("Incoming endpoint connection: " + conn.RemoteAddr().String())
 
-			bin := make([]byte, 5)
-			conn.Read(bin)
+			// A connection stalling its handshake must not hold back the
+			// registration of the others
+			go registerEndpoint(conn)
+		}
+	}()
 
-			if !HandshakeFormat(bin) {
-				Log("Cannot accept an incoming connection")
-				continue
-			}
+	return l
+}
+
+// endpointCapabilities are the protocol capabilities this master supports.
+var endpointCapabilities = []string{protocol.CapabilityStreaming, protocol.CapabilityMultiplex}
 
-			size := make([]byte, 4)
-			conn.Read(size)
+// registerEndpoint adds the replica on conn to its route once it completed
+// the handshake.
+func registerEndpoint(conn net.Conn) {
+	hello, welcome, err := acceptEndpoint(conn)
+	if err != nil {
+		Log(fmt.Sprintf("Rejected endpoint registration from %s: %v", conn.RemoteAddr(), err))
+		endpointConnections.Inc("rejected")
+		conn.Close()
+		return
+	}
 
-			s, _ := strconv.Atoi(string(size))
-			block := make([]byte, s)
-			conn.Read(block)
+	routeDirectory := hello.Route
+	endpointConnections.Inc("accepted")
 
-			routeDirectory := string(block)
+	Log(fmt.Sprintf("Connection accepted from %s (pid %d, protocol v%d)\n", routeDirectory, hello.PID, hello.Version))
 
-			Log(fmt.Sprintf("Connection accepted from %s\n", routeDirectory))
+	connWriter := &ConnWrite{Mutex: new(sync.Mutex), Conn: conn, Hello: hello, Welcome: welcome}
+	watchReplica(registerReplica(routeDirectory, connWriter), connWriter)
+}
 
-			endpoints.Store(routeDirectory, &ConnWrite{Mutex: new(sync.Mutex), Conn: conn})
-		}
-	}()
+// acceptEndpoint performs the master side of the handshake described in
+// package protocol. It returns the endpoint's hello once its protocol
+// version is compatible and its registration token is redeemed.
+func acceptEndpoint(conn net.Conn) (*protocol.Hello, *protocol.Welcome, error) {
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
 
-	return l
+	hello, err := protocol.ReadHello(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	welcome, err := protocol.Negotiate(hello, endpointCapabilities)
+	if err != nil {
+		protocol.WriteMessage(conn, protocol.FrameReject, protocol.Reject{Reason: err.Error()})
+		return nil, nil, err
+	}
+
+	if err := registrationTokens.Redeem(hello.Token, hello.Route); err != nil {
+		err = fmt.Errorf("route %s: %v", hello.Route, err)
+		protocol.WriteMessage(conn, protocol.FrameReject, protocol.Reject{Reason: err.Error()})
+		return nil, nil, err
+	}
+
+	if err := protocol.WriteMessage(conn, protocol.FrameWelcome, welcome); err != nil {
+		return nil, nil, err
+	}
+
+	return hello, welcome, nil
 }
 
 func HandshakeFormat(initial []byte) bool {
 	for i, m := range initial {
-		if uint8(m) != uint8(magicNumber[i]) {
+		if uint8(m) != uint8(protocol.Magic[i]) {
 			return false
 		}
 	}
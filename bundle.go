@@ -0,0 +1,608 @@
+package brute
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	. "github.com/rrborja/brute/log"
+)
+
+// Entries of a project bundle, the archive a master is deployed from:
+//
+//	manifest.json       what the bundle holds, with the hash of every file
+//	.brute.yml          the project, its defaults resolved
+//	endpoints/<route>   the binaries of the routes, the root endpoint and
+//	                    the authorizer
+//	hosted/...          the static assets of bin/hosted
+const (
+	bundleManifest  = "manifest.json"
+	bundleConfig    = ".brute.yml"
+	bundleEndpoints = "endpoints"
+	bundleHosted    = "hosted"
+)
+
+var (
+	unsafeBundlePathError = errors.New("bundle entry escapes the bundle")
+	noBundleConfigError   = errors.New("the bundle has no .brute.yml")
+	noBundleManifestError = errors.New("the bundle has no manifest.json")
+)
+
+// currentRelease is the link under bin to the release the master runs
+// from. Switching it switches the endpoints and the assets at once.
+const currentRelease = "current"
+
+// prebuilt is set once the master runs from a release. Its endpoints are
+// then started from bin/current/endpoints, neither built nor watched.
+var prebuilt int32
+
+func runsPrebuilt() bool {
+	return atomic.LoadInt32(&prebuilt) == 1
+}
+
+// endpointBinary is the binary the endpoint name is started from: that of
+// the active release, or else the one the master built.
+func endpointBinary(name string) string {
+	if runsPrebuilt() {
+		return filepath.Join(cwd, "bin", currentRelease, bundleEndpoints, name)
+	}
+	return filepath.Join(cwd, "bin", "endpoints", name)
+}
+
+// Manifest describes a bundle.
+type Manifest struct {
+	Project string    `json:"project"`
+	Version string    `json:"version"`
+	Brute   string    `json:"brute,omitempty"`
+	GOOS    string    `json:"goos"`
+	GOARCH  string    `json:"goarch"`
+	Created time.Time `json:"created"`
+
+	// Files are the sha256 of the files of the bundle by their path.
+	Files map[string]string `json:"files"`
+}
+
+// Platform is the GOOS/GOARCH the binaries of the bundle run on.
+func (manifest *Manifest) Platform() string {
+	return manifest.GOOS + "/" + manifest.GOARCH
+}
+
+// Platform is the GOOS/GOARCH of this master.
+func Platform() string {
+	return runtime.GOOS + "/" + runtime.GOARCH
+}
+
+// BuildOptions are the options of BuildBundle. Empty GOOS and GOARCH build
+// for this machine, an empty Version is the time of the build.
+type BuildOptions struct {
+	Out     string
+	Version string
+	GOOS    string
+	GOARCH  string
+}
+
+// BuildBundle compiles the project in dir into a bundle written to the Out
+// directory, and returns the path of the bundle and its manifest.
+func BuildBundle(config *Config, dir string, options BuildOptions) (string, *Manifest, error) {
+	manifest := &Manifest{
+		Project: config.Name,
+		Version: options.Version,
+		Brute:   version,
+		GOOS:    options.GOOS,
+		GOARCH:  options.GOARCH,
+		Created: time.Now().UTC(),
+	}
+	if manifest.Version == "" {
+		manifest.Version = manifest.Created.Format("20060102150405")
+	}
+	if manifest.GOOS == "" {
+		manifest.GOOS = runtime.GOOS
+	}
+	if manifest.GOARCH == "" {
+		manifest.GOARCH = runtime.GOARCH
+	}
+	if strings.ContainsAny(manifest.Version, `/\ `) {
+		return "", nil, fmt.Errorf("invalid version %q", manifest.Version)
+	}
+
+	staging, err := ioutil.TempDir("", "brute-bundle-")
+	if err != nil {
+		return "", nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	sources := make(map[string]string)
+	for _, route := range config.Routes {
+		sources[route.Directory] = filepath.Join(dir, "src", route.Directory, "main.go")
+	}
+	if config.Authorizer != nil {
+		sources[*config.Authorizer] = filepath.Join(dir, "src", *config.Authorizer, "main.go")
+	}
+	if root := filepath.Join(dir, "src", "main.go"); regularFile(root) {
+		sources["root"] = root
+	}
+
+	for name, source := range sources {
+		out := filepath.Join(staging, bundleEndpoints, name)
+		if err := compileEndpoint(source, out, manifest.GOOS, manifest.GOARCH); err != nil {
+			return "", nil, fmt.Errorf("build %s: %v", name, err)
+		}
+	}
+
+	if err := copyTree(filepath.Join(dir, "bin", "hosted"), filepath.Join(staging, bundleHosted)); err != nil {
+		return "", nil, err
+	}
+
+	resolved := *config
+	resolved.Internal = config.internal()
+	resolved.Remote = ""
+	data, err := yaml.Marshal(&resolved)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(staging, bundleConfig), data, 0600); err != nil {
+		return "", nil, err
+	}
+
+	if err := writeManifest(staging, manifest); err != nil {
+		return "", nil, err
+	}
+
+	if err := os.MkdirAll(options.Out, 0700); err != nil {
+		return "", nil, err
+	}
+	name := fmt.Sprintf("%s-%s-%s-%s.tar.gz", bundleName(config.Name), manifest.Version, manifest.GOOS, manifest.GOARCH)
+	bundle := filepath.Join(options.Out, name)
+
+	f, err := os.Create(bundle)
+	if err != nil {
+		return "", nil, err
+	}
+	err = WriteBundle(f, staging)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(bundle)
+		return "", nil, err
+	}
+	return bundle, manifest, nil
+}
+
+func bundleName(project string) string {
+	if project == "" {
+		return "brute"
+	}
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ' ' {
+			return '-'
+		}
+		return r
+	}, project)
+}
+
+// compileEndpoint builds the endpoint of source for a platform.
+func compileEndpoint(source, out, goos, goarch string) error {
+	if !regularFile(source) {
+		return fmt.Errorf("no source %s", source)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(out), 0700); err != nil {
+		return err
+	}
+
+	cmd := exec.Command(gotool, "build", "-o", out, source)
+	cmd.Env = append(os.Environ(), "GOOS="+goos, "GOARCH="+goarch)
+	if goos != runtime.GOOS || goarch != runtime.GOARCH {
+		cmd.Env = append(cmd.Env, "CGO_ENABLED=0")
+	}
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v\n%s", err, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
+
+func regularFile(name string) bool {
+	info, err := os.Stat(name)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// copyTree copies the files under src, if there is such a directory.
+func copyTree(src, dest string) error {
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		return nil
+	}
+
+	return filepath.Walk(src, func(name string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(src, name)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		target := filepath.Join(dest, rel)
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return err
+		}
+		return writeBundleFile(target, f, info.Mode().Perm())
+	})
+}
+
+// writeManifest hashes the files under dir into manifest and writes it.
+func writeManifest(dir string, manifest *Manifest) error {
+	files, err := hashTree(dir)
+	if err != nil {
+		return err
+	}
+	manifest.Files = files
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, bundleManifest), data, 0600)
+}
+
+// hashTree returns the hashes of the files under dir but the manifest.
+func hashTree(dir string) (map[string]string, error) {
+	files := make(map[string]string)
+	err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == bundleManifest {
+			return nil
+		}
+
+		hash, err := hashFile(name)
+		if err != nil {
+			return err
+		}
+		files[rel] = hash
+		return nil
+	})
+	return files, err
+}
+
+// WriteBundle archives the bundle staged in dir.
+func WriteBundle(w io.Writer, dir string) error {
+	var names []string
+	err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			names = append(names, name)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	for _, name := range names {
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		if err := addBundleFile(tw, name, filepath.ToSlash(rel)); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func addBundleFile(tw *tar.Writer, name, entry string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = entry
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// extractBundle unpacks a bundle into dest and verifies it.
+func extractBundle(r io.Reader, dest string) (*Config, *Manifest, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	tr := tar.NewReader(gz)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+
+		name := path.Clean(header.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return nil, nil, unsafeBundlePathError
+		}
+		target := filepath.Join(dest, filepath.FromSlash(name))
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return nil, nil, err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return nil, nil, err
+			}
+			if err := writeBundleFile(target, tr, os.FileMode(header.Mode).Perm()); err != nil {
+				return nil, nil, err
+			}
+		default:
+			return nil, nil, fmt.Errorf("unsupported bundle entry %s", header.Name)
+		}
+	}
+
+	return verifyBundle(dest)
+}
+
+// readManifest reads the manifest of a bundle archive without unpacking it.
+func readManifest(r io.Reader) (*Manifest, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, noBundleManifestError
+		} else if err != nil {
+			return nil, err
+		}
+		if path.Clean(header.Name) != bundleManifest {
+			continue
+		}
+
+		var manifest Manifest
+		if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+			return nil, fmt.Errorf("invalid manifest.json in the bundle: %v", err)
+		}
+		return &manifest, nil
+	}
+}
+
+// verifyBundle checks that an unpacked bundle is built for this platform,
+// matches its manifest, and has the binary of every route it configures.
+func verifyBundle(dir string) (*Config, *Manifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, bundleManifest))
+	if os.IsNotExist(err) {
+		return nil, nil, noBundleManifestError
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, nil, fmt.Errorf("invalid manifest.json in the bundle: %v", err)
+	}
+	if manifest.Platform() != Platform() {
+		return nil, nil, fmt.Errorf("the bundle is built for %s, not %s", manifest.Platform(), Platform())
+	}
+
+	files, err := hashTree(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, hash := range manifest.Files {
+		if files[name] != hash {
+			return nil, nil, fmt.Errorf("%s of the bundle does not match the manifest", name)
+		}
+		delete(files, name)
+	}
+	for name := range files {
+		return nil, nil, fmt.Errorf("%s of the bundle is not in the manifest", name)
+	}
+
+	config, err := readBundleConfig(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	directories := make([]string, 0, len(config.Routes)+1)
+	for _, route := range config.Routes {
+		directories = append(directories, route.Directory)
+	}
+	if config.Authorizer != nil {
+		directories = append(directories, *config.Authorizer)
+	}
+	for _, directory := range directories {
+		if !regularFile(filepath.Join(dir, bundleEndpoints, directory)) {
+			return nil, nil, fmt.Errorf("the bundle has no binary for endpoint %s", directory)
+		}
+	}
+
+	return config, &manifest, nil
+}
+
+// readBundleConfig reads the project of an unpacked bundle.
+func readBundleConfig(dir string) (*Config, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, bundleConfig))
+	if os.IsNotExist(err) {
+		return nil, noBundleConfigError
+	} else if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid .brute.yml in the bundle: %v", err)
+	}
+	return &config, nil
+}
+
+func writeBundleFile(name string, r io.Reader, perm os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm|0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// installRelease unpacks the bundle archive of the given hash under
+// bin/releases, unless it was installed before, and returns the release.
+func installRelease(bin string, archive io.Reader, hash string) (string, *Config, *Manifest, error) {
+	releases := filepath.Join(bin, "releases")
+	if err := os.MkdirAll(releases, 0700); err != nil {
+		return "", nil, nil, err
+	}
+
+	release := filepath.Join(releases, hash[:12])
+	if _, err := os.Stat(release); err == nil {
+		config, manifest, err := verifyBundle(release)
+		return release, config, manifest, err
+	}
+
+	extracting, err := ioutil.TempDir(releases, ".extract-")
+	if err != nil {
+		return "", nil, nil, err
+	}
+	config, manifest, err := extractBundle(archive, extracting)
+	if err == nil {
+		err = os.Rename(extracting, release)
+	}
+	if err != nil {
+		os.RemoveAll(extracting)
+		return "", nil, nil, err
+	}
+	return release, config, manifest, nil
+}
+
+// activateRelease points bin/current to the release by renaming a new link
+// over it, and has the master run from it. The sources are no longer
+// watched: a rebuild would not be what the release serves.
+func activateRelease(bin, release string) error {
+	target := release
+	if rel, err := filepath.Rel(bin, release); err == nil {
+		target = rel
+	}
+
+	link := filepath.Join(bin, currentRelease)
+	next := link + ".next"
+
+	os.Remove(next)
+	if err := os.Symlink(target, next); err != nil {
+		return err
+	}
+	if err := os.Rename(next, link); err != nil {
+		os.Remove(next)
+		return err
+	}
+
+	atomic.StoreInt32(&prebuilt, 1)
+	stopWatching()
+	return nil
+}
+
+// OpenBundle prepares the master to run from a bundle, an archive or the
+// directory it was unpacked in, and returns its project. The endpoints are
+// then started from the binaries of the bundle, without being built or
+// watched.
+func OpenBundle(bundle string) (*Config, error) {
+	bin := filepath.Join(cwd, "bin")
+	if err := os.MkdirAll(bin, 0700); err != nil {
+		return nil, err
+	}
+
+	var release string
+	var config *Config
+	var manifest *Manifest
+
+	if info, err := os.Stat(bundle); err != nil {
+		return nil, err
+	} else if info.IsDir() {
+		if release, err = filepath.Abs(bundle); err != nil {
+			return nil, err
+		}
+		if config, manifest, err = verifyBundle(release); err != nil {
+			return nil, err
+		}
+	} else {
+		hash, err := hashFile(bundle)
+		if err != nil {
+			return nil, err
+		}
+		f, err := os.Open(bundle)
+		if err != nil {
+			return nil, err
+		}
+		release, config, manifest, err = installRelease(bin, f, hash)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := activateRelease(bin, release); err != nil {
+		return nil, err
+	}
+
+	Log(fmt.Sprintf("Running %s %s from bundle %s", manifest.Project, manifest.Version, bundle))
+	return config, nil
+}
@@ -0,0 +1,143 @@
+package brute
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/rjeczalik/notify"
+	"github.com/stretchr/testify/assert"
+)
+
+const emptyEndpoint = "package main\n\nfunc main() {}\n"
+
+func TestBuildBundleOfTheProject(t *testing.T) {
+	dir, err := ioutil.TempDir("", "brute")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, source := range []string{"home", "auth", "."} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(dir, "src", source), 0700))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "src", source, "main.go"), []byte(emptyEndpoint), 0600))
+	}
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "bin", "hosted", "static"), 0700))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "bin", "hosted", "static", "app.css"), []byte("body {}"), 0600))
+
+	authorizer := "auth"
+	config := &Config{Name: "shop", Remote: "192.168.1.152", Authorizer: &authorizer, Routes: []Route{{Path: "/", Directory: "home"}}}
+	bundle, manifest, err := BuildBundle(config, dir, BuildOptions{Out: filepath.Join(dir, "dist"), Version: "1.2.0"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, filepath.Join(dir, "dist", "shop-1.2.0-"+runtime.GOOS+"-"+runtime.GOARCH+".tar.gz"), bundle)
+	assert.Equal(t, runtime.GOOS+"/"+runtime.GOARCH, manifest.Platform())
+	for _, file := range []string{"endpoints/home", "endpoints/auth", "endpoints/root", "hosted/static/app.css", ".brute.yml"} {
+		assert.Contains(t, manifest.Files, file)
+	}
+
+	release, err := ioutil.TempDir("", "brute")
+	assert.NoError(t, err)
+	defer os.RemoveAll(release)
+
+	f, err := os.Open(bundle)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	resolved, unpacked, err := extractBundle(f, release)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "1.2.0", unpacked.Version)
+	assert.Equal(t, "", resolved.Remote)
+	assert.Equal(t, defaultRpcService, resolved.Internal.Rpc)
+
+	// A file changed after the build fails the manifest
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(release, "endpoints", "home"), []byte("tampered"), 0700))
+	_, _, err = verifyBundle(release)
+	assert.Error(t, err)
+}
+
+func TestBuildBundleFailsOnCompileErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "brute")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "src", "home"), 0700))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "src", "home", "main.go"), []byte("package main\n\nfunc main() { x }\n"), 0600))
+
+	config := &Config{Name: "shop", Routes: []Route{{Path: "/", Directory: "home"}, {Path: "/users", Directory: "users"}}}
+	_, _, err = BuildBundle(config, dir, BuildOptions{Out: filepath.Join(dir, "dist")})
+	assert.Error(t, err)
+
+	_, err = os.Stat(filepath.Join(dir, "dist"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestMasterRunsFromABundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "brute")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	previous := cwd
+	cwd = dir
+	defer func() {
+		cwd = previous
+		prebuilt = 0
+	}()
+
+	bundle := testBundle(t, remoteProject, "home", "users")
+	defer os.Remove(bundle)
+
+	config, err := OpenBundle(bundle)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, runsPrebuilt())
+	assert.Len(t, config.Routes, 2)
+
+	data, err := ioutil.ReadFile(endpointBinary("users"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "# users")
+
+	// Another release replaces the endpoints in a single rename
+	next := testBundle(t, strings.Replace(remoteProject, "users", "accounts", -1), "home", "accounts")
+	defer os.Remove(next)
+
+	config, err = OpenBundle(next)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "accounts", config.Routes[1].Directory)
+	assert.True(t, regularFile(endpointBinary("accounts")))
+	assert.False(t, regularFile(endpointBinary("users")))
+
+	_, err = os.Lstat(filepath.Join(dir, "bin", currentRelease+".next"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestActiveReleaseStopsWatchingTheSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "brute")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer func() { prebuilt = 0 }()
+
+	src := filepath.Join(dir, "src", "home")
+	assert.NoError(t, os.MkdirAll(src, 0700))
+	c := make(chan notify.EventInfo, 1)
+	assert.NoError(t, notify.Watch(src, c, notify.All))
+	watchers.Lock()
+	watchers.channels = append(watchers.channels, c)
+	watchers.Unlock()
+
+	release := filepath.Join(dir, "bin", "releases", "1")
+	assert.NoError(t, os.MkdirAll(release, 0700))
+	assert.NoError(t, activateRelease(filepath.Join(dir, "bin"), release))
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(src, "main.go"), []byte(emptyEndpoint), 0600))
+	_, open := <-c
+	assert.False(t, open)
+}
@@ -0,0 +1,199 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// bindingTags are the struct tags a handler's struct parameter may use to
+// name the request value of a field, in the order they are looked up.
+var bindingTags = []string{"path", "query", "form", "json"}
+
+// Decode fills the struct pointed to by target from the request: fields
+// tagged `path:"id"` from the route's path variables, `query:"page"` from
+// the query string, `form:"email"` from the form submitted in the body and
+// `json:"name"` from a JSON body. Values are converted to the field's type
+// and the `validate` rules of every field are checked afterwards.
+func (context *Context) Decode(target interface{}) error {
+	value := reflect.ValueOf(target)
+	if value.Kind() != reflect.Ptr || value.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("cannot decode the request into %T, expected a pointer to a struct", target)
+	}
+
+	var errs ValidationErrors
+
+	if body := context.Request.Body; len(body) > 0 && isJson(context.Request.Header.Get("Content-Type")) {
+		if err := json.Unmarshal(body, target); err != nil {
+			errs = append(errs, FieldError{Rule: "json", Message: err.Error()})
+		}
+	}
+
+	var query url.Values
+	if uri, err := url.ParseRequestURI(context.Request.URI); err == nil {
+		query = uri.Query()
+	}
+
+	errs = append(errs, context.bindFields(value.Elem(), query, context.bodyForm())...)
+	if len(errs) == 0 {
+		errs = append(errs, validate(value.Elem())...)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (context *Context) bindFields(value reflect.Value, query, form url.Values) (errs ValidationErrors) {
+	valueType := value.Type()
+
+	for i := 0; i < valueType.NumField(); i++ {
+		field := valueType.Field(i)
+		if len(field.PkgPath) > 0 {
+			continue
+		}
+
+		var values []string
+		var found bool
+		if name, ok := field.Tag.Lookup("path"); ok {
+			var pathValue string
+			if pathValue, found = context.Request.Vars[name]; found {
+				values = []string{pathValue}
+			}
+		}
+		if name, ok := field.Tag.Lookup("query"); ok && !found {
+			values, found = query[name]
+		}
+		if name, ok := field.Tag.Lookup("form"); ok && !found {
+			values, found = form[name]
+		}
+		if !found || len(values) == 0 {
+			continue
+		}
+
+		if err := setField(value.Field(i), values); err != nil {
+			errs = append(errs, FieldError{Field: fieldName(field), Rule: "type", Message: err.Error()})
+		}
+	}
+
+	return
+}
+
+// bodyForm is the form submitted in the body. Message also holds the
+// values of the query string.
+func (context *Context) bodyForm() url.Values {
+	mediaType := strings.TrimSpace(strings.Split(context.Request.Header.Get("Content-Type"), ";")[0])
+	if mediaType != "application/x-www-form-urlencoded" {
+		return nil
+	}
+	form, _ := url.ParseQuery(string(context.Request.Body))
+	return form
+}
+
+// setField converts values to the type of field. Slices receive every
+// value, any other type the first one.
+func setField(field reflect.Value, values []string) error {
+	switch field.Kind() {
+	case reflect.Ptr:
+		element := reflect.New(field.Type().Elem())
+		if err := setField(element.Elem(), values); err != nil {
+			return err
+		}
+		field.Set(element)
+		return nil
+	case reflect.Slice:
+		slice := reflect.MakeSlice(field.Type(), len(values), len(values))
+		for i, value := range values {
+			if err := setField(slice.Index(i), []string{value}); err != nil {
+				return err
+			}
+		}
+		field.Set(slice)
+		return nil
+	}
+
+	value := values[0]
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", value)
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%q is not a positive integer", value)
+		}
+		field.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		field.SetFloat(f)
+	default:
+		// A mistake of the endpoint, not of the request
+		panic(fmt.Sprintf("cannot bind a request value to a field of type %s", field.Type()))
+	}
+
+	return nil
+}
+
+// fieldName is the name a field is known by in the request, used when
+// reporting errors.
+func fieldName(field reflect.StructField) string {
+	for _, tag := range bindingTags {
+		if name, ok := field.Tag.Lookup(tag); ok {
+			name = strings.Split(name, ",")[0]
+			if len(name) > 0 && name != "-" {
+				return name
+			}
+		}
+	}
+	return field.Name
+}
+
+func isJson(contentType string) bool {
+	mediaType := strings.TrimSpace(strings.Split(contentType, ";")[0])
+	return mediaType == string(FormatJson) || strings.HasSuffix(mediaType, "+json")
+}
+
+func isBindable(argType reflect.Type) bool {
+	if argType.Kind() == reflect.Ptr {
+		argType = argType.Elem()
+	}
+	return argType.Kind() == reflect.Struct && argType != contextType.Elem()
+}
+
+// decode creates a value of argType, a struct or a pointer to one, filled
+// from the request.
+func (context *Context) decode(argType reflect.Type) (reflect.Value, error) {
+	structType := argType
+	if argType.Kind() == reflect.Ptr {
+		structType = argType.Elem()
+	}
+
+	target := reflect.New(structType)
+	if err := context.Decode(target.Interface()); err != nil {
+		return reflect.Value{}, err
+	}
+
+	if argType.Kind() == reflect.Ptr {
+		return target, nil
+	}
+	return target.Elem(), nil
+}
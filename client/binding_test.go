@@ -0,0 +1,114 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type signup struct {
+	Id     int      `path:"id"`
+	Page   *uint    `query:"page"`
+	Tags   []string `query:"tag"`
+	Email  string   `form:"email" validate:"required,email"`
+	Name   string   `form:"name" json:"name" validate:"required,min=2,max=8,regex=^[a-z]+$"`
+	Active bool     `query:"active"`
+}
+
+func TestDecodeStructFromRequest(t *testing.T) {
+	context, _ := newTestContext(http.MethodPost)
+	context.Request = Request{
+		Vars:   map[string]string{"id": "42"},
+		URI:    "/users/42?page=3&tag=a&tag=b&active=true",
+		Header: http.Header{"Content-Type": {"application/x-www-form-urlencoded"}},
+		Body:   []byte("email=me%40brute.io&name=ritchie"),
+	}
+
+	var form signup
+	assert.NoError(t, context.Decode(&form))
+
+	assert.Equal(t, 42, form.Id)
+	assert.Equal(t, uint(3), *form.Page)
+	assert.Equal(t, []string{"a", "b"}, form.Tags)
+	assert.Equal(t, "me@brute.io", form.Email)
+	assert.Equal(t, "ritchie", form.Name)
+	assert.True(t, form.Active)
+
+	context.Request.Header = http.Header{"Content-Type": {"application/json; charset=utf-8"}}
+	context.Request.Body = []byte(`{"name":"thompson"}`)
+
+	form = signup{}
+	context.Decode(&form)
+	assert.Equal(t, "thompson", form.Name)
+}
+
+func TestFormFieldsAreNotReadFromTheQuery(t *testing.T) {
+	context, _ := newTestContext(http.MethodPost)
+	context.Message = Message{"email": {"me@brute.io"}}
+	context.Request = Request{URI: "/users?email=me@brute.io"}
+
+	var form signup
+	errs, ok := context.Decode(&form).(ValidationErrors)
+	assert.True(t, ok)
+	assert.Equal(t, FieldError{Field: "email", Rule: "required", Message: "is required"}, errs[0])
+	assert.Equal(t, "", form.Email)
+}
+
+func TestDecodeReportsFieldErrors(t *testing.T) {
+	context, _ := newTestContext(http.MethodPost)
+	context.Request = Request{URI: "/users?page=-1"}
+
+	var form signup
+	errs, ok := context.Decode(&form).(ValidationErrors)
+	assert.True(t, ok)
+	assert.Equal(t, ValidationErrors{{Field: "page", Rule: "type", Message: `"-1" is not a positive integer`}}, errs)
+
+	context.Request = Request{
+		URI:    "/users",
+		Header: http.Header{"Content-Type": {"application/x-www-form-urlencoded"}},
+		Body:   []byte("email=not-an-email&name=R2-D2"),
+	}
+
+	errs, ok = context.Decode(&form).(ValidationErrors)
+	assert.True(t, ok)
+	assert.Equal(t, ValidationErrors{
+		{Field: "email", Rule: "email", Message: "must be a valid email address"},
+		{Field: "name", Rule: "regex", Message: "must match ^[a-z]+$"},
+	}, errs)
+}
+
+func TestInvalidStructParameterRespondsBadRequest(t *testing.T) {
+	context, recorder := newTestContext(http.MethodPost)
+	context.Request = Request{URI: "/users"}
+
+	var called bool
+	serve(map[string]interface{}{http.MethodPost: func(form *signup) { called = true }}, context)
+
+	assert.False(t, called)
+	assert.Equal(t, http.StatusBadRequest, recorder.packets[len(recorder.packets)-2].Code)
+
+	var body struct{ Errors ValidationErrors }
+	assert.NoError(t, json.Unmarshal([]byte(recorder.body()), &body))
+	assert.Equal(t, []string{"email", "name"}, []string{body.Errors[0].Field, body.Errors[1].Field})
+}
+
+func TestMistakesOfTheEndpointAnswerInternalServerError(t *testing.T) {
+	type unknownRule struct {
+		Name string `query:"name" validate:"required,uppercase"`
+	}
+	type unsupportedField struct {
+		Tags map[string]string `query:"tags"`
+	}
+
+	for _, handler := range []interface{}{func(form unknownRule) {}, func(form unsupportedField) {}} {
+		context, recorder := newTestContext(http.MethodGet)
+		context.Request = Request{URI: "/users?name=ana&tags=a"}
+
+		serve(map[string]interface{}{http.MethodGet: handler}, context)
+
+		assert.Equal(t, http.StatusText(http.StatusInternalServerError), recorder.body())
+		assert.Equal(t, http.StatusInternalServerError, recorder.packets[len(recorder.packets)-2].Code)
+	}
+}
@@ -0,0 +1,140 @@
+package client
+
+import (
+	"net/http"
+	"strings"
+)
+
+// BufferSize is the number of bytes a session buffers before sending them
+// to the master. Writes are coalesced until the buffer is full, Flush is
+// called or the handler returns. A response that fits in the buffer whole
+// is sent with a Content-Length header. Zero disables buffering.
+var BufferSize = 32 << 10
+
+// output holds the response body not yet sent to the master.
+type output struct {
+	buffer []byte
+	size   int
+
+	// sent is set once a body packet reached the master, committing the
+	// status code and headers.
+	sent bool
+
+	// contentLength is set when the handler sends Content-Length itself.
+	contentLength bool
+}
+
+// SetBufferSize changes the buffer size of this session. Any buffered
+// output that no longer fits is sent right away.
+func (context *Context) SetBufferSize(size int) error {
+	context.Lock()
+	defer context.Unlock()
+
+	context.output.size = size
+	if len(context.output.buffer) > size {
+		return context.flush()
+	}
+	return nil
+}
+
+// Flush sends the buffered output to the master. Flushing a session that
+// wrote nothing yet commits its status code and headers.
+func (context *Context) Flush() error {
+	context.Lock()
+	defer context.Unlock()
+
+	if len(context.output.buffer) == 0 && context.output.sent {
+		return nil
+	}
+	return context.flush()
+}
+
+func (context *Context) buffered(buf []byte) (err error) {
+	output := &context.output
+	if len(output.buffer)+len(buf) > output.size && len(output.buffer) > 0 {
+		if err = context.flush(); err != nil {
+			return
+		}
+	}
+	if len(buf) >= output.size {
+		return context.send(buf)
+	}
+	if output.buffer == nil {
+		output.buffer = make([]byte, 0, output.size)
+	}
+	output.buffer = append(output.buffer, buf...)
+	return
+}
+
+// flush sends the buffer; the caller holds the lock. The packet keeps the
+// buffer, so a new one is allocated by the next write.
+func (context *Context) flush() error {
+	buf := context.output.buffer
+	context.output.buffer = nil
+	return context.send(buf)
+}
+
+func (context *Context) send(buf []byte) error {
+	context.output.sent = true
+
+	var ack bool
+	return context.Rpc("RequestSession.Write", &EchoPacket{context.SessionId, buf, context.status()}, &ack)
+}
+
+func (context *Context) status() int {
+	if context.StatusCode != nil {
+		return *context.StatusCode
+	}
+	return http.StatusOK
+}
+
+// complete sends what is left of the response once the handler returned.
+// A response that was never flushed is sent whole with its Content-Length.
+func (context *Context) complete() error {
+	context.Lock()
+	defer context.Unlock()
+
+	if context.output.sent {
+		if len(context.output.buffer) == 0 {
+			return nil
+		}
+		return context.flush()
+	}
+
+	if !context.output.contentLength && bodyAllowed(context.status()) {
+		context.sendHeader(40, "Content-Length", len(context.output.buffer))
+	}
+	return context.flush()
+}
+
+// fail answers 500 in place of the buffered output of a handler that
+// panicked. Once part of the response was sent, what is left is sent as
+// it is.
+func (context *Context) fail() error {
+	context.Lock()
+	defer context.Unlock()
+
+	if context.output.sent {
+		if len(context.output.buffer) == 0 {
+			return nil
+		}
+		return context.flush()
+	}
+
+	statusCode := http.StatusInternalServerError
+	context.StatusCode = &statusCode
+	context.output.buffer = []byte(http.StatusText(statusCode))
+	context.sendHeader(40, "Content-Type", "text/plain; charset=utf-8")
+	context.sendHeader(40, "Content-Length", len(context.output.buffer))
+	return context.flush()
+}
+
+func (context *Context) noteHeader(key string) {
+	if strings.EqualFold(key, "Content-Length") {
+		context.output.contentLength = true
+	}
+}
+
+func bodyAllowed(statusCode int) bool {
+	return statusCode >= 200 && statusCode != http.StatusNoContent && statusCode != http.StatusNotModified
+}
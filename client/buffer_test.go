@@ -0,0 +1,113 @@
+package client
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newBufferedContext(method string, size int) (*Context, *recorder) {
+	context, recorder := newTestContext(method)
+	context.output.size = size
+	return context, recorder
+}
+
+func TestWritesAreCoalesced(t *testing.T) {
+	context, recorder := newBufferedContext(http.MethodGet, 64)
+
+	handler := func(context *Context) {
+		for _, fragment := range []string{"<ul>", "<li>brute</li>", "</ul>"} {
+			context.Write([]byte(fragment))
+		}
+	}
+
+	serve(map[string]interface{}{http.MethodGet: handler}, context)
+
+	assert.Len(t, recorder.packets, 3)
+	assert.Equal(t, "Content-Length=23", string(recorder.packets[0].Body))
+	assert.Equal(t, "<ul><li>brute</li></ul>", string(recorder.packets[1].Body))
+	assert.Equal(t, http.StatusOK, recorder.packets[1].Code)
+}
+
+func TestFlushSendsBufferedOutput(t *testing.T) {
+	context, recorder := newBufferedContext(http.MethodGet, 64)
+
+	handler := func(context *Context) {
+		context.WriteHeader(http.StatusAccepted)
+		context.Write([]byte("queued"))
+		context.Flush()
+		context.Write([]byte(", done"))
+	}
+
+	serve(map[string]interface{}{http.MethodGet: handler}, context)
+
+	assert.Len(t, recorder.packets, 3)
+	assert.Equal(t, "queued", string(recorder.packets[0].Body))
+	assert.Equal(t, http.StatusAccepted, recorder.packets[0].Code)
+	assert.Equal(t, ", done", string(recorder.packets[1].Body))
+	assert.Equal(t, "queued, done", recorder.body())
+}
+
+func TestFullBufferIsSentWithoutContentLength(t *testing.T) {
+	context, recorder := newBufferedContext(http.MethodGet, 8)
+
+	handler := func(context *Context) {
+		context.Echo("%s", "12345")
+		context.Echo("%s", "67890")
+		context.Echo("%s", strings.Repeat("x", 10))
+	}
+
+	serve(map[string]interface{}{http.MethodGet: handler}, context)
+
+	assert.Equal(t, "1234567890xxxxxxxxxx", recorder.body())
+	for _, packet := range recorder.packets {
+		assert.NotEqual(t, 40, packet.Code)
+	}
+}
+
+func TestContentLengthIsLeftToTheHandler(t *testing.T) {
+	context, recorder := newBufferedContext(http.MethodGet, 64)
+
+	handler := func(context *Context) {
+		context.SetHeader("Content-Length", 5)
+		context.Write([]byte("brute"))
+	}
+
+	serve(map[string]interface{}{http.MethodGet: handler}, context)
+
+	assert.Equal(t, []string{"Content-Length=5"}, headers(recorder))
+}
+
+func TestPanickedHandlerAnswersInternalServerError(t *testing.T) {
+	context, recorder := newBufferedContext(http.MethodGet, 64)
+
+	handler := func(context *Context) {
+		context.Write([]byte("partial"))
+		panic("broken")
+	}
+
+	serve(map[string]interface{}{http.MethodGet: handler}, context)
+
+	assert.Equal(t, http.StatusText(http.StatusInternalServerError), recorder.body())
+	assert.Len(t, recorder.packets, 4)
+	assert.Equal(t, "Content-Length=21", string(recorder.packets[1].Body))
+	assert.Equal(t, http.StatusInternalServerError, recorder.packets[2].Code)
+}
+
+func TestPanicAfterFlushKeepsTheResponse(t *testing.T) {
+	context, recorder := newBufferedContext(http.MethodGet, 64)
+
+	handler := func(context *Context) {
+		context.Write([]byte("sent"))
+		context.Flush()
+		context.Write([]byte(", partial"))
+		panic("broken")
+	}
+
+	serve(map[string]interface{}{http.MethodGet: handler}, context)
+
+	assert.Equal(t, "sent, partial", recorder.body())
+	assert.Equal(t, http.StatusOK, recorder.packets[0].Code)
+}
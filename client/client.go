@@ -1,27 +1,35 @@
 package client
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"github.com/silentred/gid"
 	"log"
 	"net"
 	"net/rpc"
 	"os"
+	"os/signal"
 	"sync"
 	"runtime"
 	"reflect"
 	"net/http"
 	"net/url"
 	"errors"
-)
+	"strings"
 
-var magicNumber = []byte{0x62, 0x72, 0x75, 0x74, 0x65}
+	"github.com/rrborja/brute/protocol"
+	"github.com/rrborja/brute/trace"
+)
 
 var customIn = os.Stdin
 var customOut = os.Stdout
 
 var client *rpc.Client
 
+var errNotBound = errors.New("the calling goroutine is not bound to a request; use *client.Context instead")
+
 type Message url.Values
 
 type Handler interface {
@@ -38,6 +46,9 @@ type EchoPacket struct {
 	Code	  int
 }
 
+// Context is the per-request handle of an endpoint. Handlers may declare
+// a *Context parameter to receive it, and it can be passed freely to any
+// goroutine the handler spawns.
 type Context struct {
 	Name 		string
 	SessionId 	[32]byte
@@ -45,17 +56,36 @@ type Context struct {
 	StatusCode  *int
 	Message
 	Arguments 	map[string]string
+	Request 	Request
 	Rpc       	func(string, interface{}, interface{}) error
 
 	*sync.Mutex
+
+	values  sync.Map
+	closers []func()
+	workers sync.WaitGroup
+
+	output output
+
+	// span is the span of the session, nil when tracing is off
+	span *trace.Span
+
+	// closed, when set, is called once the session is closed
+	closed func()
 }
 
 func (context *Context) SetContentType(mime string) {
+	context.Lock()
+	defer context.Unlock()
+
 	var ack bool
-	context.Rpc("RequestSession.SetContentType", &EchoPacket{context.SessionId, []byte(mime), 200}, &ack)
+	context.Rpc("RequestSession.Write", &EchoPacket{context.SessionId, []byte("~ct" + mime), context.status()}, &ack)
 }
 
 func (context *Context) WriteHeader(statusCode int) error {
+	context.Lock()
+	defer context.Unlock()
+
 	if context.StatusCode != nil {
 		return errors.New("http status code already set")
 	}
@@ -64,16 +94,62 @@ func (context *Context) WriteHeader(statusCode int) error {
 }
 
 func (context *Context) Write(buf []byte) (n int, err error) {
-	statusCode := 200
-	if context.StatusCode != nil {
-		statusCode = *context.StatusCode
+	context.Lock()
+	defer context.Unlock()
+
+	if err = context.buffered(buf); err != nil {
+		return
 	}
-	var ack bool
-	err = context.Rpc("RequestSession.Write", &EchoPacket{context.SessionId, buf, statusCode}, &ack)
 	n = len(buf)
 	return
 }
 
+func (context *Context) Echo(message string, args ...interface{}) {
+	context.Write([]byte(fmt.Sprintf(message, args...)))
+}
+
+func (context *Context) SetHeader(key string, value interface{}) error {
+	context.Lock()
+	defer context.Unlock()
+
+	return context.sendHeader(40, key, value)
+}
+
+// AddHeader adds value to the response header key, keeping any value
+// already set for it.
+func (context *Context) AddHeader(key string, value interface{}) error {
+	context.Lock()
+	defer context.Unlock()
+
+	return context.sendHeader(41, key, value)
+}
+
+func (context *Context) sendHeader(code int, key string, value interface{}) error {
+	context.noteHeader(key)
+
+	var ack bool
+	return context.Call("RequestSession.Write",
+		&EchoPacket{context.SessionId,
+		[]byte(fmt.Sprintf("%s=%v", key, value)), code,
+		}, &ack)
+}
+
+func (context *Context) SetHttpCode(statusCode int) {
+	context.WriteHeader(statusCode)
+}
+
+func (context *Context) SystemMessage(message string) {
+	context.Lock()
+	defer context.Unlock()
+
+	if len(context.output.buffer) > 0 {
+		context.flush()
+	}
+
+	var ack bool
+	context.Call("RequestSession.Write", &EchoPacket{context.SessionId, []byte(message), 700}, &ack)
+}
+
 func (context *Context) Lock() {
 	context.Mutex.Lock()
 }
@@ -86,60 +162,130 @@ func (context *Context) Call(functionName string, packet *EchoPacket, ack *bool)
 	return context.Rpc(functionName, packet, ack)
 }
 
+// Bind attaches the calling goroutine to this context so the goroutine-ID
+// based functions (Out, SetHeader, html.*, json.*) write to this request.
+// The returned function restores whatever the goroutine was bound to before.
+func (context *Context) Bind() (release func()) {
+	sessionId := Gid()
+	previous, bound := handlerSessions.Get(sessionId)
+	handlerSessions.Set(sessionId, context)
+
+	return func() {
+		if bound {
+			handlerSessions.Set(sessionId, previous)
+		} else {
+			handlerSessions.Delete(sessionId)
+		}
+	}
+}
+
+// Go runs fn in a new goroutine bound to this context. The response is not
+// closed until every goroutine started this way returns.
+func (context *Context) Go(fn func()) {
+	context.workers.Add(1)
+	go func() {
+		defer context.workers.Done()
+		defer context.Bind()()
+		fn()
+	}()
+}
+
+// OnClose registers fn to be run after the handler and its goroutines
+// return, right before the response is closed. Functions run in reverse
+// order of registration.
+func (context *Context) OnClose(fn func()) {
+	context.Lock()
+	defer context.Unlock()
+
+	context.closers = append(context.closers, fn)
+}
+
+// LoadOrStore returns the value stored under key for this request, storing
+// value first if there is none. It lets packages such as html and json keep
+// per-request state on the context.
+func (context *Context) LoadOrStore(key, value interface{}) (actual interface{}, loaded bool) {
+	return context.values.LoadOrStore(key, value)
+}
+
+func (context *Context) Value(key interface{}) (value interface{}, ok bool) {
+	return context.values.Load(key)
+}
+
+func (context *Context) finish() {
+	context.workers.Wait()
+
+	context.Lock()
+	closers := context.closers
+	context.closers = nil
+	context.Unlock()
+
+	for i := len(closers) - 1; i >= 0; i-- {
+		closers[i]()
+	}
+}
+
+// CurrentContext returns the context the calling goroutine is bound to.
+func CurrentContext() (*Context, bool) {
+	handler, ok := handlerSessions.Get(Gid())
+	if !ok {
+		return nil, false
+	}
+	context, ok := handler.(*Context)
+	return context, ok
+}
+
 func Gid() SessionId {
 	return SessionId(gid.Get())
 }
 
 func Out(data []byte) (n int, err error) {
 	// use runtime.Caller to restrict calling this method only the endpoint's handler source code
-	context, _ := handlerSessions.Get(Gid())
-
-	context.Lock()
-	defer context.Unlock()
+	context, ok := handlerSessions.Get(Gid())
+	if !ok {
+		return 0, errNotBound
+	}
 
 	return context.Write(data)
 }
 
 func Echo(message string, args ...interface{}) {
-	Out([]byte(fmt.Sprintf(message, args)))
+	Out([]byte(fmt.Sprintf(message, args...)))
 }
 
 func SystemMessage(message string) {
-	context := handlerSessions[Gid()]
-
-	context.Lock()
-	defer context.Unlock()
-
-	var ack bool
-	context.Call("RequestSession.Write", &EchoPacket{context.(*Context).SessionId, []byte(message), 700}, &ack)
+	if context, ok := CurrentContext(); ok {
+		context.SystemMessage(message)
+	}
 }
 
 func With(handlers ...interface{}) []interface{} {
 	return handlers
 }
 
-func Run(handler func(args map[string]string), handlers ...interface{}) {
+var (
+	methodHandlers      = make(map[string]interface{})
+	methodHandlersMutex sync.Mutex
+)
 
-	conn, err := net.Dial("tcp", "localhost:11000")
-	if err != nil {
-		panic(err)
+// On registers fn to serve requests made with the given HTTP method. It
+// must be called before Run, and takes precedence over handlers passed to
+// Run for the same method.
+func On(method string, fn interface{}) {
+	if reflect.TypeOf(fn) == nil || reflect.TypeOf(fn).Kind() != reflect.Func {
+		panic(fmt.Errorf("the handler for method %s must be a function: %v", method, fn))
 	}
 
-	source := os.Getenv("ROUTE")
-	size := fmt.Sprintf("%04d", len(source))
-	message := append(magicNumber, append([]byte(size), []byte(source)...)...)
-
-	conn.Write(message)
+	methodHandlersMutex.Lock()
+	defer methodHandlersMutex.Unlock()
 
-	// At this point, This endpoint has been plugged to the master brute server
-	// Succeeding conn.Reads are always be session ID until connection closes
+	methodHandlers[strings.ToUpper(method)] = fn
+}
 
-	client, err = rpc.Dial("tcp", "localhost:12000")
-	if err != nil {
-		log.Fatal(err)
+func Run(handler func(args map[string]string), handlers ...interface{}) {
+	nonGetHandlers := make(map[string]interface{})
+	if handler != nil {
+		nonGetHandlers[http.MethodGet] = handler
 	}
-
-	nonGetHandlers := map[string]interface{}{http.MethodGet : handler}
 	for _, nonGetHandler := range handlers {
 		handler := nonGetHandler
 		standardHandlerName := runtime.FuncForPC(reflect.ValueOf(handler).Pointer()).Name()
@@ -153,39 +299,179 @@ func Run(handler func(args map[string]string), handlers ...interface{}) {
 		case "main.Delete", "main.delete":
 			nonGetHandlers[http.MethodDelete] = handler
 		default:
-			log.Print("Didn't I tell you not to modify the main() function of your endpoint code?")
+			log.Printf("Cannot tell the HTTP method of handler %s. Register it with client.On instead", standardHandlerName)
 		}
 	}
 
-	callEvent := make(chan Context, 100)
+	methodHandlersMutex.Lock()
+	for method, handler := range methodHandlers {
+		nonGetHandlers[method] = handler
+	}
+	methodHandlersMutex.Unlock()
 
-	go Handle(nonGetHandlers, callEvent)
+	listen(strings.Split(allowed(nonGetHandlers), ", "), func(callEvents <-chan *Context) {
+		Handle(nonGetHandlers, callEvents)
+	})
+}
+
+// RunHTTP plugs a standard http.Handler to the master brute server. Every
+// session is served with an *http.Request rebuilt from the forwarded
+// request and an http.ResponseWriter that writes back through the master.
+func RunHTTP(handler http.Handler) {
+	listen(nil, func(callEvents <-chan *Context) {
+		HandleHTTP(handler, callEvents)
+	})
+}
+
+// buildHash identifies the endpoint binary for the master.
+func buildHash() string {
+	executable, err := os.Executable()
+	if err != nil {
+		return ""
+	}
+	file, err := os.Open(executable)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func listen(methods []string, dispatch func(callEvents <-chan *Context)) {
+
+	network, address := protocol.ParseAddress(serviceAddress(protocol.EndpointServiceEnv, "localhost:11000"))
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		panic(err)
+	}
+
+	source := os.Getenv("ROUTE")
+
+	welcome, err := protocol.Dial(conn, &protocol.Hello{
+		Version:      protocol.Version,
+		MinVersion:   protocol.MinVersion,
+		Route:        source,
+		Token:        os.Getenv("BRUTE_TOKEN"),
+		PID:          os.Getpid(),
+		BuildHash:    buildHash(),
+		Methods:      methods,
+		Capabilities: []string{protocol.CapabilityStreaming, protocol.CapabilityMultiplex},
+	})
+	if err != nil {
+		log.Fatalf("The master refused endpoint %s: %v", source, err)
+	}
+
+	// At this point, This endpoint has been plugged to the master brute server
+
+	// Ctrl-C reaches the whole process group; the master shuts this
+	// endpoint down itself once its sessions are drained
+	signal.Ignore(os.Interrupt)
+
+	callEvent := make(chan *Context, 100)
+
+	go dispatch(callEvent)
+
+	if welcome.Supports(protocol.CapabilityMultiplex) {
+		// Requests and responses travel over this connection
+		plane := newDataPlane(conn)
+		served := make(chan error, 1)
+		go func() {
+			served <- plane.serve(func(sid [32]byte, request *rpcRequest) {
+				callEvent <- accepted(newContext(source, sid, request, plane.Call))
+			})
+		}()
+
+		select {
+		case <-plane.shutdown:
+			// The data plane keeps running for the sessions left
+			inFlight.Wait()
+		case <-served:
+		}
+		closeTracer()
+		os.Exit(0)
+	}
+
+	// Succeeding frames are session IDs until the connection closes
+
+	network, address = protocol.ParseAddress(serviceAddress(protocol.RpcServiceEnv, "localhost:12000"))
+	client, err = rpc.Dial(network, address)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	ack := make([]byte, 32)
 	for {
-		if _, err := conn.Read(ack); err != nil {
+		frame, err := protocol.ReadFrame(conn)
+		if err != nil {
 			break
 		}
+		if frame.Type == protocol.FrameShutdown {
+			inFlight.Wait()
+			break
+		}
+		if frame.Type != protocol.FrameSession || len(frame.Payload) != 32 {
+			continue
+		}
 
 		var sid [32]byte
-		copy(sid[:], ack)
+		copy(sid[:], frame.Payload)
 
-		var rpcResponse struct{Method string; Message url.Values; Arguments map[string]string}
+		var rpcResponse rpcRequest
 		if err := client.Call("RequestSession.AcceptRpc", sid, &rpcResponse); err == nil {
-			callEvent <- Context{
-				Name: 		source,
-				SessionId: 	sid,
-				Method: 	rpcResponse.Method,
-				Message: 	Message(rpcResponse.Message),
-				Arguments: 	rpcResponse.Arguments,
-				Rpc:       	client.Call,
-				Mutex:     	new(sync.Mutex),
-			}
+			callEvent <- accepted(newContext(source, sid, &rpcResponse, client.Call))
 		} else {
-			panic(err)
+			// The session expired or its client left before it was accepted
+			log.Printf("Dropping session %x of endpoint %s: %v", sid, source, err)
 		}
 	}
 
 	client.Close()
+	closeTracer()
 	os.Exit(0)
 }
+
+// serviceAddress returns the address of a master service given in the
+// environment, or fallback for endpoints started by older masters.
+func serviceAddress(env, fallback string) string {
+	if address := os.Getenv(env); address != "" {
+		return address
+	}
+	return fallback
+}
+
+// inFlight counts the sessions received from the master and not yet closed,
+// so the endpoint can finish them before exiting on shutdown.
+var inFlight sync.WaitGroup
+
+func accepted(context *Context) *Context {
+	inFlight.Add(1)
+	context.closed = inFlight.Done
+	return context
+}
+
+func newContext(source string, sid [32]byte, rpcResponse *rpcRequest, call func(string, interface{}, interface{}) error) *Context {
+	return &Context{
+		Name: 		source,
+		SessionId: 	sid,
+		Method: 	rpcResponse.Method,
+		Message: 	Message(rpcResponse.Message),
+		Arguments: 	rpcResponse.Arguments,
+		Request: 	Request{
+			Vars:       rpcResponse.Vars,
+			URI:        rpcResponse.URI,
+			Proto:      rpcResponse.Proto,
+			Host:       rpcResponse.Host,
+			RemoteAddr: rpcResponse.RemoteAddr,
+			Header:     rpcResponse.Header,
+			Body:       rpcResponse.Body,
+		},
+		Rpc:       	call,
+		Mutex:     	new(sync.Mutex),
+		output:    	output{size: BufferSize},
+		span:      	startSpan(source, rpcResponse.Method, rpcResponse.Traceparent),
+	}
+}
@@ -0,0 +1,199 @@
+package client
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recorder struct {
+	sync.Mutex
+	calls   []string
+	packets []EchoPacket
+}
+
+func (recorder *recorder) Call(method string, args interface{}, reply interface{}) error {
+	recorder.Lock()
+	defer recorder.Unlock()
+
+	recorder.calls = append(recorder.calls, method)
+	if packet, ok := args.(*EchoPacket); ok {
+		recorder.packets = append(recorder.packets, *packet)
+	}
+	return nil
+}
+
+func (recorder *recorder) body() (body string) {
+	for _, packet := range recorder.packets {
+		if packet.Code != 40 {
+			body += string(packet.Body)
+		}
+	}
+	return
+}
+
+func newTestContext(method string) (*Context, *recorder) {
+	recorder := new(recorder)
+	return &Context{
+		Name:      "test",
+		Method:    method,
+		Arguments: map[string]string{"id": "7"},
+		Rpc:       recorder.Call,
+		Mutex:     new(sync.Mutex),
+	}, recorder
+}
+
+func TestContextHandlerWritesFromGoroutines(t *testing.T) {
+	context, recorder := newTestContext(http.MethodGet)
+
+	handler := func(context *Context, args map[string]string) {
+		context.Go(func() {
+			Out([]byte(args["id"]))
+		})
+	}
+
+	serve(map[string]interface{}{http.MethodGet: handler}, context)
+
+	assert.Equal(t, "7", recorder.body())
+	assert.Equal(t, "RequestSession.Close", recorder.calls[len(recorder.calls)-1])
+}
+
+func TestContextOnCloseRunsBeforeClose(t *testing.T) {
+	context, recorder := newTestContext(http.MethodGet)
+
+	handler := func(context *Context) {
+		context.OnClose(func() { context.Write([]byte("b")) })
+		context.OnClose(func() { context.Write([]byte("a")) })
+	}
+
+	serve(map[string]interface{}{http.MethodGet: handler}, context)
+
+	assert.Equal(t, "ab", recorder.body())
+	assert.Equal(t, "RequestSession.Close", recorder.calls[len(recorder.calls)-1])
+}
+
+func TestDroppedSessionDoesNotStopTheEndpoint(t *testing.T) {
+	context, _ := newTestContext(http.MethodGet)
+	context.Rpc = func(method string, args interface{}, reply interface{}) error {
+		return errors.New("no such request session")
+	}
+	closed := false
+	context.closed = func() { closed = true }
+
+	handler := func(context *Context) {
+		context.Write([]byte("late"))
+	}
+
+	assert.NotPanics(t, func() {
+		serve(map[string]interface{}{http.MethodGet: handler}, context)
+	})
+	assert.True(t, closed)
+}
+
+func TestOutWithoutBoundContext(t *testing.T) {
+	_, err := Out([]byte("nowhere"))
+	assert.Equal(t, errNotBound, err)
+}
+
+func TestRunHTTPServeContent(t *testing.T) {
+	context, recorder := newTestContext(http.MethodGet)
+	context.Request = Request{URI: "/files/hello.txt?x=1", Proto: "HTTP/1.1", Host: "example.com",
+		Header: http.Header{"Range": {"bytes=0-4"}}}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/files/hello.txt", r.URL.Path)
+		assert.Equal(t, "1", r.URL.Query().Get("x"))
+		assert.Equal(t, "example.com", r.Host)
+
+		_, ok := FromRequest(r)
+		assert.True(t, ok)
+
+		http.ServeContent(w, r, "hello.txt", time.Time{}, strings.NewReader("hello, world"))
+	})
+
+	serveHTTP(handler, context)
+
+	assert.Equal(t, "hello", recorder.body())
+	assert.Equal(t, http.StatusPartialContent, recorder.packets[len(recorder.packets)-2].Code)
+	assert.Contains(t, headers(recorder), "Content-Range=bytes 0-4/12")
+}
+
+func headers(recorder *recorder) (headers []string) {
+	for _, packet := range recorder.packets {
+		if packet.Code == 40 || packet.Code == 41 {
+			headers = append(headers, string(packet.Body))
+		}
+	}
+	return
+}
+
+func TestUnregisteredMethodIsNotAllowed(t *testing.T) {
+	context, recorder := newTestContext(http.MethodPut)
+
+	handlers := map[string]interface{}{
+		http.MethodGet:  func() {},
+		http.MethodPost: func(Message) {},
+	}
+
+	serve(handlers, context)
+
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.packets[len(recorder.packets)-2].Code)
+	assert.Contains(t, headers(recorder), "Allow=GET, HEAD, OPTIONS, POST")
+}
+
+func TestHeadAndOptionsAreAnswered(t *testing.T) {
+	var served bool
+	handlers := map[string]interface{}{
+		http.MethodGet: func() { served = true },
+	}
+
+	head, _ := newTestContext(http.MethodHead)
+	serve(handlers, head)
+	assert.True(t, served)
+
+	options, recorder := newTestContext(http.MethodOptions)
+	serve(handlers, options)
+	assert.Equal(t, http.StatusNoContent, recorder.packets[len(recorder.packets)-2].Code)
+	assert.Contains(t, headers(recorder), "Allow=GET, HEAD, OPTIONS")
+}
+
+type greeting struct {
+	Text string `json:"text" xml:"text"`
+}
+
+func TestReturnedValueIsNegotiated(t *testing.T) {
+	handler := func() (int, *greeting, error) {
+		return http.StatusCreated, &greeting{"hello"}, nil
+	}
+
+	context, recorder := newTestContext(http.MethodGet)
+	context.Request = Request{Header: http.Header{"Accept": {"text/html;q=0.5, application/xml"}}}
+	serve(map[string]interface{}{http.MethodGet: handler}, context)
+
+	assert.Equal(t, "<greeting><text>hello</text></greeting>", recorder.body())
+	assert.Equal(t, http.StatusCreated, recorder.packets[len(recorder.packets)-2].Code)
+	assert.Contains(t, headers(recorder), "Content-Type=application/xml; charset=utf-8")
+
+	context, recorder = newTestContext(http.MethodGet)
+	serve(map[string]interface{}{http.MethodGet: handler}, context)
+
+	assert.Equal(t, `{"text":"hello"}`, recorder.body())
+}
+
+func TestReturnedErrorIsProblem(t *testing.T) {
+	handler := func() (*greeting, error) {
+		return nil, HTTPError{http.StatusNotFound, "no such greeting"}
+	}
+
+	context, recorder := newTestContext(http.MethodGet)
+	serve(map[string]interface{}{http.MethodGet: handler}, context)
+
+	assert.Equal(t, `{"type":"about:blank","title":"Not Found","status":404,"detail":"no such greeting"}`, recorder.body())
+	assert.Equal(t, http.StatusNotFound, recorder.packets[len(recorder.packets)-2].Code)
+	assert.Contains(t, headers(recorder), "Content-Type=application/problem+json")
+}
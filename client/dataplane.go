@@ -0,0 +1,159 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/rrborja/brute/protocol"
+)
+
+var errUnknownSession = errors.New("no such session on the data plane")
+
+// dataPlane multiplexes the sessions of an endpoint over its connection to
+// the master, see protocol.CapabilityMultiplex. Its Call method stands in
+// for the RPC client, so a Context writes the same way on either path.
+type dataPlane struct {
+	conn io.ReadWriter
+
+	writeMutex sync.Mutex
+
+	credits map[[32]byte]int
+	mutex   sync.Mutex
+	cond    *sync.Cond
+
+	// shutdown is closed when the master asks the endpoint to exit
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+}
+
+func newDataPlane(conn io.ReadWriter) *dataPlane {
+	plane := &dataPlane{conn: conn, credits: make(map[[32]byte]int), shutdown: make(chan struct{})}
+	plane.cond = sync.NewCond(&plane.mutex)
+	return plane
+}
+
+// serve reads frames from the master until the connection closes, passing
+// every dispatched session to dispatch.
+func (plane *dataPlane) serve(dispatch func(sid [32]byte, request *rpcRequest)) error {
+	for {
+		frame, err := protocol.ReadFrame(plane.conn)
+		if err != nil {
+			plane.mutex.Lock()
+			plane.credits = nil
+			plane.cond.Broadcast()
+			plane.mutex.Unlock()
+			return err
+		}
+
+		switch frame.Type {
+		case protocol.FrameDispatch:
+			sid, data, err := protocol.SplitSession(frame.Payload)
+			if err != nil {
+				continue
+			}
+			var request rpcRequest
+			if err := json.Unmarshal(data, &request); err != nil {
+				continue
+			}
+			plane.open(sid)
+			dispatch(sid, &request)
+		case protocol.FrameWindowUpdate:
+			sid, increment, err := protocol.ParseWindow(frame.Payload)
+			if err != nil {
+				continue
+			}
+			plane.mutex.Lock()
+			if credit, ok := plane.credits[sid]; ok {
+				plane.credits[sid] = credit + increment
+				plane.cond.Broadcast()
+			}
+			plane.mutex.Unlock()
+		case protocol.FrameShutdown:
+			plane.shutdownOnce.Do(func() { close(plane.shutdown) })
+		}
+	}
+}
+
+func (plane *dataPlane) open(sid [32]byte) {
+	plane.mutex.Lock()
+	defer plane.mutex.Unlock()
+
+	if plane.credits != nil {
+		plane.credits[sid] = protocol.InitialWindow
+	}
+}
+
+// acquire waits until the session has the credit to send a Data frame and
+// returns how much of a size bytes body fits in it.
+func (plane *dataPlane) acquire(sid [32]byte, size int) (int, error) {
+	plane.mutex.Lock()
+	defer plane.mutex.Unlock()
+
+	for {
+		credit, ok := plane.credits[sid]
+		if !ok {
+			return 0, errUnknownSession
+		}
+		if credit > protocol.DataFrameCost || (size == 0 && credit == protocol.DataFrameCost) {
+			if size > credit-protocol.DataFrameCost {
+				size = credit - protocol.DataFrameCost
+			}
+			plane.credits[sid] = credit - protocol.DataFrameCost - size
+			return size, nil
+		}
+		plane.cond.Wait()
+	}
+}
+
+func (plane *dataPlane) send(frameType protocol.FrameType, payload []byte) error {
+	plane.writeMutex.Lock()
+	defer plane.writeMutex.Unlock()
+
+	return protocol.WriteFrame(plane.conn, frameType, payload)
+}
+
+func (plane *dataPlane) write(packet *EchoPacket) error {
+	body := packet.Body
+	for first := true; first || len(body) > 0; first = false {
+		size, err := plane.acquire(packet.SessionId, len(body))
+		if err != nil {
+			return err
+		}
+		if err := plane.send(protocol.FrameData, protocol.DataPayload(packet.SessionId, packet.Code, body[:size])); err != nil {
+			return err
+		}
+		body = body[size:]
+	}
+	return nil
+}
+
+// Call performs the RequestSession RPC methods a Context uses.
+func (plane *dataPlane) Call(method string, args interface{}, reply interface{}) (err error) {
+	packet, ok := args.(*EchoPacket)
+	if !ok {
+		return fmt.Errorf("unsupported arguments for %s on the data plane", method)
+	}
+
+	switch method {
+	case "RequestSession.Write":
+		err = plane.write(packet)
+	case "RequestSession.SetContentType":
+		err = plane.write(&EchoPacket{packet.SessionId, append([]byte("~ct"), packet.Body...), packet.Code})
+	case "RequestSession.Close":
+		err = plane.send(protocol.FrameClose, protocol.SessionPayload(packet.SessionId, nil))
+
+		plane.mutex.Lock()
+		delete(plane.credits, packet.SessionId)
+		plane.mutex.Unlock()
+	default:
+		return fmt.Errorf("unsupported method %s on the data plane", method)
+	}
+
+	if ack, ok := reply.(*bool); ok {
+		*ack = err == nil
+	}
+	return
+}
@@ -0,0 +1,185 @@
+package client
+
+import (
+	"bytes"
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+
+	"github.com/rrborja/brute/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeMaster plays the master's side of a multiplexed data plane: it
+// collects Data frames and returns their credit right away.
+type fakeMaster struct {
+	conn   net.Conn
+	bodies map[[32]byte]*bytes.Buffer
+	frames map[[32]byte]int
+	closed chan [32]byte
+	mutex  sync.Mutex
+}
+
+func newFakeMaster(conn net.Conn) *fakeMaster {
+	master := &fakeMaster{conn: conn, bodies: make(map[[32]byte]*bytes.Buffer),
+		frames: make(map[[32]byte]int), closed: make(chan [32]byte, 1)}
+	go master.serve()
+	return master
+}
+
+func (master *fakeMaster) serve() {
+	for {
+		frame, err := protocol.ReadFrame(master.conn)
+		if err != nil {
+			return
+		}
+		switch frame.Type {
+		case protocol.FrameData:
+			sid, _, body, _ := protocol.ParseData(frame.Payload)
+			master.mutex.Lock()
+			if master.bodies[sid] == nil {
+				master.bodies[sid] = new(bytes.Buffer)
+			}
+			master.bodies[sid].Write(body)
+			master.frames[sid]++
+			master.mutex.Unlock()
+			protocol.WriteFrame(master.conn, protocol.FrameWindowUpdate, protocol.WindowPayload(sid, len(body)+protocol.DataFrameCost))
+		case protocol.FrameClose:
+			sid, _, _ := protocol.SplitSession(frame.Payload)
+			master.closed <- sid
+		}
+	}
+}
+
+func pipeDataPlane() (*dataPlane, *fakeMaster, func()) {
+	endpointConn, masterConn := net.Pipe()
+	plane := newDataPlane(endpointConn)
+	go plane.serve(nil)
+	return plane, newFakeMaster(masterConn), func() {
+		endpointConn.Close()
+		masterConn.Close()
+	}
+}
+
+func TestDataPlaneFlowControl(t *testing.T) {
+	plane, master, closePlane := pipeDataPlane()
+	defer closePlane()
+
+	sid := [32]byte{1}
+	plane.open(sid)
+
+	body := bytes.Repeat([]byte("brute"), protocol.InitialWindow/2)
+	context := &Context{SessionId: sid, Rpc: plane.Call, Mutex: new(sync.Mutex)}
+	_, err := context.Write(body)
+	assert.NoError(t, err)
+
+	var ack bool
+	assert.NoError(t, plane.Call("RequestSession.Close", &EchoPacket{SessionId: sid}, &ack))
+	assert.Equal(t, sid, <-master.closed)
+
+	assert.Equal(t, body, master.bodies[sid].Bytes())
+	assert.True(t, master.frames[sid] > 1, "a body larger than the window must be split")
+
+	_, err = context.Write([]byte("late"))
+	assert.Equal(t, errUnknownSession, err)
+}
+
+const fragments = 100
+
+var fragment = []byte(`<div class="row">brute</div>`)
+
+func writeFragments(b *testing.B, context *Context) {
+	for i := 0; i < fragments; i++ {
+		if _, err := context.Write(fragment); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchSession stands in for the master's RequestSession RPC service.
+type benchSession struct{}
+
+func (benchSession) Write(packet *EchoPacket, ack *bool) error {
+	*ack = true
+	return nil
+}
+
+func (benchSession) Close(packet *EchoPacket, ack *bool) error {
+	*ack = true
+	return nil
+}
+
+func BenchmarkRpcDataPlane(b *testing.B) {
+	server := rpc.NewServer()
+	server.RegisterName("RequestSession", benchSession{})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			server.ServeConn(conn)
+		}
+	}()
+
+	rpcClient, err := rpc.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer rpcClient.Close()
+
+	b.SetBytes(int64(fragments * len(fragment)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		context := &Context{SessionId: [32]byte{byte(i)}, Rpc: rpcClient.Call, Mutex: new(sync.Mutex)}
+		writeFragments(b, context)
+
+		var ack bool
+		rpcClient.Call("RequestSession.Close", &EchoPacket{SessionId: context.SessionId}, &ack)
+	}
+}
+
+func BenchmarkMultiplexedDataPlane(b *testing.B) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan *fakeMaster)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			accepted <- newFakeMaster(conn)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	plane := newDataPlane(conn)
+	go plane.serve(nil)
+	master := <-accepted
+
+	b.SetBytes(int64(fragments * len(fragment)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		sid := [32]byte{byte(i)}
+		plane.open(sid)
+
+		context := &Context{SessionId: sid, Rpc: plane.Call, Mutex: new(sync.Mutex)}
+		writeFragments(b, context)
+
+		var ack bool
+		plane.Call("RequestSession.Close", &EchoPacket{SessionId: sid}, &ack)
+		<-master.closed
+	}
+}
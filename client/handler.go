@@ -3,95 +3,154 @@ package client
 import (
 	"reflect"
 	"fmt"
-	"log"
 	"runtime"
 	"os"
 	"net/http"
+	"sort"
+	"strings"
 )
 
-func Handle(handler map[string]interface{}, callEvents <- chan Context) {
+var (
+	contextType   = reflect.TypeOf(&Context{})
+	messageType   = reflect.TypeOf(Message{})
+	argumentsType = reflect.TypeOf(map[string]string{})
+)
+
+func Handle(handler map[string]interface{}, callEvents <- chan *Context) {
 	for callEvent := range callEvents {
-		go func(handlerSessions HandlerSessions, handlers map[string]interface{}, callEvent Context) {
-			sessionId := Gid()
-			sessionId.Persist()
-
-			defer func(callEvent Context) {
-				if done, ok := sessionId.Cleanup(); ok {
-					(<- <-done)()
-					close(done)
-					sessionId.Purge()
-				}
+		go serve(handler, callEvent)
+	}
+}
 
-				var ack bool
-				if err := callEvent.Rpc("RequestSession.Close",
-					&EchoPacket{SessionId: callEvent.SessionId},
-					&ack); err != nil {
-					panic(err)
-				}
-				if r := recover(); r != nil {
-					buf := make([]byte, 4096)
-					buf = buf[:runtime.Stack(buf, false)]
-					fmt.Fprintf(os.Stderr, "Endpoint %s encountered an error: %v\n%s", callEvent.Name, r, buf)
+func serve(handlers map[string]interface{}, callEvent *Context) {
+	respond(callEvent, func() {
+		// Start processing the endpoint while listening for writes to pass packets to the connected Client
+		handler, ok := handlers[callEvent.Method]
+		if !ok && callEvent.Method == http.MethodHead {
+			// The master drops the body of HEAD responses
+			handler, ok = handlers[http.MethodGet]
+		}
+
+		switch {
+		case ok:
+			results, err := invoke(handler, callEvent)
+			if err != nil {
+				if errs, ok := err.(ValidationErrors); ok {
+					respondError(callEvent, errs)
+					return
 				}
-			}(callEvent)
+				panic(err)
+			}
+			respondWith(callEvent, results)
+		case callEvent.Method == http.MethodOptions:
+			callEvent.SetHeader("Allow", allowed(handlers))
+			callEvent.WriteHeader(http.StatusNoContent)
+			callEvent.Write(nil)
+		default:
+			callEvent.SetHeader("Allow", allowed(handlers))
+			callEvent.WriteHeader(http.StatusMethodNotAllowed)
+			callEvent.Write([]byte(http.StatusText(http.StatusMethodNotAllowed)))
+		}
+	})
+}
 
-			writer := &callEvent
+// allowed lists the methods an endpoint serves, for the Allow header.
+func allowed(handlers map[string]interface{}) string {
+	methods := []string{http.MethodOptions}
+	for method := range handlers {
+		methods = append(methods, method)
+	}
+	if _, ok := handlers[http.MethodGet]; ok {
+		if _, ok := handlers[http.MethodHead]; !ok {
+			methods = append(methods, http.MethodHead)
+		}
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
 
-			handlerSessions.Set(sessionId, writer)
-			writerSessions.Set(sessionId, writer)
+// respond runs fn bound to callEvent and closes the session with the master
+// once fn, and every goroutine it started through Context.Go, returns. The
+// output still buffered by then is sent right before closing.
+func respond(callEvent *Context, fn func()) {
+	release := callEvent.Bind()
+	writerSessions.Set(Gid(), callEvent)
 
-			//clientHtml.SetWriter(sessionId, clientHtml.CreateRenderStackHolder(new(clientHtml.RenderStack), writer))
+	defer func() {
+		r := recover()
 
-			// Start processing the endpoint while listening for writes to pass packets to the connected Client
-			if handler, ok := handlers[callEvent.Method]; ok {
-				funcValue := reflect.ValueOf(handler)
-				funcType := funcValue.Type()
+		callEvent.finish()
+		if r != nil {
+			callEvent.fail()
+		} else {
+			callEvent.complete()
+		}
+		callEvent.finishSpan(r)
 
-				if funcType.Kind() != reflect.Func {
-					panic(fmt.Errorf("did I just tell you not to modify the main() for this endpoint %s? %v\n", callEvent.Name, handler))
-				}
+		writerSessions.Delete(Gid())
+		release()
 
-				switch callEvent.Method {
-				case http.MethodGet, http.MethodDelete:
-					if funcType.NumIn() == 0 {
-						handler.(func())()
-					} else if funcType.NumIn() == 1 && funcType.In(0).AssignableTo(reflect.TypeOf(map[string]string{})) {
-						handler.(func(map[string]string))(callEvent.Arguments)
-					} else {
-						panic(fmt.Errorf("invalid function signature for this endpoint %s: %v\n", callEvent.Name, handler))
-					}
-				case http.MethodPost, http.MethodPut, http.MethodPatch:
-					if funcType.NumIn() == 0 {
-						handler.(func())()
-					} else if funcType.NumIn() == 1 {
-						argType := funcType.In(0)
-						if argType.AssignableTo(reflect.TypeOf(Message{})) {
-							handler.(func(Message))(callEvent.Message)
-						} else if argType.AssignableTo(reflect.TypeOf(map[string]string{})) {
-							handler.(func(map[string]string))(callEvent.Arguments)
-						} else {
-							panic(fmt.Errorf("invalid function signature for this endpoint %s: %v\n", callEvent.Name, handler))
-						}
-					} else if funcType.NumIn() == 2 {
-						argType1st := funcType.In(0)
-						argType2nd := funcType.In(1)
-						if argType1st.AssignableTo(reflect.TypeOf(Message{})) && argType2nd.AssignableTo(reflect.TypeOf(map[string]string{})) {
-							handler.(func(Message, map[string]string))(callEvent.Message, callEvent.Arguments)
-						} else if argType2nd.AssignableTo(reflect.TypeOf(Message{})) && argType1st.AssignableTo(reflect.TypeOf(map[string]string{})) {
-							handler.(func(map[string]string, Message))(callEvent.Arguments, callEvent.Message)
-						} else {
-							panic(fmt.Errorf("invalid function signature for this endpoint %s: %v\n", callEvent.Name, handler))
-						}
-					} else {
-						panic(fmt.Errorf("invalid function signature for this endpoint %s: %v\n", callEvent.Name, handler))
-					}
-				default:
-					log.Printf("unsupported method %s for this endpoint %s\n", callEvent.Method, callEvent.Name)
-				}
-			} else {
-				log.Printf("Method %v is incompatible. Running a Get method for endpoint %s instead\n", callEvent.Method, callEvent.Name)
-				handlers[http.MethodGet].(func(map[string]string))(callEvent.Arguments)
+		var ack bool
+		err := callEvent.Rpc("RequestSession.Close",
+			&EchoPacket{SessionId: callEvent.SessionId},
+			&ack)
+		if callEvent.closed != nil {
+			callEvent.closed()
+		}
+		if err != nil {
+			// The master drops the sessions that expired or whose client
+			// left: only this one is lost
+			fmt.Fprintf(os.Stderr, "Endpoint %s could not close session %x: %v\n", callEvent.Name, callEvent.SessionId, err)
+		}
+		if r != nil {
+			buf := make([]byte, 4096)
+			buf = buf[:runtime.Stack(buf, false)]
+			fmt.Fprintf(os.Stderr, "Endpoint %s encountered an error: %v\n%s", callEvent.Name, r, buf)
+		}
+	}()
+
+	fn()
+}
+
+// invoke calls handler, filling each of its parameters by type: *Context
+// receives the request context, Message the submitted form values,
+// map[string]string the path and query arguments and a struct, or a
+// pointer to one, is decoded from the request with Context.Decode.
+//
+// A handler may return nothing, (error), (T, error) or (int, T, error);
+// the results are passed on to respondWith.
+func invoke(handler interface{}, context *Context) ([]reflect.Value, error) {
+	funcValue := reflect.ValueOf(handler)
+	funcType := funcValue.Type()
+
+	if funcType.Kind() != reflect.Func {
+		return nil, fmt.Errorf("did I just tell you not to modify the main() for this endpoint %s? %v\n", context.Name, handler)
+	}
+
+	if !checkResults(funcType) {
+		return nil, fmt.Errorf("invalid return values for this endpoint %s: %v\n", context.Name, handler)
+	}
+
+	in := make([]reflect.Value, funcType.NumIn())
+	for i := range in {
+		argType := funcType.In(i)
+		switch {
+		case argType == contextType:
+			in[i] = reflect.ValueOf(context)
+		case argType == messageType:
+			in[i] = reflect.ValueOf(context.Message)
+		case argType == argumentsType:
+			in[i] = reflect.ValueOf(context.Arguments)
+		case isBindable(argType):
+			value, err := context.decode(argType)
+			if err != nil {
+				return nil, err
 			}
-		}(handlerSessions, handler, callEvent)
+			in[i] = value
+		default:
+			return nil, fmt.Errorf("invalid function signature for this endpoint %s: %v\n", context.Name, handler)
+		}
 	}
+
+	return funcValue.Call(in), nil
 }
@@ -48,6 +48,8 @@ type RenderStackHolder struct {
 
 	root *RenderStack
 	writer io.Writer
+
+	mutex sync.Mutex
 }
 
 func CreateRenderStackHolder(root *RenderStack, writer io.Writer) *RenderStackHolder {
@@ -224,6 +226,39 @@ func (writer htmlWriter) Write(p []byte) (n int, err error) {
 	return writer(p)
 }
 
+type documentKey struct{}
+
+// Document returns the page being rendered for the request behind context,
+// creating it on first use. The closing tags are written when the handler
+// returns.
+func Document(context *client.Context) *RenderStackHolder {
+	holder, loaded := context.LoadOrStore(documentKey{}, CreateRenderStackHolder(new(RenderStack), context))
+	renderStackHolder := holder.(*RenderStackHolder)
+
+	if !loaded {
+		context.OnClose(func() {
+			if len(renderStackHolder.HeadElements()) > 0 || renderStackHolder.Body() != nil {
+				context.Write([]byte("</body></html>"))
+			}
+		})
+	}
+
+	return renderStackHolder
+}
+
+// Render runs fn with the calling goroutine bound to context, so the
+// element functions used inside fn write to that request's page. Render
+// calls sharing the same context are serialized.
+func Render(context *client.Context, fn func()) {
+	renderStackHolder := Document(context)
+
+	renderStackHolder.mutex.Lock()
+	defer renderStackHolder.mutex.Unlock()
+
+	defer context.Bind()()
+	fn()
+}
+
 func Writer(sessionId client.SessionId) (renderStackHolder *RenderStackHolder, ok bool) {
 	sessionWriterMutex.Lock()
 	defer sessionWriterMutex.Unlock()
@@ -231,26 +266,14 @@ func Writer(sessionId client.SessionId) (renderStackHolder *RenderStackHolder, o
 		return renderStackHolder, ok
 	}
 
+	if context, ok := client.CurrentContext(); ok {
+		return Document(context), true
+	}
+
 	writer := htmlWriter(client.Out)
 	renderStackHolder, ok = CreateRenderStackHolder(new(RenderStack), writer), true
 	sessionWriter[sessionId] = renderStackHolder
 
-	go func() {
-		if done, ok := sessionId.Cleanup(); !ok {
-			panic("Unexpected error occurred")
-		} else {
-			cleansed := make(chan func())
-			done <- cleansed
-
-			cleansed <- func() {
-				if len(renderStackHolder.HeadElements()) > 0 || renderStackHolder.Body() != nil {
-					client.Out([]byte("</body></html>"))
-				}
-			}
-			close(cleansed)
-		}
-	}()
-
 	return
 }
 
@@ -261,6 +284,12 @@ func Writer(sessionId client.SessionId) (renderStackHolder *RenderStackHolder, o
 //}
 
 func SetContentType(writer io.Writer, mimeName client.Mime) {
+	// A buffering writer such as *client.Context would coalesce the content
+	// type packet with the body, so it is sent on its own
+	if typer, ok := writer.(interface{ SetContentType(string) }); ok {
+		typer.SetContentType(string(mimeName))
+		return
+	}
 	writer.Write([]byte("~ct" + mimeName))
 }
 
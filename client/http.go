@@ -0,0 +1,101 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+type contextKey struct{}
+
+func withContext(parent context.Context, handlerContext *Context) context.Context {
+	return context.WithValue(parent, contextKey{}, handlerContext)
+}
+
+// FromRequest returns the endpoint context of a request served by RunHTTP.
+func FromRequest(r *http.Request) (*Context, bool) {
+	handlerContext, ok := r.Context().Value(contextKey{}).(*Context)
+	return handlerContext, ok
+}
+
+func HandleHTTP(handler http.Handler, callEvents <-chan *Context) {
+	for callEvent := range callEvents {
+		go serveHTTP(handler, callEvent)
+	}
+}
+
+func serveHTTP(handler http.Handler, callEvent *Context) {
+	respond(callEvent, func() {
+		r, err := callEvent.HTTPRequest()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Endpoint %s received a malformed request: %v\n", callEvent.Name, err)
+			callEvent.WriteHeader(http.StatusBadRequest)
+			callEvent.Write(nil)
+			return
+		}
+
+		w := &responseWriter{context: callEvent, header: make(http.Header)}
+		defer w.finish()
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// responseWriter is the http.ResponseWriter given to handlers run by
+// RunHTTP. Headers are sent to the master right before the status code.
+type responseWriter struct {
+	context     *Context
+	header      http.Header
+	wroteHeader bool
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *responseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	for key, values := range w.header {
+		for i, value := range values {
+			if i == 0 {
+				w.context.SetHeader(key, value)
+			} else {
+				w.context.AddHeader(key, value)
+			}
+		}
+	}
+
+	w.context.WriteHeader(statusCode)
+}
+
+func (w *responseWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+	return w.context.Write(data)
+}
+
+// Flush sends the buffered output to the master, see Context.Flush.
+func (w *responseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.context.Flush()
+}
+
+func (w *responseWriter) finish() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	// An empty write makes the master commit the status code even when the
+	// handler wrote no body, e.g. for 304 responses.
+	w.context.Write(nil)
+}
@@ -4,6 +4,7 @@ import (
 	"io"
 	"fmt"
 	"bufio"
+	"sync"
 	"github.com/rrborja/brute/client"
 )
 
@@ -18,6 +19,8 @@ type session struct {
 
 	jsonType Type
 	*bufio.Writer
+
+	mutex sync.Mutex
 }
 
 type Type int
@@ -27,8 +30,9 @@ const (
 	MAP
 )
 
+// Write buffers buf; the document is flushed as a whole when closed, or
+// piecewise whenever the buffer fills up.
 func (s *session) Write(buf []byte) {
-	defer s.Writer.Flush()
 	s.Writer.Write(buf)
 }
 
@@ -159,18 +163,22 @@ type ResponseWriter interface {
 }
 
 var jsonWriterSession map[client.SessionId]ResponseWriter
+var jsonWriterSessionMutex sync.RWMutex
 
 func init() {
 	jsonWriterSession = make(map[client.SessionId]ResponseWriter)
 }
 
-func AddSession(sessionId client.SessionId, writer io.Writer) (chan interface{}, chan interface{}) {
+func newSession(writer io.Writer) *session {
 	endBuf := make(chan interface{})
 	waitBuf := make(chan interface{})
 
-	s := &session{endBuf: endBuf, waitBuf: waitBuf, Writer: bufio.NewWriter(writer)}
+	return &session{endBuf: endBuf, waitBuf: waitBuf, Writer: bufio.NewWriter(writer)}
+}
 
-	go func(s *session) {
+// start has the document ended once the session is closed.
+func (s *session) start() *session {
+	go func(endBuf <-chan interface{}, waitBuf chan interface{}) {
 		<-endBuf
 		switch s.jsonType {
 		case MAP:
@@ -178,17 +186,14 @@ func AddSession(sessionId client.SessionId, writer io.Writer) (chan interface{},
 		case LIST:
 			s.Write([]byte("]"))
 		}
+		s.Writer.Flush()
 		close(waitBuf)
-	}(s)
-
-	jsonWriterSession[sessionId] = s
+	}(s.endBuf, s.waitBuf)
 
-	return endBuf, waitBuf
+	return s
 }
 
-func CloseSession(sessionId client.SessionId) {
-	s := jsonWriterSession[sessionId].(*session)
-
+func (s *session) close() {
 	if s.listStream != nil {
 		s.listStream()
 		s.listStream = nil
@@ -199,8 +204,74 @@ func CloseSession(sessionId client.SessionId) {
 	<-s.waitBuf
 }
 
+func AddSession(sessionId client.SessionId, writer io.Writer) (chan interface{}, chan interface{}) {
+	s := newSession(writer).start()
+
+	jsonWriterSessionMutex.Lock()
+	jsonWriterSession[sessionId] = s
+	jsonWriterSessionMutex.Unlock()
+
+	return s.endBuf, s.waitBuf
+}
+
+func CloseSession(sessionId client.SessionId) {
+	jsonWriterSessionMutex.RLock()
+	s := jsonWriterSession[sessionId].(*session)
+	jsonWriterSessionMutex.RUnlock()
+
+	s.close()
+
+	jsonWriterSessionMutex.Lock()
+	delete(jsonWriterSession, sessionId)
+	jsonWriterSessionMutex.Unlock()
+}
+
+type sessionKey struct{}
+
+// With returns the JSON document being written for the request behind
+// context, creating it on first use. The document is closed when the
+// handler returns.
+func With(context *client.Context) ResponseWriter {
+	if value, ok := context.Value(sessionKey{}); ok {
+		return value.(*session)
+	}
+
+	value, loaded := context.LoadOrStore(sessionKey{}, newSession(context))
+	s := value.(*session)
+
+	// Only the session stored is ever closed, so only it is started
+	if !loaded {
+		context.OnClose(s.start().close)
+	}
+
+	return s
+}
+
+// Render runs fn with the calling goroutine bound to context, so List and
+// Map calls inside fn write to that request's document. Render calls
+// sharing the same context are serialized.
+func Render(context *client.Context, fn func()) {
+	s := With(context).(*session)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	defer context.Bind()()
+	fn()
+}
+
 func JsonWriterSession(sessionId client.SessionId) ResponseWriter {
-	return jsonWriterSession[sessionId]
+	jsonWriterSessionMutex.RLock()
+	s, ok := jsonWriterSession[sessionId]
+	jsonWriterSessionMutex.RUnlock()
+
+	if !ok {
+		if context, bound := client.CurrentContext(); bound {
+			return With(context)
+		}
+	}
+
+	return s
 }
 
 type ListFunc func()
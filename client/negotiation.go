@@ -0,0 +1,228 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// HTTPError is an error a handler can return to answer with a given status
+// code. It is sent as an application/problem+json body.
+type HTTPError struct {
+	Code    int
+	Message string
+}
+
+func (err HTTPError) Error() string {
+	return fmt.Sprintf("%d %s", err.Code, err.Message)
+}
+
+const FormatProblemJson = Mime("application/problem+json")
+
+var (
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+	intType   = reflect.TypeOf(0)
+)
+
+// offers are the representations a returned value can be serialized to,
+// the first being the default.
+var offers = []Mime{FormatJson, FormatXml, TextHtml}
+
+var htmlTemplate = template.Must(template.New("value").Parse(
+	`<!DOCTYPE html><html><head><meta charset="UTF-8"></head><body>{{if .Raw}}{{.Raw}}{{else}}<pre>{{.Text}}</pre>{{end}}</body></html>`))
+
+// checkResults tells whether a handler returns nothing, (error), (T, error)
+// or (int, T, error).
+func checkResults(funcType reflect.Type) bool {
+	n := funcType.NumOut()
+	switch {
+	case n == 0:
+		return true
+	case n > 3 || funcType.Out(n-1) != errorType:
+		return false
+	case n == 3:
+		return funcType.Out(0) == intType
+	}
+	return true
+}
+
+// respondWith writes what a handler returned: the error as a problem
+// response, or else the value serialized to the representation the
+// request's Accept header prefers.
+func respondWith(context *Context, results []reflect.Value) {
+	if len(results) == 0 {
+		return
+	}
+
+	if err, _ := results[len(results)-1].Interface().(error); err != nil {
+		respondError(context, err)
+		return
+	}
+
+	if len(results) == 1 {
+		return
+	}
+
+	statusCode := http.StatusOK
+	if len(results) == 3 {
+		statusCode = int(results[0].Int())
+	}
+
+	value := results[len(results)-2]
+	if isNilValue(value) {
+		if statusCode == http.StatusOK {
+			statusCode = http.StatusNoContent
+		}
+		context.WriteHeader(statusCode)
+		context.Write(nil)
+		return
+	}
+
+	mime, ok := negotiate(context.Request.Header.Get("Accept"))
+	if !ok {
+		respondError(context, HTTPError{http.StatusNotAcceptable, "none of the accepted media types can be produced"})
+		return
+	}
+
+	body, err := serialize(mime, value.Interface())
+	if err != nil {
+		respondError(context, err)
+		return
+	}
+
+	context.SetHeader("Content-Type", string(mime)+"; charset=utf-8")
+	context.WriteHeader(statusCode)
+	context.Write(body)
+}
+
+func respondError(context *Context, err error) {
+	problem := struct {
+		Type   string           `json:"type"`
+		Title  string           `json:"title"`
+		Status int              `json:"status"`
+		Detail string           `json:"detail,omitempty"`
+		Errors ValidationErrors `json:"errors,omitempty"`
+	}{Type: "about:blank"}
+
+	switch e := err.(type) {
+	case HTTPError:
+		problem.Status, problem.Detail = e.Code, e.Message
+	case *HTTPError:
+		problem.Status, problem.Detail = e.Code, e.Message
+	case ValidationErrors:
+		problem.Status, problem.Errors = http.StatusBadRequest, e
+	default:
+		// Internal errors are not disclosed to the client
+		fmt.Fprintf(os.Stderr, "Endpoint %s returned an error: %v\n", context.Name, err)
+		problem.Status = http.StatusInternalServerError
+	}
+	problem.Title = http.StatusText(problem.Status)
+
+	body, _ := json.Marshal(problem)
+
+	context.SetHeader("Content-Type", FormatProblemJson)
+	context.WriteHeader(problem.Status)
+	context.Write(body)
+}
+
+func serialize(mime Mime, value interface{}) ([]byte, error) {
+	switch mime {
+	case FormatXml:
+		return xml.Marshal(value)
+	case TextHtml:
+		var data struct {
+			Raw  template.HTML
+			Text string
+		}
+		switch v := value.(type) {
+		case template.HTML:
+			data.Raw = v
+		case string:
+			data.Text = v
+		case fmt.Stringer:
+			data.Text = v.String()
+		default:
+			text, err := json.MarshalIndent(value, "", "  ")
+			if err != nil {
+				return nil, err
+			}
+			data.Text = string(text)
+		}
+		var buf bytes.Buffer
+		err := htmlTemplate.Execute(&buf, data)
+		return buf.Bytes(), err
+	default:
+		return json.Marshal(value)
+	}
+}
+
+// negotiate picks the offer with the highest quality in an Accept header.
+// An empty header accepts anything.
+func negotiate(accept string) (Mime, bool) {
+	if len(strings.TrimSpace(accept)) == 0 {
+		return offers[0], true
+	}
+
+	type mediaRange struct {
+		mime    string
+		quality float64
+	}
+
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		r := mediaRange{mime: strings.ToLower(strings.TrimSpace(params[0])), quality: 1}
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					r.quality = q
+				}
+			}
+		}
+		if r.quality > 0 {
+			ranges = append(ranges, r)
+		}
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].quality > ranges[j].quality })
+
+	for _, r := range ranges {
+		for _, offer := range offers {
+			if matches(r.mime, offer) {
+				return offer, true
+			}
+		}
+		if r.mime == "text/xml" {
+			return FormatXml, true
+		}
+	}
+
+	return "", false
+}
+
+func matches(mediaRange string, offer Mime) bool {
+	if mediaRange == "*/*" || mediaRange == string(offer) {
+		return true
+	}
+	if strings.HasSuffix(mediaRange, "/*") {
+		return strings.HasPrefix(string(offer), strings.TrimSuffix(mediaRange, "*"))
+	}
+	return false
+}
+
+func isNilValue(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return value.IsNil()
+	}
+	return false
+}
@@ -1,10 +1,78 @@
-// TODO: Supply clients' http.Request info
 package client
 
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+)
+
+// Request is the part of the original HTTP request the master forwards to
+// the endpoint along with every session.
+type Request struct {
+	Vars       map[string]string
+	URI        string
+	Proto      string
+	Host       string
+	RemoteAddr string
+	Header     http.Header
+	Body       []byte
+}
+
+// rpcRequest mirrors the master's reply to RequestSession.AcceptRpc.
+type rpcRequest struct {
+	Method     string
+	Message    url.Values
+	Arguments  map[string]string
+	Vars       map[string]string
+	URI        string
+	Proto      string
+	Host       string
+	RemoteAddr string
+	Header     http.Header
+	Body       []byte
+
+	Traceparent string
+}
+
+// HTTPRequest rebuilds the original request as an *http.Request. The
+// returned request carries this context, see FromRequest.
+func (context *Context) HTTPRequest() (*http.Request, error) {
+	request := context.Request
+
+	uri := request.URI
+	if len(uri) == 0 {
+		uri = "/"
+	}
+
+	r, err := http.NewRequest(context.Method, uri, bytes.NewReader(request.Body))
+	if err != nil {
+		return nil, err
+	}
+
+	r.RequestURI = uri
+	r.Host = request.Host
+	r.RemoteAddr = request.RemoteAddr
+	if major, minor, ok := http.ParseHTTPVersion(request.Proto); ok {
+		r.Proto, r.ProtoMajor, r.ProtoMinor = request.Proto, major, minor
+	}
+	if request.Header != nil {
+		r.Header = request.Header
+	}
+	r.ContentLength = int64(len(request.Body))
+
+	return r.WithContext(withContext(r.Context(), context)), nil
+}
+
 func RemoteAddress() string {
-	panic("unsupported")
+	if context, ok := CurrentContext(); ok {
+		return context.Request.RemoteAddr
+	}
+	return ""
 }
 
 func ContentLength() int64 {
-	panic("unsupported")
-}
\ No newline at end of file
+	if context, ok := CurrentContext(); ok {
+		return int64(len(context.Request.Body))
+	}
+	return 0
+}
@@ -1,17 +1,15 @@
 package client
 
-import "fmt"
-
 func SetHeader(key string, value interface{}) error {
-	context, _ := handlerSessions.Get(Gid())
-	var ack bool
-	return context.Call("RequestSession.Write",
-		&EchoPacket{context.(*Context).SessionId,
-		[]byte(fmt.Sprintf("%s=%v", key, value)), 40,
-		}, &ack)
+	context, ok := CurrentContext()
+	if !ok {
+		return errNotBound
+	}
+	return context.SetHeader(key, value)
 }
 
 func SetHttpCode(statusCode int) {
-	context, _ := handlerSessions.Get(Gid())
-	context.WriteHeader(statusCode)
-}
\ No newline at end of file
+	if context, ok := CurrentContext(); ok {
+		context.SetHttpCode(statusCode)
+	}
+}
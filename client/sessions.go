@@ -7,28 +7,6 @@ import (
 
 type SessionId int64
 
-func (sessionId SessionId) Persist() bool {
-	if _, ok := sessionSignals[sessionId]; ok {
-		return false
-	}
-	sessionSignals[sessionId] = make(chan chan func())
-	return true
-}
-
-func (sessionId SessionId) Cleanup() (done chan chan func(), ok bool) {
-	done, ok = sessionSignals[sessionId]
-	return
-}
-
-func (sessionId SessionId) Purge() {
-	delete(sessionSignals, sessionId)
-	delete(handlerSessions, sessionId)
-	delete(writerSessions, sessionId)
-}
-
-type SessionSignals map[SessionId]chan chan func()
-var sessionSignals SessionSignals
-
 type HandlerSessions map[SessionId]Handler
 type WriterSessions map[SessionId]io.Writer
 
@@ -50,6 +28,12 @@ func (handlerSession HandlerSessions) Set(sessionId SessionId, handler Handler)
 
 	handlerSession[sessionId] = handler
 }
+func (handlerSession HandlerSessions) Delete(sessionId SessionId) {
+	handlerSessionsMutex.Lock()
+	defer handlerSessionsMutex.Unlock()
+
+	delete(handlerSession, sessionId)
+}
 
 var (
 	writerSessions WriterSessions
@@ -70,9 +54,14 @@ func (writerSession WriterSessions) Set(sessionId SessionId, writer io.Writer) {
 	writerSession[sessionId] = writer
 	return
 }
+func (writerSession WriterSessions) Delete(sessionId SessionId) {
+	writerSessionsMutex.Lock()
+	defer writerSessionsMutex.Unlock()
+
+	delete(writerSession, sessionId)
+}
 
 func init() {
 	handlerSessions = make(HandlerSessions)
 	writerSessions = make(WriterSessions)
-	sessionSignals = make(SessionSignals)
 }
\ No newline at end of file
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/rrborja/brute/trace"
+)
+
+var (
+	tracer     *trace.Tracer
+	tracerOnce sync.Once
+)
+
+// endpointTracer is the tracer the master configured for this endpoint,
+// nil if tracing is off.
+func endpointTracer() *trace.Tracer {
+	tracerOnce.Do(func() {
+		var err error
+		if tracer, err = trace.FromEnv(); err != nil {
+			fmt.Fprintf(os.Stderr, "Tracing is off: %v\n", err)
+		}
+	})
+	return tracer
+}
+
+// closeTracer exports the spans left before the endpoint exits.
+func closeTracer() {
+	if tracer != nil {
+		tracer.Close()
+	}
+}
+
+// startSpan starts the span of a session, the child of the span the master
+// dispatched it from.
+func startSpan(source, method, traceparent string) *trace.Span {
+	parent, err := trace.ParseTraceparent(traceparent)
+	tracer := endpointTracer()
+	if err != nil && tracer == nil {
+		return nil
+	}
+
+	span := tracer.Start(method+" "+source, trace.KindServer, parent)
+	span.SetAttribute("brute.route", source)
+	span.SetAttribute("http.method", method)
+	return span
+}
+
+// finishSpan ends the span of the session once it is closed.
+func (context *Context) finishSpan(recovered interface{}) {
+	if context.span == nil {
+		return
+	}
+
+	status := context.status()
+	context.span.SetAttribute("http.status_code", status)
+	if recovered != nil {
+		context.span.SetError(fmt.Errorf("panic: %v", recovered))
+	} else if status >= http.StatusInternalServerError {
+		context.span.SetError(fmt.Errorf("%d %s", status, http.StatusText(status)))
+	}
+	context.span.Finish()
+}
+
+// StartSpan starts a span of the handler, the child of the session's span.
+// Finish it once the operation it times is done:
+//
+//	span := context.StartSpan("query users")
+//	defer span.Finish()
+//
+// Spans are nil, and their methods do nothing, when tracing is off.
+func (context *Context) StartSpan(name string) *trace.Span {
+	return context.span.Child(name)
+}
+
+// Traceparent is the trace context of the session in the form of the
+// traceparent header, to pass on to services the handler calls. It is
+// empty when tracing is off.
+func (context *Context) Traceparent() string {
+	return context.span.Traceparent()
+}
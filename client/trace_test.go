@@ -0,0 +1,38 @@
+package client
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestHandlerSpansContinueTheMasterTrace(t *testing.T) {
+	context, _ := newTestContext(http.MethodGet)
+	context.span = startSpan("home", http.MethodGet, traceparent)
+
+	var child string
+	handler := func(context *Context) {
+		span := context.StartSpan("query")
+		defer span.Finish()
+
+		assert.Equal(t, context.span.Context.SpanID, span.Parent)
+		child = span.Context.TraceID.String()
+	}
+	serve(map[string]interface{}{http.MethodGet: handler}, context)
+
+	assert.Equal(t, "00f067aa0ba902b7", context.span.Parent.String())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", child)
+	assert.False(t, context.span.End.IsZero())
+}
+
+func TestSpansAreNilWithoutTracing(t *testing.T) {
+	context, _ := newTestContext(http.MethodGet)
+	context.span = startSpan("home", http.MethodGet, "")
+
+	assert.Nil(t, context.span)
+	assert.Nil(t, context.StartSpan("query"))
+	assert.Equal(t, "", context.Traceparent())
+}
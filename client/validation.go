@@ -0,0 +1,173 @@
+package client
+
+import (
+	"fmt"
+	"net/mail"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FieldError describes a request value that could not be bound or that
+// broke one of its field's validation rules.
+type FieldError struct {
+	Field   string `json:"field,omitempty"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors is returned by Context.Decode. A handler whose struct
+// parameter fails to decode is not called; the client answers with a 400
+// problem response listing these errors instead.
+type ValidationErrors []FieldError
+
+func (errs ValidationErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		if len(err.Field) > 0 {
+			messages[i] = err.Field + ": " + err.Message
+		} else {
+			messages[i] = err.Message
+		}
+	}
+	return strings.Join(messages, "; ")
+}
+
+var (
+	patterns      = make(map[string]*regexp.Regexp)
+	patternsMutex sync.Mutex
+)
+
+func compile(pattern string) (*regexp.Regexp, error) {
+	patternsMutex.Lock()
+	defer patternsMutex.Unlock()
+
+	if compiled, ok := patterns[pattern]; ok {
+		return compiled, nil
+	}
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	patterns[pattern] = compiled
+	return compiled, nil
+}
+
+// validate checks the `validate` tag of every field of value. Rules are
+// separated by commas: required, min=N, max=N, email and regex=PATTERN.
+// min and max bound the length of strings and slices and the value of
+// numbers. Since a pattern may contain commas, regex must be the last rule.
+// A malformed rule is a mistake of the endpoint, not of the request: it
+// panics, answering 500.
+func validate(value reflect.Value) (errs ValidationErrors) {
+	valueType := value.Type()
+
+	for i := 0; i < valueType.NumField(); i++ {
+		field := valueType.Field(i)
+		tag, ok := field.Tag.Lookup("validate")
+		if !ok || len(field.PkgPath) > 0 {
+			continue
+		}
+
+		fieldValue := value.Field(i)
+		for _, rule := range rules(tag) {
+			if err := check(fieldValue, rule); err != nil {
+				errs = append(errs, FieldError{Field: fieldName(field), Rule: rule[0], Message: err.Error()})
+				break
+			}
+		}
+	}
+
+	return
+}
+
+func rules(tag string) (rules [][2]string) {
+	for len(tag) > 0 {
+		var rule string
+		if strings.HasPrefix(tag, "regex=") {
+			rule, tag = tag, ""
+		} else if i := strings.Index(tag, ","); i >= 0 {
+			rule, tag = tag[:i], tag[i+1:]
+		} else {
+			rule, tag = tag, ""
+		}
+
+		name, argument := rule, ""
+		if i := strings.Index(rule, "="); i >= 0 {
+			name, argument = rule[:i], rule[i+1:]
+		}
+		rules = append(rules, [2]string{strings.TrimSpace(name), argument})
+	}
+	return
+}
+
+func check(value reflect.Value, rule [2]string) error {
+	name, argument := rule[0], rule[1]
+
+	if value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			if name == "required" {
+				return fmt.Errorf("is required")
+			}
+			return nil
+		}
+		value = value.Elem()
+	}
+
+	switch name {
+	case "required":
+		if value.IsZero() {
+			return fmt.Errorf("is required")
+		}
+	case "min", "max":
+		bound, err := strconv.ParseFloat(argument, 64)
+		if err != nil {
+			panic(fmt.Sprintf("invalid %s validation rule %q", name, argument))
+		}
+		measure, unit := measure(value)
+		if name == "min" && measure < bound {
+			return fmt.Errorf("must be at least %s%s", argument, unit)
+		}
+		if name == "max" && measure > bound {
+			return fmt.Errorf("must be at most %s%s", argument, unit)
+		}
+	case "email":
+		if value.Kind() == reflect.String && value.Len() > 0 {
+			if address, err := mail.ParseAddress(value.String()); err != nil || address.Address != value.String() {
+				return fmt.Errorf("must be a valid email address")
+			}
+		}
+	case "regex":
+		pattern, err := compile(argument)
+		if err != nil {
+			panic(fmt.Sprintf("invalid regex validation rule %q", argument))
+		}
+		if value.Kind() == reflect.String && !pattern.MatchString(value.String()) {
+			return fmt.Errorf("must match %s", argument)
+		}
+	default:
+		panic(fmt.Sprintf("unknown validation rule %q", name))
+	}
+
+	return nil
+}
+
+// measure is what min and max compare: the length of strings and slices,
+// the value of numbers.
+func measure(value reflect.Value) (float64, string) {
+	switch value.Kind() {
+	case reflect.String:
+		return float64(len([]rune(value.String()))), " characters"
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return float64(value.Len()), " items"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), ""
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint()), ""
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), ""
+	}
+	return 0, ""
+}
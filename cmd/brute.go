@@ -36,16 +36,13 @@ import (
 	. "github.com/rrborja/brute/log"
 )
 
-const (
-	ServiceHost = "localhost"
-	ServicePort = "11792"
-	ServiceType = "tcp"
-)
-
-func RunService() net.Listener {
-	l, err := net.Listen(ServiceType, ":"+ServicePort)
+// RunService starts the control service the brute command talks to while
+// the master runs.
+func RunService(config *brute.Config) net.Listener {
+	l, err := brute.Listen(brute.ControlAddress(config))
 	if err != nil {
 		LogError(ErrorLog{err, fmt.Sprintf("Error listening: %v", err)})
+		CloseLogger()
 		os.Exit(1)
 	}
 
@@ -54,11 +51,14 @@ func RunService() net.Listener {
 			// Listen for an incoming connection.
 			conn, err := l.Accept()
 			if err != nil {
+				if brute.ShuttingDown() {
+					return
+				}
 				LogError(ErrorLog{err, fmt.Sprintf("Error accepting: %v", err.Error())})
 				continue
 			}
 
-			handleInternalCommand(conn)
+			go handleInternalCommand(conn)
 		}
 	}()
 
@@ -66,14 +66,24 @@ func RunService() net.Listener {
 }
 
 type ServiceMessage struct {
-	Command string
+	Command  string
+	Endpoint string `json:",omitempty"`
+	Follow   bool   `json:",omitempty"`
 }
 
-func (msg *ServiceMessage) Execute() {
+// Execute applies a change of the project to the running master and
+// returns the answer to the client.
+func (msg *ServiceMessage) Execute() ServiceReply {
 	switch msg.Command {
 	case "add-endpoint":
-	case "update-endpoint":
+		return ServiceReply{Line: "Restart the master to serve the new endpoint " + msg.Endpoint}
 	case "remove-endpoint":
+		if err := brute.RemoveEndpoint(msg.Endpoint); err != nil {
+			return ServiceReply{Error: fmt.Sprintf("%s: %v", msg.Endpoint, err)}
+		}
+		return ServiceReply{Line: "The master no longer serves " + msg.Endpoint}
+	default:
+		return ServiceReply{Error: "unknown command " + msg.Command}
 	}
 }
 
@@ -82,14 +92,25 @@ func handleInternalCommand(c net.Conn) {
 
 	var msg ServiceMessage
 
+	defer c.Close()
+
 	err := d.Decode(&msg)
 	if err != nil {
 		LogError(ErrorLog{err, err.Error()})
+		return
 	}
 
-	//TODO: handle master server commands and signals
-
-	c.Close()
+	switch msg.Command {
+	case "logs":
+		serveLogs(c, &msg)
+	case "status":
+		status := brute.Status()
+		json.NewEncoder(c).Encode(ServiceReply{Status: &status})
+	case "routes":
+		json.NewEncoder(c).Encode(ServiceReply{Routes: brute.RouteTable()})
+	default:
+		json.NewEncoder(c).Encode(msg.Execute())
+	}
 }
 
 func ProcessArgument(args ...string) error {
@@ -100,8 +121,26 @@ func ProcessArgument(args ...string) error {
 		return ProcessTypeForRemove(args[1:]...)
 	case "update":
 		return ProcessTypeForUpdate(args[1:]...)
+	case "set":
+		return ProcessTypeForSet(args[1:]...)
+	case "unset":
+		return ProcessTypeForUnset(args[1:]...)
+	case "check":
+		return ProcessTypeForCheck(args[1:]...)
+	case "push":
+		return ProcessTypeForPush(args[1:]...)
+	case "build":
+		return BuildProjectBundle(args[1:]...)
+	case "serve":
+		return ServeBundle(args[1:]...)
 	case "legal":
 		return ProcessLegalMenu(args[1:]...)
+	case "logs":
+		return ShowEndpointLogs(args[1:]...)
+	case "status":
+		return ShowStatus(args[1:]...)
+	case "routes":
+		return ShowRoutes(args[1:]...)
 	case "live":
 		return DeployAsLive(args[1:]...)
 	default:
@@ -185,11 +224,29 @@ func ProcessTypeForAdd(args ...string) error {
 }
 
 func ProcessTypeForRemove(args ...string) error {
-	return nil
+	if len(args) == 0 {
+		return errors.New("expected additional arguments for remove")
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "endpoint":
+		return RemoveEndpointOfProject(args[1:]...)
+	default:
+		return fmt.Errorf("unknown feature %v", args[0])
+	}
 }
 
 func ProcessTypeForUpdate(args ...string) error {
-	return nil
+	if len(args) == 0 {
+		return errors.New("expected additional arguments for update")
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "endpoint":
+		return UpdateEndpointOfProject(args[1:]...)
+	default:
+		return fmt.Errorf("unknown feature %v", args[0])
+	}
 }
 
 func CheckCurrentProjectFolder() (*brute.Config, error) {
@@ -16,11 +16,20 @@ var Version string
 // brute set remote -url="192.168.1.152"
 // brute unset remote
 // brute check remote
+// brute push remote
+// brute build -os=linux -arch=amd64
+// brute serve dist/Ritchie-20180601120000-linux-amd64.tar.gz
 // brute add endpoint -name=Ritchie -path=borja
-// brute remove endpoint -name=Ritchie
-// brute update endpoint -name=Ritchie
+// brute remove endpoint -name=Ritchie -src=archive
+// brute update endpoint -name=Ritchie -path=/ritchie -timeout=30s -y
+// brute logs Ritchie -f
+// brute status
+// brute routes
 func main() {
+	defer CloseLogger()
+
 	Logo(Version, true)
+	SetVersion(Version)
 
 	if len(os.Args) > 1 {
 		if err := ProcessArgument(os.Args[1:]...); err != nil {
@@ -28,25 +37,28 @@ func main() {
 				log.Fatal(err)
 			}
 		} else {
+			CloseLogger()
 			os.Exit(0)
 		}
 	}
 
 	Log("Checking contents...")
 
-	if config, err := CheckCurrentProjectFolder(); err != nil {
+	if config, err := ProjectConfig(); err != nil {
 		log.Fatal(err)
 	} else {
 		New(config)
 
 		SetProjectName(config.Name)
 
-		l := RunService()
+		l := RunService(config)
 		defer l.Close()
 
 		e := RunEndpointService()
 		defer e.Close()
 
+		HandleSignals()
+
 		StartAuthorizer(config)
 
 		StartEndpoints(config)
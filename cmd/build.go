@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/rrborja/brute"
+)
+
+// bundleConfig is the project of the bundle the master runs from, if any.
+var bundleConfig *brute.Config
+
+// BuildProjectBundle compiles the project into a bundle the master runs
+// from without the Go toolchain:
+//
+//	brute build -os=linux -arch=arm64 -version=1.2.0 -out=dist
+func BuildProjectBundle(args ...string) error {
+	flags := flag.NewFlagSet("build", flag.ContinueOnError)
+	goos := flags.String("os", "", "the GOOS to build for, this machine's by default")
+	goarch := flags.String("arch", "", "the GOARCH to build for, this machine's by default")
+	version := flags.String("version", "", "the version of the bundle, the time of the build by default")
+	out := flags.String("out", "dist", "the directory to write the bundle to")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unknown arguments %v", strings.Join(flags.Args(), " "))
+	}
+
+	config, err := currentProject()
+	if err != nil {
+		return err
+	}
+
+	bundle, manifest, err := brute.BuildBundle(config, ".", brute.BuildOptions{
+		Out:     *out,
+		Version: *version,
+		GOOS:    *goos,
+		GOARCH:  *goarch,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Built %s %s for %s in %s\n", orUnknown(manifest.Project), manifest.Version, manifest.Platform(), bundle)
+	return nil
+}
+
+// ServeBundle has the master run from a bundle built by brute build
+// instead of building the project in the current directory:
+//
+//	brute serve dist/shop-1.2.0-linux-amd64.tar.gz
+func ServeBundle(args ...string) error {
+	if len(args) != 1 {
+		return errors.New("expected the bundle to serve: brute serve <bundle>")
+	}
+
+	config, err := brute.OpenBundle(args[0])
+	if err != nil {
+		return err
+	}
+	bundleConfig = config
+
+	// Carry on starting the master
+	return errors.New("deploy")
+}
+
+// ProjectConfig is the project the master serves: that of the bundle given
+// to brute serve, or else that of the current directory.
+func ProjectConfig() (*brute.Config, error) {
+	if bundleConfig != nil {
+		return bundleConfig, nil
+	}
+	return CheckCurrentProjectFolder()
+}
@@ -0,0 +1,429 @@
+package cmd
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/manifoldco/promptui"
+	"github.com/rrborja/brute"
+)
+
+// What remove endpoint does with src/<name>.
+const (
+	SourceKeep    = "keep"
+	SourceArchive = "archive"
+	SourceDelete  = "delete"
+)
+
+// archiveDirectory receives the archived sources of removed endpoints.
+const archiveDirectory = "archive"
+
+var (
+	abortedError        = errors.New("aborted")
+	noEndpointNameError = errors.New("expected the name of the endpoint: -name=...")
+	masterRunningError  = errors.New("the master of this project is running: stop it before updating an endpoint")
+)
+
+var endpointNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// currentProject reads the .brute.yml of the current directory.
+func currentProject() (*brute.Config, error) {
+	files, err := ioutil.ReadDir(".")
+	if err != nil {
+		return nil, err
+	}
+	return CheckExistingValidProject(files)
+}
+
+func findRoute(config *brute.Config, name string) (int, error) {
+	for i, route := range config.Routes {
+		if route.Directory == name {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("no endpoint named %v", name)
+}
+
+// confirm asks before changing the project, unless yes is set.
+func confirm(label string, yes bool) error {
+	if yes {
+		return nil
+	}
+
+	prompt := promptui.Prompt{
+		Label:     label,
+		IsConfirm: true,
+	}
+	if _, err := prompt.Run(); err != nil {
+		return abortedError
+	}
+	return nil
+}
+
+// RemoveEndpointOfProject removes a route from .brute.yml:
+//
+//	brute remove endpoint -name=Ritchie -src=archive -y
+//
+// The source in src/<name> is kept, archived to archive/ or deleted
+// according to -src.
+func RemoveEndpointOfProject(args ...string) error {
+	flags := flag.NewFlagSet("remove endpoint", flag.ContinueOnError)
+	name := flags.String("name", "", "the name of the endpoint")
+	src := flags.String("src", SourceKeep, "what to do with the source: keep, archive or delete")
+	yes := flags.Bool("y", false, "remove without asking")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *name == "" {
+		return noEndpointNameError
+	}
+	switch *src {
+	case SourceKeep, SourceArchive, SourceDelete:
+	default:
+		return fmt.Errorf("unknown -src %v, expected keep, archive or delete", *src)
+	}
+
+	config, err := currentProject()
+	if err != nil {
+		return err
+	}
+	i, err := findRoute(config, *name)
+	if err != nil {
+		return err
+	}
+
+	label := fmt.Sprintf("Remove endpoint %v serving %v", *name, config.Routes[i].Path)
+	if *src != SourceKeep {
+		label += fmt.Sprintf(" and %v %v", *src, filepath.Join("src", *name))
+	}
+	if err := confirm(label, *yes); err != nil {
+		return err
+	}
+
+	// The route stays configured when its source could not be disposed of
+	if err := disposeSource(*name, *src, time.Now()); err != nil {
+		return err
+	}
+
+	config.Routes = append(config.Routes[:i], config.Routes[i+1:]...)
+	ModifyProjectConfig(config)
+
+	fmt.Printf("Endpoint %v removed\n", *name)
+	return notifyMaster(ServiceMessage{Command: "remove-endpoint", Endpoint: *name})
+}
+
+// disposeSource archives or deletes src/<name>.
+func disposeSource(name, src string, now time.Time) error {
+	source := filepath.Join("src", name)
+	if _, err := os.Stat(source); os.IsNotExist(err) || src == SourceKeep {
+		return nil
+	}
+
+	if src == SourceArchive {
+		archive := filepath.Join(archiveDirectory, fmt.Sprintf("%s-%s.tar.gz", name, now.Format("20060102T150405")))
+		if err := archiveSource(source, archive); err != nil {
+			return err
+		}
+		fmt.Printf("Archived %v to %v\n", source, archive)
+	}
+
+	return os.RemoveAll(source)
+}
+
+// archiveSource writes the files under source to a gzipped tarball.
+func archiveSource(source, archive string) (err error) {
+	if err := os.MkdirAll(filepath.Dir(archive), 0700); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(archive, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(archive)
+		}
+	}()
+
+	gz := gzip.NewWriter(file)
+	tw := tar.NewWriter(gz)
+
+	err = filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(path)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// EndpointUpdate is what update endpoint changes; nil fields are left as
+// they are.
+type EndpointUpdate struct {
+	Path      *string
+	Directory *string
+	Protected *bool
+	Timeout   *string
+	Activate  *string
+}
+
+// UpdateEndpointOfProject changes a route of .brute.yml:
+//
+//	brute update endpoint -name=Ritchie -path=/borja -rename=Borja -protected=true -timeout=30s -y
+//
+// Renaming moves src/<name> along. The master of the project must not be
+// running: it serves and watches the routes as they were when it started.
+func UpdateEndpointOfProject(args ...string) error {
+	flags := flag.NewFlagSet("update endpoint", flag.ContinueOnError)
+	name := flags.String("name", "", "the name of the endpoint")
+	path := flags.String("path", "", "the new URI path")
+	rename := flags.String("rename", "", "the new name, moving its source directory")
+	protected := flags.String("protected", "", "true to have the authorizer check the requests")
+	timeout := flags.String("timeout", "", "how long a request may take, e.g. 30s, empty for the default")
+	activate := flags.String("activate", "", "the activation of the endpoint")
+	yes := flags.Bool("y", false, "update without asking")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *name == "" {
+		return noEndpointNameError
+	}
+
+	var update EndpointUpdate
+	var err error
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "path":
+			update.Path = path
+		case "rename":
+			update.Directory = rename
+		case "protected":
+			var value bool
+			if value, err = strconv.ParseBool(*protected); err != nil {
+				err = fmt.Errorf("invalid -protected %v, expected true or false", *protected)
+			}
+			update.Protected = &value
+		case "timeout":
+			update.Timeout = timeout
+		case "activate":
+			update.Activate = activate
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	config, err := currentProject()
+	if err != nil {
+		return err
+	}
+
+	if conn, err := dialMaster(); err == nil {
+		conn.Close()
+		return masterRunningError
+	}
+
+	changes, err := update.Validate(config, *name)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		return errors.New("nothing to update: give -path, -rename, -protected, -timeout or -activate")
+	}
+
+	fmt.Printf("Endpoint %v:\n  %v\n", *name, strings.Join(changes, "\n  "))
+	if err := confirm("Apply the changes", *yes); err != nil {
+		return err
+	}
+
+	if err := update.Apply(config, *name); err != nil {
+		return err
+	}
+
+	fmt.Printf("Endpoint %v updated\n", *name)
+	return nil
+}
+
+// Validate checks the update of the route name and describes the changes.
+func (update *EndpointUpdate) Validate(config *brute.Config, name string) (changes []string, err error) {
+	i, err := findRoute(config, name)
+	if err != nil {
+		return nil, err
+	}
+	route := config.Routes[i]
+	routeConfig := route.RouteConfig
+	if routeConfig == nil {
+		routeConfig = &brute.RouteConfig{}
+	}
+
+	if update.Path != nil && *update.Path != route.Path {
+		if err := validatePath(*update.Path); err != nil {
+			return nil, err
+		}
+		for j, other := range config.Routes {
+			if j != i && other.Path == *update.Path {
+				return nil, fmt.Errorf("endpoint %v already serves %v", other.Directory, other.Path)
+			}
+		}
+		changes = append(changes, fmt.Sprintf("path: %v -> %v", route.Path, *update.Path))
+	}
+
+	if update.Directory != nil && *update.Directory != route.Directory {
+		if !endpointNamePattern.MatchString(*update.Directory) {
+			return nil, fmt.Errorf("invalid name %v: use letters, digits, - and _", *update.Directory)
+		}
+		if _, err := findRoute(config, *update.Directory); err == nil {
+			return nil, fmt.Errorf("cannot rename to the existing endpoint %v", *update.Directory)
+		}
+		if _, err := os.Stat(filepath.Join("src", *update.Directory)); err == nil {
+			return nil, fmt.Errorf("%v already exists", filepath.Join("src", *update.Directory))
+		}
+		changes = append(changes, fmt.Sprintf("name: %v -> %v, moving %v", route.Directory, *update.Directory, filepath.Join("src", route.Directory)))
+	}
+
+	if update.Protected != nil && *update.Protected != routeConfig.Protected {
+		if *update.Protected && config.Authorizer == nil {
+			return nil, errors.New("the project has no authorizer to protect the endpoint with")
+		}
+		changes = append(changes, fmt.Sprintf("protected: %v -> %v", routeConfig.Protected, *update.Protected))
+	}
+
+	if update.Timeout != nil && *update.Timeout != routeConfig.Timeout {
+		if *update.Timeout != "" {
+			if d, err := time.ParseDuration(*update.Timeout); err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid -timeout %v, expected a positive duration such as 30s", *update.Timeout)
+			}
+		}
+		changes = append(changes, fmt.Sprintf("timeout: %v -> %v", orDefault(routeConfig.Timeout), orDefault(*update.Timeout)))
+	}
+
+	if update.Activate != nil && *update.Activate != routeConfig.Activate {
+		if strings.TrimSpace(*update.Activate) != *update.Activate {
+			return nil, fmt.Errorf("invalid -activate %q", *update.Activate)
+		}
+		changes = append(changes, fmt.Sprintf("activate: %v -> %v", orDefault(routeConfig.Activate), orDefault(*update.Activate)))
+	}
+
+	return changes, nil
+}
+
+func orDefault(value string) string {
+	if value == "" {
+		return "(default)"
+	}
+	return value
+}
+
+// validatePath checks a URI path template of the router.
+func validatePath(path string) error {
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("invalid path %v: it must start with /", path)
+	}
+
+	depth := 0
+	for _, c := range path {
+		switch c {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		}
+		if depth < 0 || depth > 1 {
+			return fmt.Errorf("invalid path %v: unbalanced braces", path)
+		}
+	}
+	if depth != 0 {
+		return fmt.Errorf("invalid path %v: unbalanced braces", path)
+	}
+	return nil
+}
+
+// Apply writes a validated update of the route name to .brute.yml, moving
+// its source first when it is renamed.
+func (update *EndpointUpdate) Apply(config *brute.Config, name string) error {
+	i, err := findRoute(config, name)
+	if err != nil {
+		return err
+	}
+	route := &config.Routes[i]
+
+	if update.Directory != nil && *update.Directory != route.Directory {
+		source := filepath.Join("src", route.Directory)
+		if _, err := os.Stat(source); err == nil {
+			if err := os.Rename(source, filepath.Join("src", *update.Directory)); err != nil {
+				return err
+			}
+		}
+		route.Directory = *update.Directory
+	}
+
+	if update.Path != nil {
+		route.Path = *update.Path
+	}
+
+	if update.Protected != nil || update.Timeout != nil || update.Activate != nil {
+		if route.RouteConfig == nil {
+			route.RouteConfig = &brute.RouteConfig{}
+		} else {
+			// The routes may share their config through a yaml anchor
+			routeConfig := *route.RouteConfig
+			route.RouteConfig = &routeConfig
+		}
+		if update.Protected != nil {
+			route.Protected = *update.Protected
+		}
+		if update.Timeout != nil {
+			route.Timeout = *update.Timeout
+		}
+		if update.Activate != nil {
+			route.Activate = *update.Activate
+		}
+	}
+
+	ModifyProjectConfig(config)
+	return nil
+}
@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rrborja/brute"
+	"github.com/stretchr/testify/assert"
+)
+
+func inProject(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "brute")
+	assert.NoError(t, err)
+	cwd, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chdir(dir))
+
+	assert.NoError(t, os.MkdirAll(filepath.Join("src", "home"), 0700))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join("src", "home", "home.go"), []byte("package main\n"), 0600))
+
+	return func() {
+		os.Chdir(cwd)
+		os.RemoveAll(dir)
+	}
+}
+
+func testProject() *brute.Config {
+	return &brute.Config{Routes: []brute.Route{
+		{Path: "/", Directory: "home"},
+		{Path: "/users/{id}", Directory: "users"},
+	}}
+}
+
+func TestUpdateEndpointValidation(t *testing.T) {
+	defer inProject(t)()
+	config := testProject()
+
+	for _, update := range []EndpointUpdate{
+		{Path: stringOf("users")},
+		{Path: stringOf("/users/{id")},
+		{Path: stringOf("/users/{id}")},
+		{Directory: stringOf("users")},
+		{Directory: stringOf("../etc")},
+		{Timeout: stringOf("-1s")},
+		{Timeout: stringOf("soon")},
+		{Protected: boolOf(true)},
+	} {
+		_, err := update.Validate(config, "home")
+		assert.Error(t, err)
+	}
+
+	_, err := (&EndpointUpdate{}).Validate(config, "about")
+	assert.Error(t, err)
+
+	changes, err := (&EndpointUpdate{Path: stringOf("/")}).Validate(config, "home")
+	assert.NoError(t, err)
+	assert.Empty(t, changes)
+}
+
+func TestUpdateEndpointMovesTheSource(t *testing.T) {
+	defer inProject(t)()
+	config := testProject()
+
+	update := EndpointUpdate{Path: stringOf("/home"), Directory: stringOf("index"), Timeout: stringOf("30s")}
+	changes, err := update.Validate(config, "home")
+	assert.NoError(t, err)
+	assert.Len(t, changes, 3)
+	assert.NoError(t, update.Apply(config, "home"))
+
+	_, err = os.Stat(filepath.Join("src", "index", "home.go"))
+	assert.NoError(t, err)
+
+	saved, err := currentProject()
+	assert.NoError(t, err)
+	assert.Equal(t, "index", saved.Routes[0].Directory)
+	assert.Equal(t, "/home", saved.Routes[0].Path)
+	assert.Equal(t, "30s", saved.Routes[0].Timeout)
+	assert.Nil(t, saved.Routes[1].RouteConfig)
+}
+
+func TestRemovedSourceIsArchived(t *testing.T) {
+	defer inProject(t)()
+
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	assert.NoError(t, disposeSource("home", SourceArchive, now))
+
+	_, err := os.Stat(filepath.Join("src", "home"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(archiveDirectory, "home-20180601T120000.tar.gz"))
+	assert.NoError(t, err)
+
+	assert.NoError(t, disposeSource("users", SourceDelete, now))
+}
+
+func TestEndpointIsNotUpdatedUnderARunningMaster(t *testing.T) {
+	defer inProject(t)()
+	config := testProject()
+	ModifyProjectConfig(config)
+
+	assert.NoError(t, os.MkdirAll("bin", 0700))
+	l, err := brute.Listen(brute.ControlAddress(config))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	assert.Equal(t, masterRunningError, UpdateEndpointOfProject("-name=home", "-rename=index", "-y"))
+	_, err = os.Stat(filepath.Join("src", "home", "home.go"))
+	assert.NoError(t, err)
+}
+
+func TestRouteIsKeptWhenItsSourceCannotBeArchived(t *testing.T) {
+	defer inProject(t)()
+	ModifyProjectConfig(testProject())
+
+	// The archive directory cannot be created
+	assert.NoError(t, ioutil.WriteFile(archiveDirectory, nil, 0600))
+
+	assert.Error(t, RemoveEndpointOfProject("-name=home", "-src=archive", "-y"))
+
+	saved, err := currentProject()
+	assert.NoError(t, err)
+	assert.Len(t, saved.Routes, 2)
+	_, err = os.Stat(filepath.Join("src", "home", "home.go"))
+	assert.NoError(t, err)
+}
+
+func stringOf(value string) *string {
+	return &value
+}
+
+func boolOf(value bool) *bool {
+	return &value
+}
@@ -0,0 +1,176 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/rrborja/brute"
+	"github.com/rrborja/brute/protocol"
+)
+
+// ServiceReply is what the control service answers to a ServiceMessage,
+// one per line of a streamed answer such as the output of an endpoint.
+type ServiceReply struct {
+	Line   string              `json:",omitempty"`
+	Error  string              `json:",omitempty"`
+	Status *brute.MasterStatus `json:",omitempty"`
+	Routes []brute.RouteEntry  `json:",omitempty"`
+}
+
+var masterNotRunningError = errors.New("the master of this project is not running")
+
+// serveLogs sends the output kept for an endpoint, then the new lines as
+// they come when following until the client goes away.
+func serveLogs(c net.Conn, msg *ServiceMessage) {
+	e := json.NewEncoder(c)
+
+	output, err := brute.EndpointOutputOf(msg.Endpoint)
+	if err != nil {
+		e.Encode(ServiceReply{Error: fmt.Sprintf("%s: %v", msg.Endpoint, err)})
+		return
+	}
+
+	if !msg.Follow {
+		for _, line := range output.Lines() {
+			if e.Encode(ServiceReply{Line: line.String()}) != nil {
+				return
+			}
+		}
+		return
+	}
+
+	lines, follow, stop := output.Follow()
+	defer stop()
+
+	for _, line := range lines {
+		if e.Encode(ServiceReply{Line: line.String()}) != nil {
+			return
+		}
+	}
+
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, c)
+		close(gone)
+	}()
+
+	for {
+		select {
+		case line := <-follow:
+			if e.Encode(ServiceReply{Line: line.String()}) != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}
+
+// dialMaster connects to the control service of the project in the
+// current directory.
+func dialMaster() (net.Conn, error) {
+	config, err := currentProject()
+	if err != nil {
+		return nil, err
+	}
+
+	network, address := protocol.ParseAddress(brute.ControlAddress(config))
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, masterNotRunningError
+	}
+	return conn, nil
+}
+
+// requestMaster sends a message to the control service of the running
+// master and returns its reply.
+func requestMaster(msg ServiceMessage) (*ServiceReply, error) {
+	conn, err := dialMaster()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(msg); err != nil {
+		return nil, err
+	}
+
+	var reply ServiceReply
+	if err := json.NewDecoder(conn).Decode(&reply); err == io.EOF {
+		return nil, errors.New("the master closed the connection without replying")
+	} else if err != nil {
+		return nil, err
+	}
+
+	if reply.Error != "" {
+		return nil, errors.New(reply.Error)
+	}
+	return &reply, nil
+}
+
+// notifyMaster tells the running master of a change to the project and
+// prints its answer. Nothing is sent when the master is not running.
+func notifyMaster(msg ServiceMessage) error {
+	reply, err := requestMaster(msg)
+	if err == masterNotRunningError {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stdout, reply.Line)
+	return nil
+}
+
+// ShowEndpointLogs prints the output of an endpoint of the running master:
+//
+//	brute logs home -f
+func ShowEndpointLogs(args ...string) error {
+	var name string
+	var follow bool
+	for _, arg := range args {
+		switch arg {
+		case "-f", "--follow", "-follow":
+			follow = true
+		default:
+			if strings.HasPrefix(arg, "-") || name != "" {
+				return fmt.Errorf("unknown argument %v", arg)
+			}
+			name = arg
+		}
+	}
+	if name == "" {
+		return errors.New("expected the name of an endpoint: brute logs <endpoint> [-f]")
+	}
+
+	conn, err := dialMaster()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(ServiceMessage{Command: "logs", Endpoint: name, Follow: follow}); err != nil {
+		return err
+	}
+
+	d := json.NewDecoder(conn)
+	for {
+		var reply ServiceReply
+		if err := d.Decode(&reply); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if reply.Error != "" {
+			return errors.New(reply.Error)
+		}
+		fmt.Fprintln(os.Stdout, reply.Line)
+	}
+}
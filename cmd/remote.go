@@ -0,0 +1,305 @@
+package cmd
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/manifoldco/promptui"
+	"github.com/rrborja/brute"
+	"gopkg.in/yaml.v2"
+)
+
+// CredentialsEnv overrides where the tokens of the remotes are kept,
+// ~/.brute/credentials.yml by default.
+const CredentialsEnv = "BRUTE_CREDENTIALS"
+
+var noRemoteError = errors.New("the project has no remote: brute set remote -url=...")
+
+func credentialsFile() string {
+	if name := os.Getenv(CredentialsEnv); name != "" {
+		return name
+	}
+	return filepath.Join(os.Getenv("HOME"), ".brute", "credentials.yml")
+}
+
+// readCredentials returns the tokens of the remotes by their address.
+func readCredentials() (map[string]string, error) {
+	credentials := make(map[string]string)
+
+	data, err := ioutil.ReadFile(credentialsFile())
+	if os.IsNotExist(err) {
+		return credentials, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal(data, &credentials); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", credentialsFile(), err)
+	}
+	return credentials, nil
+}
+
+func writeCredentials(credentials map[string]string) error {
+	data, err := yaml.Marshal(credentials)
+	if err != nil {
+		return err
+	}
+
+	name := credentialsFile()
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name, data, 0600)
+}
+
+// remoteOf returns the remote of the project and its token.
+func remoteOf(config *brute.Config) (address, token string, err error) {
+	if config.Remote == "" {
+		return "", "", noRemoteError
+	}
+	if address, err = brute.RemoteAddress(config.Remote); err != nil {
+		return "", "", err
+	}
+
+	credentials, err := readCredentials()
+	if err != nil {
+		return "", "", err
+	}
+	token, ok := credentials[address]
+	if !ok {
+		return "", "", fmt.Errorf("no token for remote %s: brute set remote -url=%s -token=...", address, config.Remote)
+	}
+	return address, token, nil
+}
+
+// SetProjectRemote stores the remote master of the project, and its token
+// out of the project:
+//
+//	brute set remote -url=192.168.1.152 -token=...
+//
+// The token is the content of the token file of the remote master. It is
+// asked for when -token is not given.
+func SetProjectRemote(args ...string) error {
+	flags := flag.NewFlagSet("set remote", flag.ContinueOnError)
+	url := flags.String("url", "", "the address of the remote master, host or host:port")
+	token := flags.String("token", "", "the token of the remote master")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *url == "" {
+		return errors.New("expected the address of the remote: -url=...")
+	}
+	address, err := brute.RemoteAddress(*url)
+	if err != nil {
+		return err
+	}
+
+	config, err := currentProject()
+	if err != nil {
+		return err
+	}
+
+	if *token == "" {
+		prompt := promptui.Prompt{
+			Label: "Token of " + address,
+			Mask:  '*',
+		}
+		if *token, err = prompt.Run(); err != nil {
+			return abortedError
+		}
+	}
+
+	credentials, err := readCredentials()
+	if err != nil {
+		return err
+	}
+	credentials[address] = strings.TrimSpace(*token)
+	if err := writeCredentials(credentials); err != nil {
+		return err
+	}
+
+	config.Remote = *url
+	ModifyProjectConfig(config)
+
+	fmt.Printf("Remote set to %s\n", address)
+	return nil
+}
+
+// UnsetProjectRemote forgets the remote of the project and its token.
+func UnsetProjectRemote(args ...string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unknown arguments %v", strings.Join(args, " "))
+	}
+
+	config, err := currentProject()
+	if err != nil {
+		return err
+	}
+	if config.Remote == "" {
+		return noRemoteError
+	}
+
+	if address, err := brute.RemoteAddress(config.Remote); err == nil {
+		credentials, err := readCredentials()
+		if err != nil {
+			return err
+		}
+		if _, ok := credentials[address]; ok {
+			delete(credentials, address)
+			if err := writeCredentials(credentials); err != nil {
+				return err
+			}
+		}
+	}
+
+	config.Remote = ""
+	ModifyProjectConfig(config)
+
+	fmt.Println("Remote unset")
+	return nil
+}
+
+// CheckProjectRemote tells whether the remote master is reachable, accepts
+// the token and speaks a compatible version.
+func CheckProjectRemote(args ...string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unknown arguments %v", strings.Join(args, " "))
+	}
+
+	config, err := currentProject()
+	if err != nil {
+		return err
+	}
+	address, token, err := remoteOf(config)
+	if err != nil {
+		return err
+	}
+
+	reply, err := brute.CheckRemote(address, token)
+	if err != nil {
+		return fmt.Errorf("remote %s: %v", address, err)
+	}
+
+	fmt.Printf("Remote %s is reachable, serving project %s with brute %s on %s (remote control v%d)\n",
+		address, orUnknown(reply.Project), orUnknown(reply.BruteVersion), orUnknown(reply.Platform), reply.Version)
+	if local := brute.BuildVersion(); local != "" && reply.BruteVersion != "" && local != reply.BruteVersion {
+		fmt.Printf("The remote runs brute %s but this is brute %s; endpoints built here may not match\n", reply.BruteVersion, local)
+	}
+	if reply.Project != "" && reply.Project != config.Name {
+		fmt.Printf("The remote serves project %s, not %s\n", reply.Project, config.Name)
+	}
+	return nil
+}
+
+func orUnknown(value string) string {
+	if value == "" {
+		return "(unknown)"
+	}
+	return value
+}
+
+// PushProjectRemote sends a bundle to the remote master, which switches to
+// it at once. Unless one is given, the project is built for the platform of
+// the remote:
+//
+//	brute push remote [-bundle=dist/shop-1.2.0-linux-amd64.tar.gz]
+func PushProjectRemote(args ...string) error {
+	flags := flag.NewFlagSet("push remote", flag.ContinueOnError)
+	bundle := flags.String("bundle", "", "the bundle built by brute build to push")
+	version := flags.String("version", "", "the version of the bundle built, the time of the build by default")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unknown arguments %v", strings.Join(flags.Args(), " "))
+	}
+
+	config, err := currentProject()
+	if err != nil {
+		return err
+	}
+	address, token, err := remoteOf(config)
+	if err != nil {
+		return err
+	}
+
+	if *bundle == "" {
+		remote, err := brute.CheckRemote(address, token)
+		if err != nil {
+			return fmt.Errorf("remote %s: %v", address, err)
+		}
+		platform := strings.SplitN(remote.Platform, "/", 2)
+		if len(platform) != 2 {
+			return fmt.Errorf("remote %s did not tell its platform; build the bundle with brute build and push it with -bundle", address)
+		}
+
+		out, err := ioutil.TempDir("", "brute-push-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(out)
+
+		var manifest *brute.Manifest
+		*bundle, manifest, err = brute.BuildBundle(config, ".", brute.BuildOptions{
+			Out:     out,
+			Version: *version,
+			GOOS:    platform[0],
+			GOARCH:  platform[1],
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Built %s for %s\n", manifest.Version, manifest.Platform())
+	}
+
+	reply, err := brute.PushBundle(address, token, *bundle)
+	if err != nil {
+		return fmt.Errorf("remote %s: %v", address, err)
+	}
+
+	fmt.Printf("Release %s is active on %s\n", reply.Release, address)
+	if len(reply.Restarted) > 0 {
+		fmt.Printf("Restarted %s\n", strings.Join(reply.Restarted, ", "))
+	}
+	if len(reply.Pending) > 0 {
+		fmt.Printf("Restart the remote master to apply %s\n", strings.Join(reply.Pending, ", "))
+	}
+	return nil
+}
+
+// ProcessTypeForSet, ProcessTypeForUnset, ProcessTypeForCheck and
+// ProcessTypeForPush dispatch brute set, unset, check and push.
+func ProcessTypeForSet(args ...string) error {
+	return processRemote("set", SetProjectRemote, args...)
+}
+
+func ProcessTypeForUnset(args ...string) error {
+	return processRemote("unset", UnsetProjectRemote, args...)
+}
+
+func ProcessTypeForCheck(args ...string) error {
+	return processRemote("check", CheckProjectRemote, args...)
+}
+
+func ProcessTypeForPush(args ...string) error {
+	return processRemote("push", PushProjectRemote, args...)
+}
+
+func processRemote(command string, process func(args ...string) error, args ...string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected additional arguments for %s", command)
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "remote":
+		return process(args[1:]...)
+	default:
+		return fmt.Errorf("unknown feature %v", args[0])
+	}
+}
@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rrborja/brute"
+)
+
+// ShowStatus prints what the running master and its endpoints are doing:
+//
+//	brute status [-json]
+func ShowStatus(args ...string) error {
+	flags := flag.NewFlagSet("status", flag.ContinueOnError)
+	asJson := flags.Bool("json", false, "print the status as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	reply, err := requestMaster(ServiceMessage{Command: "status"})
+	if err != nil {
+		return err
+	}
+	if reply.Status == nil {
+		return fmt.Errorf("the master did not report its status")
+	}
+
+	if *asJson {
+		return printJson(os.Stdout, reply.Status)
+	}
+	printStatus(os.Stdout, reply.Status)
+	return nil
+}
+
+func printStatus(out io.Writer, status *brute.MasterStatus) {
+	ready := "not ready"
+	if status.Ready {
+		ready = "ready"
+	}
+	fmt.Fprintf(out, "Master pid %d, up %v, %s\n\n", status.Pid, roundDuration(status.Uptime), ready)
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ENDPOINT\tSTATE\tPID\tUPTIME\tBUILD\tIN FLIGHT\tRESTARTS\tEXITS")
+	for _, endpoint := range status.Endpoints {
+		state := string(endpoint.State)
+		if endpoint.Detail != "" {
+			state += " (" + endpoint.Detail + ")"
+		}
+		build := "-"
+		if endpoint.Build != "" {
+			build = shortHash(endpoint.Build)
+		}
+		restarts := strconv.FormatUint(endpoint.Restarts, 10)
+		exits := strconv.FormatUint(endpoint.Exits, 10)
+
+		if len(endpoint.Replicas) == 0 {
+			fmt.Fprintf(w, "%s\t%s\t-\t-\t%s\t%d\t%s\t%s\n", endpoint.Route, state, build, endpoint.InFlight, restarts, exits)
+			continue
+		}
+		for _, replica := range endpoint.Replicas {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%v\t%s\t%d\t%s\t%s\n",
+				endpoint.Route, state, replica.Pid, roundDuration(replica.Uptime), build, replica.InFlight, restarts, exits)
+		}
+	}
+	w.Flush()
+}
+
+// ShowRoutes prints the route table of the running master:
+//
+//	brute routes [-json]
+func ShowRoutes(args ...string) error {
+	flags := flag.NewFlagSet("routes", flag.ContinueOnError)
+	asJson := flags.Bool("json", false, "print the routes as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	reply, err := requestMaster(ServiceMessage{Command: "routes"})
+	if err != nil {
+		return err
+	}
+
+	if *asJson {
+		return printJson(os.Stdout, reply.Routes)
+	}
+	printRoutes(os.Stdout, reply.Routes)
+	return nil
+}
+
+func printRoutes(out io.Writer, routes []brute.RouteEntry) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PATH\tENDPOINT\tAUTHORIZER\tPROTECTED\tTIMEOUT\tREPLICAS")
+	for _, route := range routes {
+		authorizer := route.Authorizer
+		if authorizer == "" {
+			authorizer = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%v\t%v\t%d\n",
+			route.Path, route.Route, authorizer, route.Protected, route.Timeout, route.Replicas)
+	}
+	w.Flush()
+
+	var conflicts []string
+	for _, route := range routes {
+		if len(route.Conflicts) > 0 {
+			conflicts = append(conflicts, fmt.Sprintf("  %s (%s) conflicts with %s", route.Path, route.Route, strings.Join(route.Conflicts, ", ")))
+		}
+	}
+	if len(conflicts) > 0 {
+		fmt.Fprintf(out, "\nConflicting path patterns, served by the route listed first:\n%s\n", strings.Join(conflicts, "\n"))
+	}
+}
+
+func printJson(out io.Writer, v interface{}) error {
+	e := json.NewEncoder(out)
+	e.SetIndent("", "  ")
+	return e.Encode(v)
+}
+
+func shortHash(hash string) string {
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+	return hash
+}
+
+func roundDuration(d time.Duration) time.Duration {
+	return d - d%time.Second
+}
@@ -18,6 +18,8 @@ const EmptyController = `package main
 
 import (
     "fmt"
+
+    "github.com/rrborja/brute/client"
 )
 
 // Handler is the main logic of your endpoint
@@ -27,6 +29,8 @@ func Handler(args map[string]string) {
 
 // WARNING: Do not modify beyond this line
 func main() {
+    // Serve other HTTP methods with client.On, e.g.
+    // client.On(http.MethodPost, Create)
     client.Run(Handler)
 }
 
@@ -0,0 +1,74 @@
+package brute
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/rrborja/brute/protocol"
+	. "github.com/rrborja/brute/log"
+)
+
+// Multiplexed tells whether the endpoint's data plane runs over its own
+// connection instead of the RPC server.
+func (connWriter *ConnWrite) Multiplexed() bool {
+	return connWriter.Welcome != nil && connWriter.Welcome.Supports(protocol.CapabilityMultiplex)
+}
+
+// Dispatch hands a session to the endpoint. Multiplexed endpoints receive
+// the request along with it, the others fetch it with AcceptRpc.
+func (connWriter *ConnWrite) Dispatch(sid [32]byte, context *ContextHolder) error {
+	if !connWriter.Multiplexed() {
+		return protocol.WriteFrame(connWriter, protocol.FrameSession, sid[:])
+	}
+
+	var request RpcRequest
+	context.fill(&request)
+
+	data, err := json.Marshal(&request)
+	if err != nil {
+		return err
+	}
+
+	return protocol.WriteFrame(connWriter, protocol.FrameDispatch, protocol.SessionPayload(sid, data))
+}
+
+// serveDataPlane reads the Data and Close frames of a multiplexed endpoint
+// until its connection closes. The credit of every Data frame is returned
+// once Delegate has written it to the HTTP client.
+func serveDataPlane(routeDirectory string, connWriter *ConnWrite) {
+	for {
+		frame, err := protocol.ReadFrame(connWriter.Conn)
+		if err != nil {
+			Log(fmt.Sprintf("Data plane of endpoint %s closed: %v", routeDirectory, err))
+			return
+		}
+
+		var ack bool
+		switch frame.Type {
+		case protocol.FrameData:
+			sid, code, body, err := protocol.ParseData(frame.Payload)
+			if err != nil {
+				continue
+			}
+
+			credit := len(body) + protocol.DataFrameCost
+			packet := &EchoPacket{SessionId: sid, Body: body, Code: code}
+			packet.delivered = func() {
+				protocol.WriteFrame(connWriter, protocol.FrameWindowUpdate, protocol.WindowPayload(sid, credit))
+			}
+
+			if err := requestSession.Write(packet, &ack); err != nil {
+				// Nobody reads the session anymore, the endpoint still needs
+				// its credit back to finish writing
+				packet.delivered()
+			}
+		case protocol.FrameClose:
+			sid, _, err := protocol.SplitSession(frame.Payload)
+			if err != nil {
+				continue
+			}
+
+			requestSession.Close(&EchoPacket{SessionId: sid}, &ack)
+		}
+	}
+}
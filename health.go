@@ -0,0 +1,241 @@
+package brute
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RouteState is where an endpoint stands between its build and serving.
+type RouteState string
+
+const (
+	// StateBuilding is an endpoint being compiled.
+	StateBuilding RouteState = "building"
+	// StateStarting is an endpoint built whose processes did not connect yet.
+	StateStarting RouteState = "starting"
+	// StateConnected is an endpoint with at least one replica connected.
+	StateConnected RouteState = "connected"
+	// StateBroken is an endpoint that failed to compile, serving the
+	// compile error page until the code is fixed.
+	StateBroken RouteState = "broken"
+	// StateCrashed is an endpoint whose processes all exited.
+	StateCrashed RouteState = "crashed"
+)
+
+// Reserved paths of the main listener serving the health of the master
+// when no admin listener is configured.
+const (
+	LivenessPath  = "/_brute/healthz"
+	ReadinessPath = "/_brute/readyz"
+)
+
+type routeHealth struct {
+	state      RouteState
+	detail     string
+	since      time.Time
+	generation uint64
+	required   bool
+	// build is the hash of the binary last built for the route.
+	build string
+}
+
+var (
+	routeHealths      = make(map[string]*routeHealth)
+	routeHealthsMutex sync.Mutex
+)
+
+func healthOf(directory string) *routeHealth {
+	health, ok := routeHealths[directory]
+	if !ok {
+		health = &routeHealth{state: StateStarting, since: time.Now()}
+		routeHealths[directory] = health
+	}
+	return health
+}
+
+func setRouteState(directory string, state RouteState, detail string) {
+	routeHealthsMutex.Lock()
+	defer routeHealthsMutex.Unlock()
+
+	health := healthOf(directory)
+	if health.state != state {
+		health.since = time.Now()
+	}
+	health.state = state
+	health.detail = detail
+}
+
+// RouteStateOf returns the state of a route, as reported by readiness.
+func RouteStateOf(directory string) RouteState {
+	if status, ok := CheckReadiness().Routes[directory]; ok {
+		return status.State
+	}
+	return StateCrashed
+}
+
+// buildFailure describes a failed build by the first line of the compiler
+// output, or by err if the compiler said nothing.
+func buildFailure(output []byte, err error) string {
+	if line := strings.TrimSpace(strings.SplitN(strings.TrimSpace(string(output)), "\n", 2)[0]); line != "" {
+		return line
+	}
+	return err.Error()
+}
+
+// forgetRoute drops a removed route from the readiness report.
+func forgetRoute(directory string) {
+	routeHealthsMutex.Lock()
+	defer routeHealthsMutex.Unlock()
+
+	delete(routeHealths, directory)
+}
+
+// requireRoutes marks the routes readiness waits for.
+func requireRoutes(directories ...string) {
+	routeHealthsMutex.Lock()
+	defer routeHealthsMutex.Unlock()
+
+	for _, directory := range directories {
+		healthOf(directory).required = true
+	}
+}
+
+// startingRoute marks a new generation of the processes of a route as
+// starting and returns it, so that the exit of older processes does not
+// count as a crash.
+func startingRoute(directory string) uint64 {
+	routeHealthsMutex.Lock()
+	defer routeHealthsMutex.Unlock()
+
+	health := healthOf(directory)
+	health.generation++
+	if health.state == StateBroken {
+		// The compile error page keeps being served
+		return health.generation
+	}
+	if health.state != StateStarting {
+		health.since = time.Now()
+	}
+	health.state = StateStarting
+	health.detail = ""
+	return health.generation
+}
+
+func routeGeneration(directory string) uint64 {
+	routeHealthsMutex.Lock()
+	defer routeHealthsMutex.Unlock()
+
+	return healthOf(directory).generation
+}
+
+// routeExited records the exit of a process of the given generation.
+func routeExited(directory string, generation uint64, err error) {
+	if ShuttingDown() {
+		return
+	}
+
+	// The replicas of a removed route exit after it is forgotten
+	if _, removed := removedEndpoints.Load(directory); removed {
+		return
+	}
+
+	routeHealthsMutex.Lock()
+	defer routeHealthsMutex.Unlock()
+
+	health, ok := routeHealths[directory]
+	if !ok || health.generation != generation || health.state == StateBuilding || health.state == StateBroken {
+		return
+	}
+	endpointExits.Inc(directory)
+
+	detail := "exited"
+	if err != nil {
+		detail = err.Error()
+	}
+	if health.state != StateCrashed {
+		health.since = time.Now()
+	}
+	health.state = StateCrashed
+	health.detail = detail
+}
+
+// RouteStatus is the health of a route in the readiness report.
+type RouteStatus struct {
+	State    RouteState `json:"state"`
+	Detail   string     `json:"detail,omitempty"`
+	Since    time.Time  `json:"since"`
+	Replicas int        `json:"replicas"`
+	Required bool       `json:"required"`
+}
+
+// Readiness is the report served on the readiness endpoint.
+type Readiness struct {
+	Ready  bool                   `json:"ready"`
+	Routes map[string]RouteStatus `json:"routes"`
+}
+
+// CheckReadiness reports the state of every route. The master is ready
+// once every required route, those of .brute.yml and the authorizer, is
+// connected.
+func CheckReadiness() Readiness {
+	routeHealthsMutex.Lock()
+	report := Readiness{Ready: !ShuttingDown(), Routes: make(map[string]RouteStatus, len(routeHealths))}
+	for directory, health := range routeHealths {
+		report.Routes[directory] = RouteStatus{
+			State:    health.state,
+			Detail:   health.detail,
+			Since:    health.since,
+			Required: health.required,
+		}
+	}
+	routeHealthsMutex.Unlock()
+
+	for directory, status := range report.Routes {
+		if val, ok := endpoints.Map.Load(directory); ok {
+			if set, ok := val.(*ReplicaSet); ok {
+				status.Replicas = set.Len()
+				if status.Replicas > 0 {
+					// Replicas of the previous build serve while the
+					// endpoint is rebuilt
+					if status.State == StateBuilding {
+						status.Detail = "rebuilding"
+					} else {
+						status.Detail = ""
+					}
+					status.State = StateConnected
+				}
+			}
+		}
+		if status.Required && status.State != StateConnected {
+			report.Ready = false
+		}
+		report.Routes[directory] = status
+	}
+
+	return report
+}
+
+func livenessHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if ShuttingDown() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "shutting down")
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func readinessHandler(w http.ResponseWriter, r *http.Request) {
+	report := CheckReadiness()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !report.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
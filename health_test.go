@@ -0,0 +1,99 @@
+package brute
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func resetRouteHealths() {
+	routeHealthsMutex.Lock()
+	routeHealths = make(map[string]*routeHealth)
+	routeHealthsMutex.Unlock()
+}
+
+func readiness(t *testing.T) (int, Readiness) {
+	w := httptest.NewRecorder()
+	adminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+
+	var report Readiness
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	return w.Code, report
+}
+
+func TestReadinessWaitsForRequiredRoutes(t *testing.T) {
+	resetRouteHealths()
+	defer resetRouteHealths()
+	defer endpoints.Delete("health-home")
+
+	requireRoutes("health-home")
+	setRouteState("health-home", StateBuilding, "")
+	setRouteState("health-optional", StateBroken, "undefined: x")
+
+	code, report := readiness(t)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.False(t, report.Ready)
+	assert.Equal(t, StateBuilding, report.Routes["health-home"].State)
+	assert.Equal(t, "undefined: x", report.Routes["health-optional"].Detail)
+
+	set := newReplicaSet(Route{Directory: "health-home"})
+	set.Add(newTestReplica())
+	endpoints.Store("health-home", set)
+	startingRoute("health-home")
+
+	code, report = readiness(t)
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, report.Ready)
+	assert.Equal(t, StateConnected, report.Routes["health-home"].State)
+	assert.Equal(t, 1, report.Routes["health-home"].Replicas)
+	assert.Equal(t, StateBroken, report.Routes["health-optional"].State)
+}
+
+func TestOnlyTheLatestProcessesCrash(t *testing.T) {
+	resetRouteHealths()
+	defer resetRouteHealths()
+
+	old := startingRoute("health-home")
+	current := startingRoute("health-home")
+
+	routeExited("health-home", old, errors.New("signal: killed"))
+	assert.Equal(t, StateStarting, RouteStateOf("health-home"))
+
+	routeExited("health-home", current, errors.New("exit status 2"))
+	assert.Equal(t, StateCrashed, RouteStateOf("health-home"))
+
+	setRouteState("health-home", StateBroken, "")
+	startingRoute("health-home")
+	assert.Equal(t, StateBroken, RouteStateOf("health-home"))
+}
+
+func TestRemovedRoutesStayForgotten(t *testing.T) {
+	resetRouteHealths()
+	defer resetRouteHealths()
+
+	set := newReplicaSet(Route{Directory: "health-removed"})
+	endpoints.Store("health-removed", set)
+	generation := startingRoute("health-removed")
+
+	assert.NoError(t, RemoveEndpoint("health-removed"))
+	defer removedEndpoints.Delete("health-removed")
+
+	// Its replicas exit once told to shut down
+	routeExited("health-removed", generation, errors.New("exit status 0"))
+
+	_, report := readiness(t)
+	_, ok := report.Routes["health-removed"]
+	assert.False(t, ok)
+}
+
+func TestLiveness(t *testing.T) {
+	w := httptest.NewRecorder()
+	adminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "ok\n", w.Body.String())
+}
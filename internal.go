@@ -0,0 +1,66 @@
+package brute
+
+import (
+	"path/filepath"
+
+	"github.com/rrborja/brute/protocol"
+)
+
+// InternalConfig is the internal section of .brute.yml, holding the
+// addresses of the services the master runs for its endpoints and for the
+// brute command. They default to Unix sockets in bin/, so several projects
+// can run side by side:
+//
+//	internal:
+//	  endpoints: tcp4://127.0.0.1:11000
+//	  rpc: tcp4://127.0.0.1:12000
+//	  control: unix://bin/control.sock
+type InternalConfig struct {
+	Endpoints string `yaml:"endpoints"`
+	Rpc       string `yaml:"rpc"`
+	Control   string `yaml:"control"`
+}
+
+var (
+	defaultEndpointService = "unix://" + filepath.Join("bin", "endpoints.sock")
+	defaultRpcService      = "unix://" + filepath.Join("bin", "rpc.sock")
+	defaultControlService  = "unix://" + filepath.Join("bin", "control.sock")
+)
+
+// internalServices are the addresses in use, set by New.
+var internalServices = (*Config)(nil).internal()
+
+func (config *Config) internal() *InternalConfig {
+	services := &InternalConfig{defaultEndpointService, defaultRpcService, defaultControlService}
+	if config == nil || config.Internal == nil {
+		return services
+	}
+
+	if config.Internal.Endpoints != "" {
+		services.Endpoints = config.Internal.Endpoints
+	}
+	if config.Internal.Rpc != "" {
+		services.Rpc = config.Internal.Rpc
+	}
+	if config.Internal.Control != "" {
+		services.Control = config.Internal.Control
+	}
+	return services
+}
+
+// ControlAddress is where the control service of the project described by
+// config listens, for the master and the brute command alike.
+func ControlAddress(config *Config) string {
+	return config.internal().Control
+}
+
+// endpointAddress is address as given to the endpoints, which may run from
+// another directory: a relative Unix socket is resolved against the
+// project directory.
+func endpointAddress(address string) string {
+	network, path := protocol.ParseAddress(address)
+	if network != "unix" || filepath.IsAbs(path) {
+		return address
+	}
+	return "unix://" + filepath.Join(cwd, path)
+}
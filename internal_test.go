@@ -0,0 +1,28 @@
+package brute
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInternalServicesDefaultToSockets(t *testing.T) {
+	services := (&Config{}).internal()
+	assert.Equal(t, "unix://bin/endpoints.sock", services.Endpoints)
+	assert.Equal(t, "unix://bin/rpc.sock", services.Rpc)
+	assert.Equal(t, "unix://bin/control.sock", ControlAddress(nil))
+
+	services = (&Config{Internal: &InternalConfig{Rpc: "tcp4://127.0.0.1:12001"}}).internal()
+	assert.Equal(t, "unix://bin/endpoints.sock", services.Endpoints)
+	assert.Equal(t, "tcp4://127.0.0.1:12001", services.Rpc)
+}
+
+func TestEndpointsAreGivenAbsoluteSockets(t *testing.T) {
+	previous := cwd
+	cwd = "/srv/shop"
+	defer func() { cwd = previous }()
+
+	assert.Equal(t, "unix:///srv/shop/bin/endpoints.sock", endpointAddress(defaultEndpointService))
+	assert.Equal(t, "unix:///run/brute/rpc.sock", endpointAddress("unix:///run/brute/rpc.sock"))
+	assert.Equal(t, "tcp4://127.0.0.1:12000", endpointAddress("tcp4://127.0.0.1:12000"))
+}
@@ -0,0 +1,125 @@
+package brute
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	queueFullError    = errors.New("the request queue of the endpoint is full")
+	queueTimeoutError = errors.New("waited too long in the request queue of the endpoint")
+	clientGoneError   = errors.New("the client went away while queued")
+)
+
+// limiters holds the Limiter of every route with a MaxInFlight, keyed by
+// route directory.
+var limiters sync.Map
+
+// Limiter bounds the requests an endpoint serves at once. Requests over
+// the limit wait in a queue of bounded length for at most the queue wait.
+type Limiter struct {
+	slots       chan struct{}
+	queueLength int64
+	queueWait   time.Duration
+
+	queued   int64
+	rejected uint64
+	timedOut uint64
+}
+
+// LimiterStats is a snapshot of a Limiter for metrics.
+type LimiterStats struct {
+	InFlight int
+	Queued   int
+	Rejected uint64
+	TimedOut uint64
+}
+
+// limiterFor returns the Limiter of route, or nil if its requests are not
+// limited.
+func limiterFor(route Route) *Limiter {
+	if route.RouteConfig == nil || route.MaxInFlight <= 0 {
+		return nil
+	}
+
+	if limiter, ok := limiters.Load(route.Directory); ok {
+		return limiter.(*Limiter)
+	}
+
+	queueWait := route.timeout()
+	if route.QueueWait != "" {
+		if wait, err := time.ParseDuration(route.QueueWait); err == nil && wait > 0 {
+			queueWait = wait
+		}
+	}
+
+	limiter, _ := limiters.LoadOrStore(route.Directory, &Limiter{
+		slots:       make(chan struct{}, route.MaxInFlight),
+		queueLength: int64(route.QueueLength),
+		queueWait:   queueWait,
+	})
+	return limiter.(*Limiter)
+}
+
+// Acquire takes an in-flight slot, queueing if there is none free. The
+// slot must be given back with Release.
+func (limiter *Limiter) Acquire(cancel <-chan struct{}) error {
+	select {
+	case limiter.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if atomic.AddInt64(&limiter.queued, 1) > limiter.queueLength {
+		atomic.AddInt64(&limiter.queued, -1)
+		atomic.AddUint64(&limiter.rejected, 1)
+		return queueFullError
+	}
+	defer atomic.AddInt64(&limiter.queued, -1)
+
+	timer := time.NewTimer(limiter.queueWait)
+	defer timer.Stop()
+
+	select {
+	case limiter.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		atomic.AddUint64(&limiter.timedOut, 1)
+		return queueTimeoutError
+	case <-cancel:
+		return clientGoneError
+	}
+}
+
+func (limiter *Limiter) Release() {
+	<-limiter.slots
+}
+
+// RetryAfter is the number of seconds a shed client is told to wait.
+func (limiter *Limiter) RetryAfter() string {
+	return strconv.Itoa(int(math.Max(1, math.Ceil(limiter.queueWait.Seconds()))))
+}
+
+func (limiter *Limiter) Stats() LimiterStats {
+	return LimiterStats{
+		InFlight: len(limiter.slots),
+		Queued:   int(atomic.LoadInt64(&limiter.queued)),
+		Rejected: atomic.LoadUint64(&limiter.rejected),
+		TimedOut: atomic.LoadUint64(&limiter.timedOut),
+	}
+}
+
+// RouteStats returns the limiter statistics of every limited route, keyed
+// by route directory.
+func RouteStats() map[string]LimiterStats {
+	stats := make(map[string]LimiterStats)
+	limiters.Range(func(directory, limiter interface{}) bool {
+		stats[directory.(string)] = limiter.(*Limiter).Stats()
+		return true
+	})
+	return stats
+}
@@ -0,0 +1,59 @@
+package brute
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiterQueuesAndSheds(t *testing.T) {
+	route := Route{Directory: "limited", RouteConfig: &RouteConfig{MaxInFlight: 1, QueueLength: 1, QueueWait: "50ms"}}
+	limiter := limiterFor(route)
+	defer limiters.Delete(route.Directory)
+
+	assert.NoError(t, limiter.Acquire(nil))
+
+	queued := make(chan error)
+	go func() { queued <- limiter.Acquire(nil) }()
+
+	for limiter.Stats().Queued == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, queueFullError, limiter.Acquire(nil))
+
+	limiter.Release()
+	assert.NoError(t, <-queued)
+	assert.Equal(t, LimiterStats{InFlight: 1, Rejected: 1}, limiter.Stats())
+
+	assert.Equal(t, queueTimeoutError, limiter.Acquire(nil))
+	assert.Equal(t, "1", limiter.RetryAfter())
+	assert.Equal(t, uint64(1), RouteStats()[route.Directory].TimedOut)
+}
+
+func TestUnlimitedRoute(t *testing.T) {
+	assert.Nil(t, limiterFor(Route{Directory: "home"}))
+	assert.Nil(t, limiterFor(Route{Directory: "home", RouteConfig: &RouteConfig{Timeout: "1s"}}))
+}
+
+type failingBody struct{}
+
+func (failingBody) Read([]byte) (int, error) { return 0, errors.New("connection reset") }
+
+func TestRequestBodiesAreReadWhole(t *testing.T) {
+	controller := &ControllerEndpoint{Route: Route{Directory: "upload"}}
+	endpoints.Store("upload", newReplicaSet(controller.Route))
+	defer endpoints.Delete("upload")
+
+	w := httptest.NewRecorder()
+	controller.ServeHTTP(w, httptest.NewRequest("POST", "/upload", bytes.NewReader(make([]byte, maxRequestBody+1))))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	w = httptest.NewRecorder()
+	controller.ServeHTTP(w, httptest.NewRequest("POST", "/upload", failingBody{}))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
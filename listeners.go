@@ -0,0 +1,298 @@
+package brute
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rrborja/brute/protocol"
+	. "github.com/rrborja/brute/log"
+)
+
+// ServerConfig is the server section of .brute.yml.
+//
+// Addresses are host:port pairs, listening on both IPv4 and IPv6 when the
+// host is empty. They may be prefixed with tcp4://, tcp6:// or unix://, the
+// latter taking a socket path relative to the project:
+//
+//	server:
+//	  listen: ["tcp4://127.0.0.1:8443", "[::1]:8443", "unix://bin/brute.sock"]
+//	  redirect: [":8080"]
+//	  cert: /etc/brute/cert.pem
+//	  key: /etc/brute/key.pem
+//
+// In dev mode the listen addresses serve plain HTTP and nothing redirects.
+type ServerConfig struct {
+	Listen   []string `yaml:"listen"`
+	Redirect []string `yaml:"redirect"`
+	Cert     string   `yaml:"cert"`
+	Key      string   `yaml:"key"`
+	Dev      bool     `yaml:"dev"`
+}
+
+const (
+	legacyCertFile = "cert.pem"
+	legacyKeyFile  = "tls.key"
+)
+
+var (
+	devCertFile = filepath.Join("bin", "dev-cert.pem")
+	devKeyFile  = filepath.Join("bin", "dev-key.pem")
+)
+
+func (config *Config) server() *ServerConfig {
+	if config == nil || config.Server == nil {
+		return &ServerConfig{}
+	}
+	return config.Server
+}
+
+func (server *ServerConfig) listenAddresses() []string {
+	if len(server.Listen) > 0 {
+		return server.Listen
+	}
+	if server.Dev {
+		return []string{":" + strconv.Itoa(httpPort)}
+	}
+	return []string{":" + strconv.Itoa(httpsPort)}
+}
+
+func (server *ServerConfig) redirectAddresses() []string {
+	if server.Dev {
+		return nil
+	}
+	if len(server.Redirect) > 0 {
+		return server.Redirect
+	}
+	return []string{":" + strconv.Itoa(httpPort)}
+}
+
+// certificate returns the certificate and key files to serve HTTPS with:
+// the configured ones, else cert.pem and tls.key if the project has them,
+// else a self-signed development certificate generated in bin/.
+func (server *ServerConfig) certificate() (certFile, keyFile string, err error) {
+	switch {
+	case server.Cert != "" && server.Key != "":
+		return server.Cert, server.Key, nil
+	case server.Cert != "":
+		return "", "", errors.New("server: cert is set but key is missing")
+	case server.Key != "":
+		return "", "", errors.New("server: key is set but cert is missing")
+	}
+
+	if fileExists(legacyCertFile) && fileExists(legacyKeyFile) {
+		return legacyCertFile, legacyKeyFile, nil
+	}
+
+	if !validCertificate(devCertFile, devKeyFile) {
+		Log(fmt.Sprintf("No certificate configured. Generating a self-signed development certificate in %s", devCertFile))
+		if err := generateDevCertificate(devCertFile, devKeyFile); err != nil {
+			return "", "", err
+		}
+	}
+	return devCertFile, devKeyFile, nil
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+func validCertificate(certFile, keyFile string) bool {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	return err == nil && time.Now().Before(cert.NotAfter)
+}
+
+func generateDevCertificate(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"brute.io development"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(certFile), 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+}
+
+// Listen listens on an address in the form protocol.ParseAddress reads.
+func Listen(address string) (net.Listener, error) {
+	network, addr := protocol.ParseAddress(address)
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	case "unix":
+		// A socket left behind by a previous run would fail the bind, but
+		// one a running master still accepts on is not ours to take over
+		if info, err := os.Stat(addr); err == nil && info.Mode()&os.ModeSocket != 0 {
+			conn, err := net.DialTimeout(network, addr, time.Second)
+			if err == nil {
+				conn.Close()
+				return nil, fmt.Errorf("listen address %s is in use by a running master", address)
+			}
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				os.Remove(addr)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported network %s in listen address %s", network, address)
+	}
+	return net.Listen(network, addr)
+}
+
+// redirectHandler sends plain HTTP requests to the HTTPS port.
+func redirectHandler(securePort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		target := "https://" + host
+		if securePort != "443" {
+			target += ":" + securePort
+		}
+		target += req.URL.Path
+		if len(req.URL.RawQuery) > 0 {
+			target += "?" + req.URL.RawQuery
+		}
+		w.Header().Set("server", "brute.io")
+		w.Header().Add("X-comment", "You must use HTTPS next time.")
+		http.Redirect(w, req, target,
+			http.StatusTemporaryRedirect)
+	})
+}
+
+// securePort is the port HTTP requests are redirected to: that of the first
+// TCP listen address.
+func securePort(addresses []string) string {
+	for _, address := range addresses {
+		network, addr := protocol.ParseAddress(address)
+		if network == "unix" {
+			continue
+		}
+		if _, port, err := net.SplitHostPort(addr); err == nil {
+			return port
+		}
+	}
+	return strconv.Itoa(httpsPort)
+}
+
+// listenAndServe serves handler on the listen addresses of config, and
+// the HTTPS redirect on the redirect ones. It returns when a server stops,
+// after Shutdown completes if that is why.
+func listenAndServe(config *Config, handler http.Handler) {
+	server := config.server()
+
+	var certFile, keyFile string
+	if !server.Dev {
+		var err error
+		if certFile, keyFile, err = server.certificate(); err != nil {
+			LogError(ErrorLog{err, fmt.Sprintf("Could not set up the TLS certificate: %v", err)})
+			CloseLogger()
+			os.Exit(1)
+		}
+	}
+
+	stopped := make(chan error, 1)
+	start := func(srv *http.Server, address string, tls bool) {
+		l, err := Listen(address)
+		if err != nil {
+			LogError(ErrorLog{err, fmt.Sprintf("Can't listen on %s: %v", address, err)})
+			CloseLogger()
+			os.Exit(1)
+		}
+
+		scheme := "http"
+		if tls {
+			scheme = "https"
+		}
+		Log(fmt.Sprintf("Serving %s on %s", scheme, address))
+
+		go func() {
+			if tls {
+				err = srv.ServeTLS(l, certFile, keyFile)
+			} else {
+				err = srv.Serve(l)
+			}
+			if err != http.ErrServerClosed {
+				LogError(ErrorLog{err, fmt.Sprintf("Server on %s stopped: %v", address, err)})
+			}
+			select {
+			case stopped <- err:
+			default:
+			}
+		}()
+	}
+
+	if redirects := server.redirectAddresses(); len(redirects) > 0 {
+		srv := &http.Server{Handler: redirectHandler(securePort(server.listenAddresses()))}
+		srv.SetKeepAlivesEnabled(true)
+		trackServer(srv)
+
+		for _, address := range redirects {
+			start(srv, address, false)
+		}
+	}
+
+	secureSrv := &http.Server{Handler: handler}
+	secureSrv.SetKeepAlivesEnabled(true)
+	trackServer(secureSrv)
+
+	for _, address := range server.listenAddresses() {
+		start(secureSrv, address, !server.Dev)
+	}
+
+	awaitShutdown(<-stopped)
+}
@@ -0,0 +1,98 @@
+package brute
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rrborja/brute/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAddress(t *testing.T) {
+	for address, expected := range map[string][2]string{
+		":8443":                 {"tcp", ":8443"},
+		"tcp4://127.0.0.1:8443": {"tcp4", "127.0.0.1:8443"},
+		"tcp6://[::1]:8443":     {"tcp6", "[::1]:8443"},
+		"unix://bin/brute.sock": {"unix", "bin/brute.sock"},
+	} {
+		network, addr := protocol.ParseAddress(address)
+		assert.Equal(t, expected, [2]string{network, addr})
+	}
+}
+
+func TestListenOnUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "brute")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	address := "unix://" + filepath.Join(dir, "brute.sock")
+	for i := 0; i < 2; i++ {
+		l, err := Listen(address)
+		if assert.NoError(t, err) {
+			// Closing a unix listener removes its socket; leave it behind
+			// like a crashed master would
+			l.(interface{ SetUnlinkOnClose(bool) }).SetUnlinkOnClose(false)
+			l.Close()
+		}
+	}
+
+	// A socket some master still accepts on is left alone
+	l, err := Listen(address)
+	if assert.NoError(t, err) {
+		defer l.Close()
+		_, err = Listen(address)
+		assert.Error(t, err)
+	}
+
+	_, err = Listen("udp://:53")
+	assert.Error(t, err)
+}
+
+func TestDevCertificateIsGenerated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "brute")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	certFile, keyFile, err := (&ServerConfig{}).certificate()
+	assert.NoError(t, err)
+	assert.Equal(t, devCertFile, certFile)
+	assert.True(t, validCertificate(certFile, keyFile))
+
+	configured := &ServerConfig{Cert: "site.pem", Key: "site.key"}
+	certFile, keyFile, err = configured.certificate()
+	assert.NoError(t, err)
+	assert.Equal(t, "site.pem", certFile)
+	assert.Equal(t, "site.key", keyFile)
+
+	_, _, err = (&ServerConfig{Cert: "site.pem"}).certificate()
+	assert.EqualError(t, err, "server: cert is set but key is missing")
+	_, _, err = (&ServerConfig{Key: "site.key"}).certificate()
+	assert.EqualError(t, err, "server: key is set but cert is missing")
+}
+
+func TestDevModeServesPlainHTTP(t *testing.T) {
+	dev := &ServerConfig{Dev: true}
+	assert.Empty(t, dev.redirectAddresses())
+	assert.Equal(t, []string{":8080"}, dev.listenAddresses())
+
+	production := (*Config)(nil).server()
+	assert.Equal(t, []string{":8080"}, production.redirectAddresses())
+	assert.Equal(t, []string{":8443"}, production.listenAddresses())
+}
+
+func TestRedirectKeepsHost(t *testing.T) {
+	w := httptest.NewRecorder()
+	redirectHandler("8443").ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com:8080/home?id=7", nil))
+
+	assert.Equal(t, http.StatusTemporaryRedirect, w.Code)
+	assert.Equal(t, "https://example.com:8443/home?id=7", w.Header().Get("Location"))
+	assert.Equal(t, "8443", securePort([]string{"unix://bin/brute.sock", "[::]:8443"}))
+}
@@ -0,0 +1,129 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Entry is a single log record.
+type Entry struct {
+	Time    time.Time
+	Level   Level
+	Message string
+	// Fields alternate keys and values.
+	Fields []interface{}
+
+	// raw is written as is by text encoders, e.g. the blank lines of
+	// NewLines, and skipped by the others
+	raw string
+
+	// swap, when set, is not an entry to log but the sinks to write the
+	// following entries to, see SetSinks
+	swap *sinkSwap
+}
+
+// Encoder turns an entry into the bytes a sink writes.
+type Encoder interface {
+	Encode(entry *Entry) []byte
+}
+
+const timeFormat = "2006-01-02 15:04:05.000"
+
+// TextEncoder writes one human readable line per entry:
+//
+//	2018-04-02 15:04:05.000 INFO  Starting endpoint home pid=4242
+type TextEncoder struct{}
+
+func (TextEncoder) Encode(entry *Entry) []byte {
+	if entry.raw != "" {
+		return []byte(entry.raw)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(entry.Time.Format(timeFormat))
+	buf.WriteByte(' ')
+	fmt.Fprintf(&buf, "%-5s ", entry.Level)
+	buf.WriteString(entry.Message)
+
+	eachField(entry.Fields, func(key string, value interface{}) {
+		buf.WriteByte(' ')
+		buf.WriteString(key)
+		buf.WriteByte('=')
+		text := fmt.Sprint(format(value))
+		if text == "" || strings.ContainsAny(text, " \t\n\"=") {
+			text = strconv.Quote(text)
+		}
+		buf.WriteString(text)
+	})
+
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// JSONEncoder writes one JSON object per line with the time, level and
+// message under "time", "level" and "msg", followed by the fields.
+type JSONEncoder struct{}
+
+func (JSONEncoder) Encode(entry *Entry) []byte {
+	if entry.raw != "" {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(`{"time":`)
+	writeJSON(&buf, entry.Time.Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSON(&buf, entry.Level.String())
+	buf.WriteString(`,"msg":`)
+	writeJSON(&buf, entry.Message)
+
+	eachField(entry.Fields, func(key string, value interface{}) {
+		buf.WriteByte(',')
+		writeJSON(&buf, key)
+		buf.WriteByte(':')
+		writeJSON(&buf, format(value))
+	})
+
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+func writeJSON(buf *bytes.Buffer, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf.Write(data)
+}
+
+// format turns values that encode poorly, such as errors, into strings.
+func format(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		if v == nil {
+			return nil
+		}
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return value
+}
+
+// eachField calls fn for every key and value of fields. A key without a
+// value, or a key that is not a string, is reported under "!BADKEY".
+func eachField(fields []interface{}, fn func(key string, value interface{})) {
+	for i := 0; i < len(fields); i += 2 {
+		key, ok := fields[i].(string)
+		if !ok || i+1 == len(fields) {
+			fn("!BADKEY", fields[i])
+			i--
+			continue
+		}
+		fn(key, fields[i+1])
+	}
+}
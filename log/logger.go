@@ -1,75 +1,270 @@
+// Package log is the leveled, structured logger of brute. Entries carry a
+// message and key/value fields:
+//
+//	Info("Starting endpoint", "route", "home", "pid", 4242)
+//
+// Logging never blocks: entries go through a buffered queue to a single
+// writer that encodes them to every sink. When the queue is full entries
+// are dropped and counted. CloseLogger flushes what is queued.
 package log
 
 import (
-	"sync"
+	"fmt"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var lock sync.Mutex
-
-var _Log chan string
+// LevelEnv overrides the configured level, e.g. BRUTE_LOG_LEVEL=debug.
+const LevelEnv = "BRUTE_LOG_LEVEL"
 
-var _LogError chan ErrorLog
-
-var _NewLines chan int
+// queueSize is how many entries may wait for the writer.
+const queueSize = 4096
 
 type ErrorLog struct {
 	Error error
 	String string
 }
 
-func CloseLogger() {
-	close(_Log)
-	close(_LogError)
-	close(_NewLines)
+// Options configure the logger, see Configure.
+type Options struct {
+	// Level is the name of the lowest level logged, info by default.
+	Level string
+	// Format is text or json.
+	Format string
+	// File, when set, receives the entries too, rotated once it grows past
+	// MaxSize bytes, keeping MaxBackups old files.
+	File       string
+	MaxSize    int64
+	MaxBackups int
+}
+
+type logger struct {
+	level   int32
+	dropped uint64
+
+	queue   chan *Entry
+	flushed chan struct{}
+	closed  bool
+	mutex   sync.RWMutex
+
+	sinks      []Sink
+	sinksMutex sync.Mutex
 }
 
+var std = newLogger(Stderr(TextEncoder{}))
+
 func init() {
-	_Log = make(chan string)
-	_LogError = make(chan ErrorLog)
-	_NewLines = make(chan int)
-
-	go newLines(_NewLines)
-	go _log(_Log)
-	go logError(_LogError)
-}
-
-func newLines(countChan <- chan int) {
-	for count := range countChan {
-		func(count int) {
-			lock.Lock()
-			defer lock.Unlock()
-			print(strings.Repeat("\n", count))
-		}(count)
+	if level, err := ParseLevel(os.Getenv(LevelEnv)); err == nil {
+		SetLevel(level)
 	}
 }
 
-func _log(messageChan <- chan string) {
-	for message := range messageChan {
-		func(message string) {
+func newLogger(sinks ...Sink) *logger {
+	l := &logger{queue: make(chan *Entry, queueSize), flushed: make(chan struct{}), sinks: sinks}
+	go l.run()
+	return l
+}
+
+func (l *logger) run() {
+	defer close(l.flushed)
 
-			lock.Lock()
-			defer lock.Unlock()
-			println("[LOG] " + message)
+	for entry := range l.queue {
+		if entry.swap != nil {
+			l.swap(entry.swap.sinks)
+			close(entry.swap.done)
+			continue
+		}
+		l.write(entry)
 
-		}(message)
+		if dropped := atomic.SwapUint64(&l.dropped, 0); dropped > 0 {
+			l.write(&Entry{Time: time.Now(), Level: LevelWarn, Message: "Log queue overflowed", Fields: []interface{}{"dropped", dropped}})
+		}
 	}
 }
 
-func logError(messageChan <- chan ErrorLog) {
-	for message := range messageChan {
-		Log(message.String)
+func (l *logger) write(entry *Entry) {
+	l.sinksMutex.Lock()
+	defer l.sinksMutex.Unlock()
+
+	for _, sink := range l.sinks {
+		if err := sink.Write(entry); err != nil {
+			fmt.Fprintf(os.Stderr, "log: %v\n", err)
+		}
 	}
 }
 
+func (l *logger) enabled(level Level) bool {
+	return level >= Level(atomic.LoadInt32(&l.level))
+}
+
+func (l *logger) log(entry *Entry) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	if l.closed {
+		// Late entries are written straight away
+		l.write(entry)
+		return
+	}
+
+	select {
+	case l.queue <- entry:
+	default:
+		atomic.AddUint64(&l.dropped, 1)
+	}
+}
+
+func (l *logger) close() {
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		return
+	}
+	l.closed = true
+	close(l.queue)
+	l.mutex.Unlock()
+
+	<-l.flushed
+
+	l.sinksMutex.Lock()
+	defer l.sinksMutex.Unlock()
+
+	for _, sink := range l.sinks {
+		sink.Close()
+	}
+	l.sinks = []Sink{Stderr(TextEncoder{})}
+}
+
+// SetLevel sets the lowest level logged.
+func SetLevel(level Level) {
+	atomic.StoreInt32(&std.level, int32(level))
+}
+
+func GetLevel() Level {
+	return Level(atomic.LoadInt32(&std.level))
+}
+
+type sinkSwap struct {
+	sinks []Sink
+	done  chan struct{}
+}
+
+// swap replaces the sinks and closes the previous ones.
+func (l *logger) swap(sinks []Sink) {
+	l.sinksMutex.Lock()
+	previous := l.sinks
+	l.sinks = sinks
+	l.sinksMutex.Unlock()
+
+	for _, sink := range previous {
+		sink.Close()
+	}
+}
+
+// SetSinks replaces the sinks, closing the previous ones once the entries
+// queued so far are written to them. It returns when the swap is done.
+func SetSinks(sinks ...Sink) {
+	std.setSinks(sinks)
+}
+
+func (l *logger) setSinks(sinks []Sink) {
+	l.mutex.RLock()
+	if l.closed {
+		l.mutex.RUnlock()
+		l.swap(sinks)
+		return
+	}
+
+	// Queued behind the pending entries, and never dropped
+	swap := &sinkSwap{sinks: sinks, done: make(chan struct{})}
+	l.queue <- &Entry{swap: swap}
+	l.mutex.RUnlock()
+
+	<-swap.done
+}
+
+// Configure applies options on top of the environment: LevelEnv wins over
+// the configured level.
+func Configure(options Options) error {
+	var encoder Encoder = TextEncoder{}
+	switch strings.ToLower(options.Format) {
+	case "", "text":
+	case "json":
+		encoder = JSONEncoder{}
+	default:
+		return fmt.Errorf("unknown log format %q", options.Format)
+	}
+
+	levelName := options.Level
+	if env := os.Getenv(LevelEnv); env != "" {
+		levelName = env
+	}
+	level, err := ParseLevel(levelName)
+	if err != nil {
+		return err
+	}
+
+	sinks := []Sink{Stderr(encoder)}
+	if options.File != "" {
+		file, err := OpenRotatingFile(options.File, options.MaxSize, options.MaxBackups)
+		if err != nil {
+			return err
+		}
+		sinks = append(sinks, NewWriterSink(file, encoder))
+	}
+
+	SetLevel(level)
+	SetSinks(sinks...)
+	return nil
+}
+
+func logAt(level Level, message string, fields []interface{}) {
+	if !std.enabled(level) {
+		return
+	}
+	std.log(&Entry{Time: time.Now(), Level: level, Message: message, Fields: fields})
+}
+
+func Debug(message string, fields ...interface{}) {
+	logAt(LevelDebug, message, fields)
+}
+
+func Info(message string, fields ...interface{}) {
+	logAt(LevelInfo, message, fields)
+}
+
+func Warn(message string, fields ...interface{}) {
+	logAt(LevelWarn, message, fields)
+}
+
+func Error(message string, fields ...interface{}) {
+	logAt(LevelError, message, fields)
+}
+
+// CloseLogger writes the queued entries and closes the sinks. Entries
+// logged afterwards go to stderr synchronously.
+func CloseLogger() {
+	std.close()
+}
+
+// Log logs message at the info level.
 func Log(log string) {
-	_Log <- log
+	Info(strings.TrimRight(log, "\n"))
 }
 
+// LogError logs at the error level, keeping the error as a field.
 func LogError(log ErrorLog) {
-	_LogError <- log
+	if log.Error == nil {
+		Error(log.String)
+		return
+	}
+	Error(log.String, "error", log.Error)
 }
 
+// NewLines prints blank lines on the text sinks, in order with the entries.
 func NewLines(count int) {
-	_NewLines <- count
+	std.log(&Entry{raw: strings.Repeat("\n", count)})
 }
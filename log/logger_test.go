@@ -0,0 +1,108 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var at = time.Date(2018, 4, 2, 15, 4, 5, 0, time.UTC)
+
+func TestTextEncoder(t *testing.T) {
+	line := TextEncoder{}.Encode(&Entry{Time: at, Level: LevelWarn, Message: "Endpoint crashed",
+		Fields: []interface{}{"route", "home", "reason", "exit status 2", "pid"}})
+
+	assert.Equal(t, `2018-04-02 15:04:05.000 WARN  Endpoint crashed route=home reason="exit status 2" !BADKEY=pid`+"\n", string(line))
+}
+
+func TestJSONEncoder(t *testing.T) {
+	line := JSONEncoder{}.Encode(&Entry{Time: at, Level: LevelError, Message: "Build failed",
+		Fields: []interface{}{"error", errors.New("syntax error"), "took", 1500 * time.Millisecond}})
+
+	var decoded map[string]interface{}
+	assert.NoError(t, json.Unmarshal(line, &decoded))
+	assert.Equal(t, "ERROR", decoded["level"])
+	assert.Equal(t, "Build failed", decoded["msg"])
+	assert.Equal(t, "syntax error", decoded["error"])
+	assert.Equal(t, "1.5s", decoded["took"])
+
+	assert.Empty(t, JSONEncoder{}.Encode(&Entry{raw: "\n"}))
+}
+
+func TestParseLevel(t *testing.T) {
+	level, err := ParseLevel("WARNING")
+	assert.NoError(t, err)
+	assert.Equal(t, LevelWarn, level)
+
+	_, err = ParseLevel("loud")
+	assert.Error(t, err)
+}
+
+func TestPipelineIsFlushedOnClose(t *testing.T) {
+	var buf bytes.Buffer
+	l := newLogger(NewWriterSink(&buf, TextEncoder{}))
+
+	for i := 0; i < 100; i++ {
+		l.log(&Entry{Time: at, Level: LevelInfo, Message: "queued"})
+	}
+	l.close()
+
+	assert.Equal(t, 100, bytes.Count(buf.Bytes(), []byte("queued")))
+}
+
+func TestQueuedEntriesGoToThePreviousSinks(t *testing.T) {
+	var previous, next bytes.Buffer
+	l := newLogger(NewWriterSink(&previous, TextEncoder{}))
+	defer l.close()
+
+	for i := 0; i < 100; i++ {
+		l.log(&Entry{Time: at, Level: LevelInfo, Message: "before"})
+	}
+	l.setSinks([]Sink{NewWriterSink(&next, TextEncoder{})})
+	l.log(&Entry{Time: at, Level: LevelInfo, Message: "after"})
+	l.close()
+
+	assert.Equal(t, 100, bytes.Count(previous.Bytes(), []byte("before")))
+	assert.Equal(t, 0, bytes.Count(previous.Bytes(), []byte("after")))
+	assert.Equal(t, "2018-04-02 15:04:05.000 INFO  after\n", next.String())
+}
+
+func TestLevelFiltersEntries(t *testing.T) {
+	assert.True(t, std.enabled(LevelInfo))
+	assert.False(t, std.enabled(LevelDebug))
+
+	SetLevel(LevelDebug)
+	defer SetLevel(LevelInfo)
+	assert.True(t, std.enabled(LevelDebug))
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "brute")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "bin", "brute.log")
+	file, err := OpenRotatingFile(name, 10, 2)
+	assert.NoError(t, err)
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err := file.Write([]byte(line))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, file.Close())
+
+	for name, expected := range map[string]string{name: "fourth\n", name + ".1": "third\n", name + ".2": "second\n"} {
+		data, err := ioutil.ReadFile(name)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(data))
+	}
+	_, err = os.Stat(name + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,146 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Sink receives the entries of the logger.
+type Sink interface {
+	Write(entry *Entry) error
+	Close() error
+}
+
+type writerSink struct {
+	writer  io.Writer
+	encoder Encoder
+}
+
+// NewWriterSink encodes entries to w. Closing the sink closes w if it is an
+// io.Closer other than stdout or stderr.
+func NewWriterSink(w io.Writer, encoder Encoder) Sink {
+	return &writerSink{w, encoder}
+}
+
+// Stderr writes entries to the standard error.
+func Stderr(encoder Encoder) Sink {
+	return NewWriterSink(os.Stderr, encoder)
+}
+
+func (sink *writerSink) Write(entry *Entry) error {
+	data := sink.encoder.Encode(entry)
+	if len(data) == 0 {
+		return nil
+	}
+	_, err := sink.writer.Write(data)
+	return err
+}
+
+func (sink *writerSink) Close() error {
+	if sink.writer == os.Stderr || sink.writer == os.Stdout {
+		return nil
+	}
+	if closer, ok := sink.writer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// RotatingFile is a file that is renamed to name.1 once it grows past
+// MaxSize bytes, shifting the older backups up to name.MaxBackups.
+type RotatingFile struct {
+	Name       string
+	MaxSize    int64
+	MaxBackups int
+
+	file  *os.File
+	size  int64
+	mutex sync.Mutex
+}
+
+// OpenRotatingFile opens name for appending, creating its directory.
+func OpenRotatingFile(name string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	rotating := &RotatingFile{Name: name, MaxSize: maxSize, MaxBackups: maxBackups}
+	if err := rotating.open(); err != nil {
+		return nil, err
+	}
+	return rotating, nil
+}
+
+func (rotating *RotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(rotating.Name), 0700); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(rotating.Name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	rotating.file = file
+	rotating.size = info.Size()
+	return nil
+}
+
+func (rotating *RotatingFile) Write(data []byte) (int, error) {
+	rotating.mutex.Lock()
+	defer rotating.mutex.Unlock()
+
+	if rotating.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	if rotating.MaxSize > 0 && rotating.size > 0 && rotating.size+int64(len(data)) > rotating.MaxSize {
+		if err := rotating.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rotating.file.Write(data)
+	rotating.size += int64(n)
+	return n, err
+}
+
+func (rotating *RotatingFile) rotate() error {
+	if err := rotating.file.Close(); err != nil {
+		return err
+	}
+
+	if rotating.MaxBackups > 0 {
+		for i := rotating.MaxBackups - 1; i > 0; i-- {
+			os.Rename(backupName(rotating.Name, i), backupName(rotating.Name, i+1))
+		}
+		if err := os.Rename(rotating.Name, backupName(rotating.Name, 1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(rotating.Name); err != nil {
+		return err
+	}
+
+	return rotating.open()
+}
+
+func backupName(name string, i int) string {
+	return fmt.Sprintf("%s.%d", name, i)
+}
+
+func (rotating *RotatingFile) Close() error {
+	rotating.mutex.Lock()
+	defer rotating.mutex.Unlock()
+
+	if rotating.file == nil {
+		return nil
+	}
+	err := rotating.file.Close()
+	rotating.file = nil
+	return err
+}
@@ -0,0 +1,384 @@
+package brute
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The metrics of the master, served in the Prometheus text format by the
+// admin listener.
+var (
+	requestsTotal = NewCounterVec("brute_http_requests_total",
+		"Requests served by the endpoints.", "route", "status")
+	requestDuration = NewHistogramVec("brute_http_request_duration_seconds",
+		"Time to serve a request.", defaultBuckets, "route", "status")
+	requestsInFlight = NewGaugeFunc("brute_http_requests_in_flight",
+		"Requests being served by the replicas of an endpoint.", inFlightSamples, "route")
+	queuedRequests = NewGaugeFunc("brute_http_requests_queued",
+		"Requests waiting for a slot of an endpoint.", queuedSamples, "route")
+	sessionsOpen = NewGaugeFunc("brute_sessions",
+		"Request sessions in the session store.", func() []Sample {
+			return []Sample{{Value: float64(requestSession.Len())}}
+		})
+	replicasRunning = NewGaugeFunc("brute_endpoint_replicas",
+		"Replicas connected for an endpoint.", replicaSamples, "route")
+
+	rpcCalls = NewCounterVec("brute_rpc_calls_total",
+		"Calls from endpoints to the session store.", "method")
+	rpcErrors = NewCounterVec("brute_rpc_errors_total",
+		"Calls from endpoints to the session store that failed.", "method")
+
+	buildDuration = NewHistogramVec("brute_build_duration_seconds",
+		"Time to build an endpoint.", buildBuckets, "route")
+	buildFailures = NewCounterVec("brute_build_failures_total",
+		"Builds of an endpoint that failed.", "route")
+	endpointRestarts = NewCounterVec("brute_endpoint_restarts_total",
+		"Endpoints restarted after a code change or a push.", "route")
+	endpointExits = NewCounterVec("brute_endpoint_exits_total",
+		"Endpoint processes that exited while their route was served.", "route")
+	hotReloads = NewCounterVec("brute_hot_reloads_total",
+		"Code changes detected, by whether the endpoint was rebuilt.", "route", "result")
+	endpointConnections = NewCounterVec("brute_endpoint_connections_total",
+		"Connections accepted by the endpoint service.", "result")
+
+	authorizerDuration = NewHistogramVec("brute_authorizer_duration_seconds",
+		"Time taken by the authorizer to decide.", defaultBuckets, "outcome")
+)
+
+var (
+	defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	buildBuckets   = []float64{.5, 1, 2, 5, 10, 20, 30, 60, 120}
+)
+
+// Metric is a family of samples written in the Prometheus text format.
+type Metric interface {
+	WriteTo(w io.Writer) (int64, error)
+}
+
+var (
+	registry      []Metric
+	registryMutex sync.Mutex
+)
+
+func register(metric Metric) {
+	registryMutex.Lock()
+	registry = append(registry, metric)
+	registryMutex.Unlock()
+}
+
+// WriteMetrics writes every metric in the Prometheus text format.
+func WriteMetrics(w io.Writer) error {
+	registryMutex.Lock()
+	metrics := append([]Metric(nil), registry...)
+	registryMutex.Unlock()
+
+	for _, metric := range metrics {
+		if _, err := metric.WriteTo(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(names)+len(extra)/2)
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+extra[i+1]+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (family *family) header(w io.Writer) (int64, error) {
+	n, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.kind)
+	return int64(n), err
+}
+
+func (family *family) key(values []string) string {
+	if len(values) != len(family.labels) {
+		panic(fmt.Sprintf("metric %s takes %d labels, got %d", family.name, len(family.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// CounterVec is a counter per combination of label values.
+type CounterVec struct {
+	family
+	values map[string]*counter
+	mutex  sync.RWMutex
+}
+
+type counter struct {
+	labels []string
+	value  uint64
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	vec := &CounterVec{family: family{name, help, "counter", labels}, values: make(map[string]*counter)}
+	register(vec)
+	return vec
+}
+
+func (vec *CounterVec) Inc(labels ...string) {
+	vec.Add(1, labels...)
+}
+
+func (vec *CounterVec) Add(delta uint64, labels ...string) {
+	key := vec.key(labels)
+
+	vec.mutex.RLock()
+	c, ok := vec.values[key]
+	vec.mutex.RUnlock()
+
+	if !ok {
+		vec.mutex.Lock()
+		if c, ok = vec.values[key]; !ok {
+			c = &counter{labels: append([]string(nil), labels...)}
+			vec.values[key] = c
+		}
+		vec.mutex.Unlock()
+	}
+
+	atomic.AddUint64(&c.value, delta)
+}
+
+// Value returns the count for labels.
+func (vec *CounterVec) Value(labels ...string) uint64 {
+	vec.mutex.RLock()
+	defer vec.mutex.RUnlock()
+
+	if c, ok := vec.values[vec.key(labels)]; ok {
+		return atomic.LoadUint64(&c.value)
+	}
+	return 0
+}
+
+func (vec *CounterVec) WriteTo(w io.Writer) (int64, error) {
+	total, err := vec.header(w)
+	if err != nil {
+		return total, err
+	}
+
+	vec.mutex.RLock()
+	keys := make([]string, 0, len(vec.values))
+	for key := range vec.values {
+		keys = append(keys, key)
+	}
+	vec.mutex.RUnlock()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		vec.mutex.RLock()
+		c := vec.values[key]
+		vec.mutex.RUnlock()
+
+		n, err := fmt.Fprintf(w, "%s%s %d\n", vec.name, formatLabels(vec.labels, c.labels), atomic.LoadUint64(&c.value))
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// HistogramVec counts observations in cumulative buckets per combination
+// of label values.
+type HistogramVec struct {
+	family
+	buckets []float64
+	values  map[string]*histogram
+	mutex   sync.Mutex
+}
+
+type histogram struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	vec := &HistogramVec{family: family{name, help, "histogram", labels}, buckets: buckets, values: make(map[string]*histogram)}
+	register(vec)
+	return vec
+}
+
+func (vec *HistogramVec) Observe(value float64, labels ...string) {
+	key := vec.key(labels)
+
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+
+	h, ok := vec.values[key]
+	if !ok {
+		h = &histogram{labels: append([]string(nil), labels...), counts: make([]uint64, len(vec.buckets))}
+		vec.values[key] = h
+	}
+
+	for i, bound := range vec.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// ObserveSince observes the seconds elapsed since start.
+func (vec *HistogramVec) ObserveSince(start time.Time, labels ...string) {
+	vec.Observe(time.Since(start).Seconds(), labels...)
+}
+
+// Count returns the number of observations for labels.
+func (vec *HistogramVec) Count(labels ...string) uint64 {
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+
+	if h, ok := vec.values[vec.key(labels)]; ok {
+		return h.count
+	}
+	return 0
+}
+
+func (vec *HistogramVec) WriteTo(w io.Writer) (int64, error) {
+	var buf strings.Builder
+
+	vec.mutex.Lock()
+	keys := make([]string, 0, len(vec.values))
+	for key := range vec.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		h := vec.values[key]
+		for i, bound := range vec.buckets {
+			fmt.Fprintf(&buf, "%s_bucket%s %d\n", vec.name, formatLabels(vec.labels, h.labels, "le", formatValue(bound)), h.counts[i])
+		}
+		fmt.Fprintf(&buf, "%s_bucket%s %d\n", vec.name, formatLabels(vec.labels, h.labels, "le", "+Inf"), h.count)
+		fmt.Fprintf(&buf, "%s_sum%s %s\n", vec.name, formatLabels(vec.labels, h.labels), formatValue(h.sum))
+		fmt.Fprintf(&buf, "%s_count%s %d\n", vec.name, formatLabels(vec.labels, h.labels), h.count)
+	}
+	vec.mutex.Unlock()
+
+	total, err := vec.header(w)
+	if err != nil {
+		return total, err
+	}
+	n, err := io.WriteString(w, buf.String())
+	return total + int64(n), err
+}
+
+// Sample is a value of a gauge with its label values.
+type Sample struct {
+	Labels []string
+	Value  float64
+}
+
+// GaugeFunc reads its samples when the metrics are written.
+type GaugeFunc struct {
+	family
+	collect func() []Sample
+}
+
+func NewGaugeFunc(name, help string, collect func() []Sample, labels ...string) *GaugeFunc {
+	gauge := &GaugeFunc{family{name, help, "gauge", labels}, collect}
+	register(gauge)
+	return gauge
+}
+
+func (gauge *GaugeFunc) WriteTo(w io.Writer) (int64, error) {
+	samples := gauge.collect()
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].Labels, "\xff") < strings.Join(samples[j].Labels, "\xff")
+	})
+
+	total, err := gauge.header(w)
+	if err != nil {
+		return total, err
+	}
+	for _, sample := range samples {
+		n, err := fmt.Fprintf(w, "%s%s %s\n", gauge.name, formatLabels(gauge.labels, sample.Labels), formatValue(sample.Value))
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func inFlightSamples() (samples []Sample) {
+	endpoints.Range(func(directory, value interface{}) bool {
+		if set, ok := value.(*ReplicaSet); ok {
+			samples = append(samples, Sample{[]string{directory.(string)}, float64(set.InFlight())})
+		}
+		return true
+	})
+	return
+}
+
+func replicaSamples() (samples []Sample) {
+	endpoints.Range(func(directory, value interface{}) bool {
+		if set, ok := value.(*ReplicaSet); ok {
+			samples = append(samples, Sample{[]string{directory.(string)}, float64(set.Len())})
+		}
+		return true
+	})
+	return
+}
+
+func queuedSamples() (samples []Sample) {
+	for directory, stats := range RouteStats() {
+		samples = append(samples, Sample{[]string{directory}, float64(stats.Queued)})
+	}
+	return
+}
+
+// observeRequest records a request served, once its access record is
+// complete.
+func observeRequest(record *AccessRecord) {
+	status := strconv.Itoa(record.Status)
+	requestsTotal.Inc(record.Route, status)
+	requestDuration.Observe(record.Duration.Seconds(), record.Route, status)
+}
+
+// observeRpc counts a call to the session store, deferred with the error
+// it returns.
+func observeRpc(method string, err *error) {
+	rpcCalls.Inc(method)
+	if *err != nil {
+		rpcErrors.Inc(method)
+	}
+}
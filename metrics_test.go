@@ -0,0 +1,87 @@
+package brute
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounterVecText(t *testing.T) {
+	vec := &CounterVec{family: family{"test_total", "A test.", "counter", []string{"route"}}, values: make(map[string]*counter)}
+	vec.Inc(`say "hi"`)
+	vec.Add(2, "home")
+
+	var buf bytes.Buffer
+	_, err := vec.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "# HELP test_total A test.\n# TYPE test_total counter\n"+
+		"test_total{route=\"home\"} 2\n"+
+		"test_total{route=\"say \\\"hi\\\"\"} 1\n", buf.String())
+}
+
+func TestHistogramVecText(t *testing.T) {
+	vec := &HistogramVec{family: family{"test_seconds", "A test.", "histogram", []string{"route"}},
+		buckets: []float64{.1, 1}, values: make(map[string]*histogram)}
+	vec.Observe(.05, "home")
+	vec.Observe(.5, "home")
+	vec.Observe(5, "home")
+
+	var buf bytes.Buffer
+	_, err := vec.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Contains(t, buf.String(), "test_seconds_bucket{route=\"home\",le=\"0.1\"} 1\n")
+	assert.Contains(t, buf.String(), "test_seconds_bucket{route=\"home\",le=\"1\"} 2\n")
+	assert.Contains(t, buf.String(), "test_seconds_bucket{route=\"home\",le=\"+Inf\"} 3\n")
+	assert.Contains(t, buf.String(), "test_seconds_sum{route=\"home\"} 5.55\n")
+	assert.Contains(t, buf.String(), "test_seconds_count{route=\"home\"} 3\n")
+}
+
+func TestObserveRpc(t *testing.T) {
+	calls, errs := rpcCalls.Value("Close"), rpcErrors.Value("Close")
+
+	var ack bool
+	err := requestSession.Close(&EchoPacket{}, &ack)
+	assert.Error(t, err)
+
+	assert.Equal(t, calls+1, rpcCalls.Value("Close"))
+	assert.Equal(t, errs+1, rpcErrors.Value("Close"))
+
+	calls, errs = rpcCalls.Value("Write"), rpcErrors.Value("Write")
+	err = errors.New("session gone")
+	observeRpc("Write", &err)
+	assert.Equal(t, calls+1, rpcCalls.Value("Write"))
+	assert.Equal(t, errs+1, rpcErrors.Value("Write"))
+}
+
+func TestMetricsAreServed(t *testing.T) {
+	observeRequest(&AccessRecord{Route: "metrics-test", Status: 404, Duration: 20 * time.Millisecond})
+
+	w := httptest.NewRecorder()
+	adminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, 200, w.Code)
+	assert.True(t, strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4"))
+	body := w.Body.String()
+	assert.Contains(t, body, "brute_http_requests_total{route=\"metrics-test\",status=\"404\"} 1\n")
+	assert.Contains(t, body, "brute_http_request_duration_seconds_bucket{route=\"metrics-test\",status=\"404\",le=\"0.025\"} 1\n")
+	assert.Contains(t, body, "# TYPE brute_sessions gauge\n")
+	assert.Contains(t, body, "# TYPE brute_build_failures_total counter\n")
+}
+
+func TestRootRequestsAreCounted(t *testing.T) {
+	root := Route{Directory: "root"}
+	served := requestsTotal.Value("root", "204")
+
+	handler := instrumentRoute(&Config{Admin: &AdminConfig{}}, root, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/about", nil))
+
+	assert.Equal(t, served+1, requestsTotal.Value("root", "204"))
+}
@@ -0,0 +1,227 @@
+package brute
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/rrborja/brute/log"
+)
+
+// EndpointLogConfig is the endpoint_logs section of .brute.yml. Every line
+// an endpoint writes to its stdout or stderr is logged, tagged with the
+// route and PID, and the last Lines of them are kept for brute logs. With
+// Dir set, they are also written to Dir/<endpoint>.log, rotated once it
+// grows past MaxSize megabytes:
+//
+//	endpoint_logs:
+//	  lines: 1000
+//	  dir: bin/logs
+//	  max_size: 10
+//	  max_backups: 3
+type EndpointLogConfig struct {
+	Lines      int    `yaml:"lines"`
+	Dir        string `yaml:"dir"`
+	MaxSize    int64  `yaml:"max_size"`
+	MaxBackups int    `yaml:"max_backups"`
+}
+
+const (
+	defaultOutputLines = 1000
+	// maxOutputLine splits lines longer than that.
+	maxOutputLine = 64 << 10
+)
+
+var noSuchEndpointOutputError = errors.New("no output captured for this endpoint")
+
+// endpointLogs is set by New.
+var endpointLogs = &EndpointLogConfig{}
+
+// outputs holds the *EndpointOutput of every endpoint started.
+var outputs sync.Map
+
+// OutputLine is a line written by an endpoint process.
+type OutputLine struct {
+	Time   time.Time
+	Pid    int
+	Stream string
+	Text   string
+}
+
+func (line OutputLine) String() string {
+	return fmt.Sprintf("%s [%d] %s", line.Time.Format("2006-01-02 15:04:05.000"), line.Pid, line.Text)
+}
+
+// EndpointOutput keeps the last lines of the processes of an endpoint and
+// hands new ones to its followers.
+type EndpointOutput struct {
+	Route string
+
+	lines     []OutputLine
+	next      int
+	full      bool
+	followers map[chan OutputLine]struct{}
+	file      *RotatingFile
+	mutex     sync.Mutex
+}
+
+func newEndpointOutput(route string, config *EndpointLogConfig) *EndpointOutput {
+	size := config.Lines
+	if size <= 0 {
+		size = defaultOutputLines
+	}
+
+	output := &EndpointOutput{
+		Route:     route,
+		lines:     make([]OutputLine, size),
+		followers: make(map[chan OutputLine]struct{}),
+	}
+
+	if config.Dir != "" {
+		file, err := OpenRotatingFile(filepath.Join(config.Dir, route+".log"), config.MaxSize<<20, config.MaxBackups)
+		if err != nil {
+			LogError(ErrorLog{err, fmt.Sprintf("Could not open the log file of endpoint %s: %v", route, err)})
+		} else {
+			output.file = file
+		}
+	}
+
+	return output
+}
+
+// outputOf returns the output of route, creating it on first use.
+func outputOf(route string) *EndpointOutput {
+	if output, ok := outputs.Load(route); ok {
+		return output.(*EndpointOutput)
+	}
+	output, _ := outputs.LoadOrStore(route, newEndpointOutput(route, endpointLogs))
+	return output.(*EndpointOutput)
+}
+
+func (output *EndpointOutput) add(line OutputLine) {
+	Info(line.Text, "route", output.Route, "pid", line.Pid, "stream", line.Stream)
+
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+
+	output.lines[output.next] = line
+	output.next = (output.next + 1) % len(output.lines)
+	if output.next == 0 {
+		output.full = true
+	}
+
+	if output.file != nil {
+		output.file.Write([]byte(line.String() + "\n"))
+	}
+
+	for follower := range output.followers {
+		select {
+		case follower <- line:
+		default:
+			// A follower too slow to keep up misses lines rather than
+			// holding back the endpoint
+		}
+	}
+}
+
+// Lines returns the lines kept, oldest first.
+func (output *EndpointOutput) Lines() []OutputLine {
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+
+	return output.snapshot()
+}
+
+func (output *EndpointOutput) snapshot() []OutputLine {
+	if !output.full {
+		return append([]OutputLine(nil), output.lines[:output.next]...)
+	}
+	lines := make([]OutputLine, 0, len(output.lines))
+	lines = append(lines, output.lines[output.next:]...)
+	return append(lines, output.lines[:output.next]...)
+}
+
+// Follow returns the lines kept and a channel receiving the next ones
+// until stop is called.
+func (output *EndpointOutput) Follow() (lines []OutputLine, follow <-chan OutputLine, stop func()) {
+	follower := make(chan OutputLine, 256)
+
+	output.mutex.Lock()
+	lines = output.snapshot()
+	output.followers[follower] = struct{}{}
+	output.mutex.Unlock()
+
+	var once sync.Once
+	return lines, follower, func() {
+		once.Do(func() {
+			output.mutex.Lock()
+			delete(output.followers, follower)
+			output.mutex.Unlock()
+		})
+	}
+}
+
+// Writer returns the writer capturing the stream of cmd, which must be
+// started before anything is written.
+func (output *EndpointOutput) Writer(cmd *exec.Cmd, stream string) *OutputWriter {
+	return &OutputWriter{output: output, cmd: cmd, stream: stream}
+}
+
+// EndpointOutputOf returns the output of the endpoint named route.
+func EndpointOutputOf(route string) (*EndpointOutput, error) {
+	if output, ok := outputs.Load(route); ok {
+		return output.(*EndpointOutput), nil
+	}
+	return nil, noSuchEndpointOutputError
+}
+
+// OutputWriter splits what a process writes into lines.
+type OutputWriter struct {
+	output  *EndpointOutput
+	cmd     *exec.Cmd
+	stream  string
+	partial []byte
+}
+
+func (w *OutputWriter) Write(data []byte) (int, error) {
+	n := len(data)
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			w.partial = append(w.partial, data...)
+			if len(w.partial) >= maxOutputLine {
+				w.emit(w.partial)
+			}
+			break
+		}
+
+		if len(w.partial) > 0 {
+			w.emit(append(w.partial, data[:i]...))
+		} else {
+			w.emit(data[:i])
+		}
+		data = data[i+1:]
+	}
+	return n, nil
+}
+
+// Flush emits what was written after the last newline. It is called once
+// the process exited, when nothing more is written.
+func (w *OutputWriter) Flush() {
+	if len(w.partial) > 0 {
+		w.emit(w.partial)
+	}
+}
+
+func (w *OutputWriter) emit(text []byte) {
+	var pid int
+	if w.cmd != nil && w.cmd.Process != nil {
+		pid = w.cmd.Process.Pid
+	}
+	w.output.add(OutputLine{time.Now(), pid, w.stream, string(bytes.TrimRight(text, "\r"))})
+	w.partial = w.partial[:0]
+}
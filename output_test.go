@@ -0,0 +1,93 @@
+package brute
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEndpointOutputIsCapturedByLine(t *testing.T) {
+	output := newEndpointOutput("home", &EndpointLogConfig{})
+
+	cmd := exec.Command("sh", "-c", "echo one; echo two >&2; printf 'thr'; printf 'ee\\n'")
+	cmd.Stdout = output.Writer(cmd, "stdout")
+	cmd.Stderr = output.Writer(cmd, "stderr")
+	assert.NoError(t, cmd.Run())
+
+	lines := output.Lines()
+	if assert.Len(t, lines, 3) {
+		texts := []string{lines[0].Text, lines[1].Text, lines[2].Text}
+		assert.Contains(t, texts, "one")
+		assert.Contains(t, texts, "two")
+		assert.Contains(t, texts, "three")
+		assert.Equal(t, cmd.Process.Pid, lines[0].Pid)
+	}
+}
+
+func TestUnterminatedLastLineIsFlushed(t *testing.T) {
+	output := newEndpointOutput("home", &EndpointLogConfig{})
+
+	cmd := exec.Command("sh", "-c", "echo starting; printf 'panic: boom' >&2; exit 2")
+	stderr := output.Writer(cmd, "stderr")
+	cmd.Stdout = output.Writer(cmd, "stdout")
+	cmd.Stderr = stderr
+	assert.Error(t, cmd.Run())
+	assert.Len(t, output.Lines(), 1)
+
+	stderr.Flush()
+	lines := output.Lines()
+	if assert.Len(t, lines, 2) {
+		assert.Equal(t, "panic: boom", lines[1].Text)
+		assert.Equal(t, "stderr", lines[1].Stream)
+	}
+
+	stderr.Flush()
+	assert.Len(t, output.Lines(), 2)
+}
+
+func TestEndpointOutputKeepsTheLastLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "brute")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	output := newEndpointOutput("home", &EndpointLogConfig{Lines: 2, Dir: dir})
+	w := output.Writer(nil, "stdout")
+	w.Write([]byte("first\nsecond\nthird\n"))
+
+	lines := output.Lines()
+	if assert.Len(t, lines, 2) {
+		assert.Equal(t, "second", lines[0].Text)
+		assert.Equal(t, "third", lines[1].Text)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "home.log"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, strings.Count(string(data), "\n"))
+}
+
+func TestFollowEndpointOutput(t *testing.T) {
+	output := newEndpointOutput("home", &EndpointLogConfig{})
+	w := output.Writer(nil, "stdout")
+	w.Write([]byte("before\n"))
+
+	lines, follow, stop := output.Follow()
+	assert.Len(t, lines, 1)
+
+	w.Write([]byte("after\n"))
+	select {
+	case line := <-follow:
+		assert.Equal(t, "after", line.Text)
+	case <-time.After(time.Second):
+		t.Fatal("the new line was not followed")
+	}
+
+	stop()
+	w.Write([]byte("ignored\n"))
+	assert.Len(t, follow, 0)
+}
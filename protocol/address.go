@@ -0,0 +1,21 @@
+package protocol
+
+import "strings"
+
+// The master tells the endpoints it spawns where to reach it through these
+// environment variables, holding addresses in the form ParseAddress reads.
+const (
+	EndpointServiceEnv = "BRUTE_ENDPOINT_SERVICE"
+	RpcServiceEnv      = "BRUTE_RPC_SERVICE"
+)
+
+// ParseAddress splits an address such as "unix://bin/endpoints.sock",
+// "tcp4://127.0.0.1:11000" or "localhost:11000" into the network and the
+// address arguments of net.Listen and net.Dial. Addresses without a scheme
+// are TCP.
+func ParseAddress(address string) (network, addr string) {
+	if i := strings.Index(address, "://"); i >= 0 {
+		return address[:i], address[i+3:]
+	}
+	return "tcp", address
+}
@@ -0,0 +1,92 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// CapabilityMultiplex means the endpoint connection also carries the data
+// plane: requests and their responses travel as frames over it instead of
+// through the master's RPC server, many sessions sharing the connection.
+//
+// Once negotiated, the master sends a Dispatch frame instead of a Session
+// frame, holding the session ID followed by the JSON encoded request. The
+// endpoint answers with Data frames and ends the session with a Close frame.
+// Each session may have at most InitialWindow bytes of credit in flight,
+// every Data frame costing its body length plus DataFrameCost; the master
+// returns the credit with WindowUpdate frames once it has written the data
+// to the HTTP client. Charging each frame a fixed cost bounds the number of
+// small frames a session can queue on the master, so one slow HTTP client
+// never stalls the other sessions of the connection.
+const CapabilityMultiplex = "multiplex"
+
+const (
+	FrameDispatch FrameType = iota + 16
+	FrameData
+	FrameClose
+	FrameWindowUpdate
+)
+
+// InitialWindow is the number of bytes an endpoint may send for a session
+// before waiting for a WindowUpdate.
+const InitialWindow = 256 << 10
+
+// DataFrameCost is charged against the window for every Data frame on top
+// of its body length.
+const DataFrameCost = 4 << 10
+
+const sessionIdSize = 32
+
+var ShortFrameError = errors.New("frame payload is too short")
+
+// SessionPayload prefixes data with a session ID.
+func SessionPayload(sid [32]byte, data []byte) []byte {
+	payload := make([]byte, sessionIdSize+len(data))
+	copy(payload, sid[:])
+	copy(payload[sessionIdSize:], data)
+	return payload
+}
+
+// SplitSession separates the session ID a payload starts with from the rest.
+func SplitSession(payload []byte) (sid [32]byte, data []byte, err error) {
+	if len(payload) < sessionIdSize {
+		return sid, nil, ShortFrameError
+	}
+	copy(sid[:], payload)
+	return sid, payload[sessionIdSize:], nil
+}
+
+// DataPayload encodes a Data frame: session ID, 4-byte status or packet
+// code, then the body.
+func DataPayload(sid [32]byte, code int, body []byte) []byte {
+	payload := make([]byte, sessionIdSize+4+len(body))
+	copy(payload, sid[:])
+	binary.BigEndian.PutUint32(payload[sessionIdSize:], uint32(code))
+	copy(payload[sessionIdSize+4:], body)
+	return payload
+}
+
+func ParseData(payload []byte) (sid [32]byte, code int, body []byte, err error) {
+	if len(payload) < sessionIdSize+4 {
+		return sid, 0, nil, ShortFrameError
+	}
+	copy(sid[:], payload)
+	code = int(binary.BigEndian.Uint32(payload[sessionIdSize:]))
+	return sid, code, payload[sessionIdSize+4:], nil
+}
+
+// WindowPayload encodes a WindowUpdate frame granting increment bytes.
+func WindowPayload(sid [32]byte, increment int) []byte {
+	payload := make([]byte, sessionIdSize+4)
+	copy(payload, sid[:])
+	binary.BigEndian.PutUint32(payload[sessionIdSize:], uint32(increment))
+	return payload
+}
+
+func ParseWindow(payload []byte) (sid [32]byte, increment int, err error) {
+	if len(payload) < sessionIdSize+4 {
+		return sid, 0, ShortFrameError
+	}
+	copy(sid[:], payload)
+	return sid, int(binary.BigEndian.Uint32(payload[sessionIdSize:])), nil
+}
@@ -0,0 +1,145 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Capabilities an endpoint or the master may support on top of the base
+// protocol. Only the capabilities both sides list in their handshake may be
+// used on a connection.
+const (
+	// CapabilityStreaming means response writes are delegated to the HTTP
+	// client as soon as they arrive instead of once the handler returns.
+	CapabilityStreaming = "streaming"
+	// CapabilityWebsockets means the connection can carry upgraded
+	// websocket sessions.
+	CapabilityWebsockets = "websockets"
+	// CapabilityBodyStreaming means request bodies are sent in chunks
+	// instead of along with the session.
+	CapabilityBodyStreaming = "body-streaming"
+)
+
+// Hello is the first frame an endpoint sends.
+type Hello struct {
+	Version      int      `json:"version"`
+	MinVersion   int      `json:"min_version"`
+	Route        string   `json:"route"`
+	Token        string   `json:"token"`
+	PID          int      `json:"pid"`
+	BuildHash    string   `json:"build_hash,omitempty"`
+	Methods      []string `json:"methods,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// Welcome accepts an endpoint.
+type Welcome struct {
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// Reject refuses an endpoint.
+type Reject struct {
+	Reason string `json:"reason"`
+}
+
+func (reject Reject) Error() string {
+	return reject.Reason
+}
+
+// Negotiate picks the highest protocol version both the master and the
+// endpoint speak, and the capabilities both support.
+func Negotiate(hello *Hello, capabilities []string) (*Welcome, error) {
+	version := Version
+	if hello.Version < version {
+		version = hello.Version
+	}
+
+	if version < MinVersion || version < hello.MinVersion {
+		return nil, fmt.Errorf("endpoint %s speaks protocol versions %d to %d but the master speaks %d to %d; rebuild the endpoint against a compatible brute client library",
+			hello.Route, hello.MinVersion, hello.Version, MinVersion, Version)
+	}
+
+	welcome := &Welcome{Version: version}
+	for _, offered := range hello.Capabilities {
+		for _, supported := range capabilities {
+			if offered == supported {
+				welcome.Capabilities = append(welcome.Capabilities, offered)
+			}
+		}
+	}
+
+	return welcome, nil
+}
+
+func (welcome *Welcome) Supports(capability string) bool {
+	for _, c := range welcome.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+func WriteMessage(w io.Writer, frameType FrameType, message interface{}) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return WriteFrame(w, frameType, payload)
+}
+
+// ReadHello reads the handshake of an endpoint, magic number included.
+func ReadHello(r io.Reader) (*Hello, error) {
+	if err := ReadMagic(r); err != nil {
+		return nil, err
+	}
+
+	frame, err := ReadFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	if frame.Type != FrameHello {
+		return nil, fmt.Errorf("expected a hello frame, got frame type %d", frame.Type)
+	}
+
+	var hello Hello
+	if err := json.Unmarshal(frame.Payload, &hello); err != nil {
+		return nil, fmt.Errorf("malformed hello frame: %v", err)
+	}
+	return &hello, nil
+}
+
+// Dial performs the endpoint side of the handshake over conn. A Reject
+// from the master is returned as an error.
+func Dial(conn io.ReadWriter, hello *Hello) (*Welcome, error) {
+	if _, err := conn.Write(Magic); err != nil {
+		return nil, err
+	}
+	if err := WriteMessage(conn, FrameHello, hello); err != nil {
+		return nil, err
+	}
+
+	frame, err := ReadFrame(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	switch frame.Type {
+	case FrameWelcome:
+		var welcome Welcome
+		if err := json.Unmarshal(frame.Payload, &welcome); err != nil {
+			return nil, fmt.Errorf("malformed welcome frame: %v", err)
+		}
+		return &welcome, nil
+	case FrameReject:
+		var reject Reject
+		if err := json.Unmarshal(frame.Payload, &reject); err != nil {
+			return nil, fmt.Errorf("malformed reject frame: %v", err)
+		}
+		return nil, reject
+	default:
+		return nil, fmt.Errorf("expected a welcome frame, got frame type %d", frame.Type)
+	}
+}
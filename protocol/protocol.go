@@ -0,0 +1,125 @@
+// Package protocol defines how an endpoint process talks to the master on
+// the endpoint service.
+//
+// A connection starts with the 5-byte magic number "brute" written by the
+// endpoint. Everything after it is a sequence of frames:
+//
+//	+--------+----------------------+-------------------+
+//	| type   | length               | payload           |
+//	| 1 byte | 4 bytes, big endian  | length bytes      |
+//	+--------+----------------------+-------------------+
+//
+// The endpoint first sends a Hello frame. The master answers with either a
+// Welcome frame, carrying the negotiated protocol version and capabilities,
+// or a Reject frame explaining why the endpoint cannot be served, after
+// which it closes the connection. Once welcomed, the master sends a Session
+// frame, whose payload is a 32-byte session ID, for every request routed to
+// the endpoint. When the master shuts down it sends a Shutdown frame, after
+// which the endpoint finishes the sessions it has and exits. Frames of
+// unknown types are skipped by both sides so newer peers can add frames
+// within the same protocol version.
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Magic is written by an endpoint before its first frame.
+var Magic = []byte{0x62, 0x72, 0x75, 0x74, 0x65}
+
+const (
+	// Version is the protocol version implemented by this package. It is
+	// compiled into both the master and every endpoint.
+	Version = 2
+	// MinVersion is the oldest version this package can still speak.
+	MinVersion = 2
+
+	// MaxFrameSize bounds the payload of a single frame.
+	MaxFrameSize = 16 << 20
+)
+
+type FrameType byte
+
+const (
+	FrameHello FrameType = iota + 1
+	FrameWelcome
+	FrameReject
+	FrameSession
+	FrameShutdown
+)
+
+var (
+	FrameTooLargeError = errors.New("frame exceeds the maximum frame size")
+	// LegacyHandshakeError is returned when the peer speaks the unframed
+	// handshake of brute client libraries older than protocol version 2.
+	LegacyHandshakeError = errors.New("endpoint uses the legacy unversioned handshake; rebuild it against the current brute client library")
+)
+
+type Frame struct {
+	Type    FrameType
+	Payload []byte
+}
+
+// WriteFrame writes a frame with a single call to w, so concurrent writers
+// sharing a locked connection never interleave frames.
+func WriteFrame(w io.Writer, frameType FrameType, payload []byte) error {
+	if len(payload) > MaxFrameSize {
+		return FrameTooLargeError
+	}
+
+	buf := make([]byte, 5+len(payload))
+	buf[0] = byte(frameType)
+	binary.BigEndian.PutUint32(buf[1:5], uint32(len(payload)))
+	copy(buf[5:], payload)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadFrame reads the next frame from r, waiting for partial reads to
+// complete.
+func ReadFrame(r io.Reader) (*Frame, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	if isLegacy(header[0]) {
+		return nil, LegacyHandshakeError
+	}
+
+	size := binary.BigEndian.Uint32(header[1:5])
+	if size > MaxFrameSize {
+		return nil, FrameTooLargeError
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	return &Frame{FrameType(header[0]), payload}, nil
+}
+
+// ReadMagic consumes the magic number an endpoint starts its connection with.
+func ReadMagic(r io.Reader) error {
+	magic := make([]byte, len(Magic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return err
+	}
+	for i, m := range magic {
+		if m != Magic[i] {
+			return fmt.Errorf("not a brute endpoint")
+		}
+	}
+	return nil
+}
+
+// isLegacy tells whether the first byte after the magic number is one of
+// the ASCII digits that started the route length in the legacy handshake.
+func isLegacy(first byte) bool {
+	return first >= '0' && first <= '9'
+}
@@ -0,0 +1,53 @@
+package protocol
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrameSurvivesPartialReads(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, WriteFrame(&buf, FrameSession, []byte("0123456789abcdef0123456789abcdef")))
+
+	frame, err := ReadFrame(iotest.OneByteReader(&buf))
+	assert.NoError(t, err)
+	assert.Equal(t, FrameSession, frame.Type)
+	assert.Equal(t, "0123456789abcdef0123456789abcdef", string(frame.Payload))
+}
+
+func TestLegacyHandshakeIsDetected(t *testing.T) {
+	_, err := ReadHello(bytes.NewBufferString("brute0004home"))
+	assert.Equal(t, LegacyHandshakeError, err)
+}
+
+func TestNegotiate(t *testing.T) {
+	welcome, err := Negotiate(&Hello{Version: Version + 1, MinVersion: MinVersion,
+		Capabilities: []string{CapabilityStreaming, CapabilityWebsockets}}, []string{CapabilityStreaming})
+	assert.NoError(t, err)
+	assert.Equal(t, Version, welcome.Version)
+	assert.Equal(t, []string{CapabilityStreaming}, welcome.Capabilities)
+
+	_, err = Negotiate(&Hello{Route: "home", Version: Version + 2, MinVersion: Version + 1}, nil)
+	assert.Error(t, err)
+}
+
+func TestDialIsRejected(t *testing.T) {
+	master, endpoint := net.Pipe()
+	defer master.Close()
+	defer endpoint.Close()
+
+	go func() {
+		hello, err := ReadHello(master)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "home", hello.Route)
+		}
+		WriteMessage(master, FrameReject, Reject{"no such route"})
+	}()
+
+	_, err := Dial(endpoint, &Hello{Version: Version, MinVersion: MinVersion, Route: "home"})
+	assert.Equal(t, Reject{"no such route"}, err)
+}
@@ -0,0 +1,64 @@
+package brute
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+)
+
+var (
+	unknownTokenError  = errors.New("unknown or already used registration token")
+	routeMismatchError = errors.New("registration token was issued for another route")
+)
+
+// registrationTokens holds the one-time tokens handed to endpoint processes
+// spawned by this master. An endpoint must present its token when it
+// registers its route on the endpoint service.
+var registrationTokens = &Registrations{pending: make(map[string]string)}
+
+type Registrations struct {
+	pending map[string]string
+	mutex   sync.Mutex
+}
+
+// Issue creates a token allowing a single registration of route.
+func (registrations *Registrations) Issue(route string) string {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		panic(err)
+	}
+
+	registrations.mutex.Lock()
+	defer registrations.mutex.Unlock()
+
+	encoded := hex.EncodeToString(token)
+	registrations.pending[encoded] = route
+	return encoded
+}
+
+// Redeem consumes token if it was issued for route.
+func (registrations *Registrations) Redeem(token, route string) error {
+	registrations.mutex.Lock()
+	defer registrations.mutex.Unlock()
+
+	issuedFor, ok := registrations.pending[token]
+	if !ok {
+		return unknownTokenError
+	}
+	if issuedFor != route {
+		return routeMismatchError
+	}
+
+	delete(registrations.pending, token)
+	return nil
+}
+
+// Revoke discards token, e.g. when its endpoint process failed to start
+// or exited.
+func (registrations *Registrations) Revoke(token string) {
+	registrations.mutex.Lock()
+	defer registrations.mutex.Unlock()
+
+	delete(registrations.pending, token)
+}
@@ -0,0 +1,67 @@
+package brute
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistrationTokensAreRedeemedOnce(t *testing.T) {
+	registrations := &Registrations{pending: make(map[string]string)}
+
+	token := registrations.Issue("users")
+	assert.Len(t, token, 64)
+	assert.NotEqual(t, token, registrations.Issue("users"))
+
+	assert.NoError(t, registrations.Redeem(token, "users"))
+	assert.Equal(t, unknownTokenError, registrations.Redeem(token, "users"))
+}
+
+func TestRegistrationTokensAreBoundToTheirRoute(t *testing.T) {
+	registrations := &Registrations{pending: make(map[string]string)}
+
+	token := registrations.Issue("users")
+	assert.Equal(t, routeMismatchError, registrations.Redeem(token, "admin"))
+
+	// A mismatch does not consume the token
+	assert.NoError(t, registrations.Redeem(token, "users"))
+}
+
+func TestRevokedRegistrationTokens(t *testing.T) {
+	registrations := &Registrations{pending: make(map[string]string)}
+
+	token := registrations.Issue("users")
+	registrations.Revoke(token)
+	assert.Equal(t, unknownTokenError, registrations.Redeem(token, "users"))
+
+	assert.Equal(t, unknownTokenError, registrations.Redeem("", "users"))
+}
+
+func TestTokenOfAnExitedEndpointIsRevoked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "brute")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	previous := cwd
+	cwd = dir
+	defer func() { cwd = previous }()
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "bin", "endpoints"), 0700))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "bin", "endpoints", "crashing"), []byte("#!/bin/sh\nexit 1\n"), 0700))
+
+	StartRootEndpoint(Route{Path: "/crashing", Directory: "crashing"})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	children.Wait(ctx)
+
+	registrationTokens.mutex.Lock()
+	defer registrationTokens.mutex.Unlock()
+	for _, route := range registrationTokens.pending {
+		assert.NotEqual(t, "crashing", route)
+	}
+}
@@ -0,0 +1,551 @@
+package brute
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/rrborja/brute/log"
+)
+
+// Versions of the remote control protocol, spoken between the brute
+// command and a master deployed elsewhere.
+const (
+	RemoteVersion    = 1
+	MinRemoteVersion = 1
+)
+
+// DefaultRemotePort is where a remote master listens when its address has
+// no port.
+const DefaultRemotePort = "11793"
+
+// Commands of the remote control protocol.
+const (
+	RemoteCheck  = "check"
+	RemoteStatus = "status"
+	RemotePush   = "push"
+)
+
+const (
+	defaultRemoteTokenFile = "bin/remote.token"
+	remoteDialTimeout      = 10 * time.Second
+	remoteTimeout          = 10 * time.Minute
+	maxBundleSize          = 1 << 30
+)
+
+var (
+	remoteAuthenticationError = errors.New("authentication failed")
+	unknownRemoteCommandError = errors.New("unknown remote command")
+	bundleHashMismatchError   = errors.New("the bundle received does not match its hash")
+	bundleTooLargeError       = errors.New("the bundle is too large")
+)
+
+// version is the version of brute the master was built as.
+var version string
+
+func SetVersion(v string) {
+	version = v
+}
+
+// BuildVersion is the version of brute set with SetVersion.
+func BuildVersion() string {
+	return version
+}
+
+// RemoteControlConfig is the remote_control section of .brute.yml. A master
+// accepts remote deployments only when the section is there:
+//
+//	remote_control:
+//	  listen: :11793
+//	  token_file: bin/remote.token
+//
+// The token is generated in the token file when there is none. The brute
+// command authenticates with it without sending it, but the bundles are not
+// encrypted: reach masters across untrusted networks through a tunnel.
+type RemoteControlConfig struct {
+	Listen    string `yaml:"listen"`
+	TokenFile string `yaml:"token_file"`
+}
+
+func (config *RemoteControlConfig) address() string {
+	if config.Listen == "" {
+		return ":" + DefaultRemotePort
+	}
+	return config.Listen
+}
+
+// RemoteChallenge is what a remote master sends first on a connection.
+type RemoteChallenge struct {
+	Version    int    `json:"version"`
+	MinVersion int    `json:"min_version"`
+	Nonce      string `json:"nonce"`
+}
+
+// RemoteRequest is the single request of a connection. A push is followed
+// by the Size bytes of the bundle.
+type RemoteRequest struct {
+	Version int    `json:"version"`
+	Command string `json:"command"`
+	Hash    string `json:"hash,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	Mac     string `json:"mac"`
+}
+
+// RemoteReply answers a RemoteRequest.
+type RemoteReply struct {
+	Version      int    `json:"version"`
+	Error        string `json:"error,omitempty"`
+	BruteVersion string `json:"brute_version,omitempty"`
+	Project      string `json:"project,omitempty"`
+	Platform     string `json:"platform,omitempty"`
+
+	Status *MasterStatus `json:"status,omitempty"`
+
+	// Release names the bundle a push activated. Restarted lists the
+	// endpoints running its binaries, Pending those the master does not
+	// serve, or serves with their previous settings, until it is
+	// restarted.
+	Release   string   `json:"release,omitempty"`
+	Restarted []string `json:"restarted,omitempty"`
+	Pending   []string `json:"pending,omitempty"`
+}
+
+// remoteMac authenticates a request for the connection of nonce.
+func remoteMac(token, nonce string, request *RemoteRequest) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	fmt.Fprintf(mac, "%s\n%d\n%s\n%s\n%d", nonce, request.Version, request.Command, request.Hash, request.Size)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// RemoteAddress is the TCP address of a remote given as host, host:port or
+// tcp://host:port.
+func RemoteAddress(url string) (string, error) {
+	address := url
+	for _, scheme := range []string{"tcp://", "brute://"} {
+		address = strings.TrimPrefix(address, scheme)
+	}
+	if address == "" || strings.Contains(address, "/") {
+		return "", fmt.Errorf("invalid remote %q, expected host or host:port", url)
+	}
+
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(strings.Trim(address, "[]"), DefaultRemotePort)
+	}
+	return address, nil
+}
+
+// RemoteControl serves the remote control protocol for the project in Dir.
+type RemoteControl struct {
+	Dir   string
+	Token string
+
+	// Reload restarts the endpoints of an activated release.
+	Reload func(routes []Route)
+
+	mutex sync.Mutex
+}
+
+// serveRemoteControl starts the remote control listener if it is
+// configured.
+func serveRemoteControl(config *Config) {
+	if config.RemoteControl == nil {
+		return
+	}
+
+	tokenFile := config.RemoteControl.TokenFile
+	if tokenFile == "" {
+		tokenFile = defaultRemoteTokenFile
+	}
+	token, err := remoteToken(tokenFile)
+	if err != nil {
+		LogError(ErrorLog{err, fmt.Sprintf("Can't read the remote control token: %v", err)})
+		return
+	}
+
+	address := config.RemoteControl.address()
+	l, err := Listen(address)
+	if err != nil {
+		LogError(ErrorLog{err, fmt.Sprintf("Can't listen for remote control on %s: %v", address, err)})
+		return
+	}
+	closeOnShutdown(l)
+
+	Log(fmt.Sprintf("Serving remote control on %s", address))
+	control := &RemoteControl{Dir: cwd, Token: token, Reload: reloadEndpoints}
+	go control.Serve(l)
+}
+
+// remoteToken reads the token of the remote control, generating it the
+// first time.
+func remoteToken(name string) (string, error) {
+	data, err := ioutil.ReadFile(name)
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	encoded := hex.EncodeToString(token)
+
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(name, []byte(encoded+"\n"), 0600); err != nil {
+		return "", err
+	}
+	Log(fmt.Sprintf("Generated the remote control token in %s", name))
+	return encoded, nil
+}
+
+// Serve answers the connections of l until it is closed.
+func (control *RemoteControl) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ShuttingDown() {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+
+		go control.handle(conn)
+	}
+}
+
+func (control *RemoteControl) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(remoteTimeout))
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		LogError(ErrorLog{err, err.Error()})
+		return
+	}
+	challenge := RemoteChallenge{Version: RemoteVersion, MinVersion: MinRemoteVersion, Nonce: hex.EncodeToString(nonce)}
+
+	e := json.NewEncoder(conn)
+	if err := e.Encode(challenge); err != nil {
+		return
+	}
+
+	r := bufio.NewReader(conn)
+	var request RemoteRequest
+	if err := readJsonLine(r, &request); err != nil {
+		return
+	}
+
+	reply := control.serve(r, challenge.Nonce, &request, conn.RemoteAddr())
+	reply.Version = RemoteVersion
+	e.Encode(reply)
+}
+
+// serve runs an authenticated request, reading the bundle of a push from r.
+func (control *RemoteControl) serve(r io.Reader, nonce string, request *RemoteRequest, from net.Addr) *RemoteReply {
+	if !hmac.Equal([]byte(request.Mac), []byte(remoteMac(control.Token, nonce, request))) {
+		Warn("Rejected a remote control request", "remote", from.String(), "command", request.Command)
+		return &RemoteReply{Error: remoteAuthenticationError.Error()}
+	}
+	if request.Version < MinRemoteVersion || request.Version > RemoteVersion {
+		return &RemoteReply{Error: fmt.Sprintf("the master speaks remote control versions %d to %d, not %d", MinRemoteVersion, RemoteVersion, request.Version)}
+	}
+
+	switch request.Command {
+	case RemoteCheck:
+		return &RemoteReply{BruteVersion: version, Project: projectName, Platform: Platform()}
+	case RemoteStatus:
+		status := Status()
+		return &RemoteReply{BruteVersion: version, Project: projectName, Status: &status}
+	case RemotePush:
+		Info("Receiving a bundle", "remote", from.String(), "size", request.Size, "hash", request.Hash)
+		reply, err := control.push(r, request)
+		if err != nil {
+			LogError(ErrorLog{err, fmt.Sprintf("Could not activate the bundle from %s: %v", from, err)})
+			return &RemoteReply{Error: err.Error()}
+		}
+		return reply
+	default:
+		return &RemoteReply{Error: unknownRemoteCommandError.Error()}
+	}
+}
+
+// push receives a bundle, unpacks it as a release under bin/releases and
+// switches the master to it at once.
+func (control *RemoteControl) push(r io.Reader, request *RemoteRequest) (*RemoteReply, error) {
+	if request.Size <= 0 || request.Size > maxBundleSize {
+		return nil, bundleTooLargeError
+	}
+	if len(request.Hash) != sha256.Size*2 {
+		return nil, bundleHashMismatchError
+	}
+
+	control.mutex.Lock()
+	defer control.mutex.Unlock()
+
+	bin := filepath.Join(control.Dir, "bin")
+	if err := os.MkdirAll(bin, 0700); err != nil {
+		return nil, err
+	}
+
+	incoming, err := ioutil.TempFile(bin, ".incoming-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(incoming.Name())
+	defer incoming.Close()
+
+	h := sha256.New()
+	if _, err := io.CopyN(io.MultiWriter(incoming, h), r, request.Size); err != nil {
+		return nil, err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != request.Hash {
+		return nil, bundleHashMismatchError
+	}
+	if _, err := incoming.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	release, config, manifest, err := installRelease(bin, incoming, request.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if err := activateRelease(bin, release); err != nil {
+		return nil, err
+	}
+	id := filepath.Base(release)
+	Log(fmt.Sprintf("Activated release %s, version %s of %s", id, manifest.Version, manifest.Project))
+
+	reply := &RemoteReply{BruteVersion: version, Project: projectName, Platform: Platform(), Release: id}
+	served := make(map[string]Route)
+	if activeConfig != nil {
+		for _, route := range activeConfig.Routes {
+			served[route.Directory] = route
+		}
+	}
+
+	var reload []Route
+	for _, route := range config.Routes {
+		current, ok := served[route.Directory]
+		if !ok {
+			reply.Pending = append(reply.Pending, route.Directory)
+			continue
+		}
+		delete(served, route.Directory)
+		reload = append(reload, current)
+		reply.Restarted = append(reply.Restarted, route.Directory)
+		if changes := routeChanges(current, route); len(changes) > 0 {
+			reply.Pending = append(reply.Pending, fmt.Sprintf("%s (%s changed)", route.Directory, strings.Join(changes, ", ")))
+		}
+	}
+	if activeConfig != nil {
+		for _, route := range activeConfig.Routes {
+			if _, ok := served[route.Directory]; ok {
+				reply.Pending = append(reply.Pending, route.Directory+" (removed)")
+			}
+		}
+	}
+
+	// The authorizer and the root endpoint switch along with the routes
+	var authorizer, pushedAuthorizer string
+	if activeConfig != nil && activeConfig.Authorizer != nil {
+		authorizer = *activeConfig.Authorizer
+	}
+	if config.Authorizer != nil {
+		pushedAuthorizer = *config.Authorizer
+	}
+	if authorizer != "" && authorizer == pushedAuthorizer {
+		reload = append(reload, Route{Directory: authorizer, config: activeConfig})
+		reply.Restarted = append(reply.Restarted, authorizer)
+	} else if authorizer != pushedAuthorizer {
+		reply.Pending = append(reply.Pending, "authorizer")
+	}
+	if _, ok := endpoints.Map.Load("root"); ok {
+		if regularFile(filepath.Join(release, bundleEndpoints, "root")) {
+			reload = append(reload, Route{Directory: "root"})
+			reply.Restarted = append(reply.Restarted, "root")
+		} else {
+			reply.Pending = append(reply.Pending, "root (removed)")
+		}
+	}
+
+	if control.Reload != nil && len(reload) > 0 {
+		control.Reload(reload)
+	}
+	return reply, nil
+}
+
+// routeChanges lists the settings of the served route current that the
+// route next of a release changes, but a restart of the endpoint does not.
+func routeChanges(current, next Route) []string {
+	var changes []string
+	if current.Path != next.Path {
+		changes = append(changes, "path")
+	}
+	if isProtected(current) != isProtected(next) {
+		changes = append(changes, "protection")
+	}
+	if current.replicas() != next.replicas() {
+		changes = append(changes, "replicas")
+	}
+	return changes
+}
+
+func isProtected(route Route) bool {
+	return route.RouteConfig != nil && route.Protected
+}
+
+// reloadEndpoints restarts the processes of routes on their new binaries.
+// The current processes serve until the new ones are connected.
+func reloadEndpoints(routes []Route) {
+	for _, route := range routes {
+		recordBuild(route.Directory, endpointBinary(route.Directory))
+		endpointRestarts.Inc(route.Directory)
+
+		if _, ok := endpoints.Map.Load(route.Directory); ok {
+			reloadReplicas(route)
+		}
+		StartEndpoint(route)
+	}
+}
+
+// readJsonLine decodes the JSON value on the next line of r, leaving what
+// follows it, e.g. a bundle, in r.
+func readJsonLine(r *bufio.Reader, v interface{}) error {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(line, v)
+}
+
+// remoteClient talks to a remote master on a single connection.
+type remoteClient struct {
+	conn      net.Conn
+	r         *bufio.Reader
+	challenge RemoteChallenge
+}
+
+func dialRemote(url string) (*remoteClient, error) {
+	address, err := RemoteAddress(url)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialTimeout("tcp", address, remoteDialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("remote %s is unreachable: %v", address, err)
+	}
+	conn.SetDeadline(time.Now().Add(remoteTimeout))
+
+	client := &remoteClient{conn: conn, r: bufio.NewReader(conn)}
+	if err := readJsonLine(client.r, &client.challenge); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s does not speak the remote control protocol: %v", address, err)
+	}
+	if client.challenge.MinVersion > RemoteVersion || client.challenge.Version < MinRemoteVersion {
+		conn.Close()
+		return nil, fmt.Errorf("the remote master speaks remote control versions %d to %d but this brute speaks %d to %d; update brute on either side",
+			client.challenge.MinVersion, client.challenge.Version, MinRemoteVersion, RemoteVersion)
+	}
+	return client, nil
+}
+
+func (client *remoteClient) request(token string, request *RemoteRequest, body io.Reader) (*RemoteReply, error) {
+	defer client.conn.Close()
+
+	request.Version = RemoteVersion
+	if client.challenge.Version < request.Version {
+		request.Version = client.challenge.Version
+	}
+	request.Mac = remoteMac(token, client.challenge.Nonce, request)
+
+	if err := json.NewEncoder(client.conn).Encode(request); err != nil {
+		return nil, err
+	}
+	if body != nil {
+		if _, err := io.CopyN(client.conn, body, request.Size); err != nil {
+			return nil, err
+		}
+	}
+
+	var reply RemoteReply
+	if err := json.NewDecoder(client.r).Decode(&reply); err != nil {
+		return nil, err
+	}
+	if reply.Error != "" {
+		return &reply, errors.New(reply.Error)
+	}
+	return &reply, nil
+}
+
+// CheckRemote authenticates with the remote master at url and returns what
+// it reports of itself.
+func CheckRemote(url, token string) (*RemoteReply, error) {
+	client, err := dialRemote(url)
+	if err != nil {
+		return nil, err
+	}
+	return client.request(token, &RemoteRequest{Command: RemoteCheck}, nil)
+}
+
+// RemoteMasterStatus returns the status of the remote master at url.
+func RemoteMasterStatus(url, token string) (*RemoteReply, error) {
+	client, err := dialRemote(url)
+	if err != nil {
+		return nil, err
+	}
+	return client.request(token, &RemoteRequest{Command: RemoteStatus}, nil)
+}
+
+// PushBundle sends the bundle file, as built by BuildBundle, to the remote
+// master at url, which activates it. Archives without a manifest are not
+// sent.
+func PushBundle(url, token, bundle string) (*RemoteReply, error) {
+	f, err := os.Open(bundle)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if _, err := readManifest(f); err != nil {
+		return nil, fmt.Errorf("%s is not a bundle built by brute build: %v", bundle, err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	client, err := dialRemote(url)
+	if err != nil {
+		return nil, err
+	}
+	request := &RemoteRequest{Command: RemotePush, Hash: hex.EncodeToString(h.Sum(nil)), Size: size}
+	return client.request(token, request, f)
+}
@@ -0,0 +1,430 @@
+package brute
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rrborja/brute/client"
+	"github.com/stretchr/testify/assert"
+)
+
+// testMaster lays out the project of a master that built its endpoints
+// in a new directory.
+func testMaster(t *testing.T, endpoints ...string) string {
+	dir, err := ioutil.TempDir("", "brute")
+	assert.NoError(t, err)
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "bin", "endpoints"), 0700))
+	for _, endpoint := range endpoints {
+		binary := filepath.Join(dir, "bin", "endpoints", endpoint)
+		assert.NoError(t, ioutil.WriteFile(binary, []byte("#!/bin/sh\n# built\n"), 0700))
+	}
+	return dir
+}
+
+// testBundle archives a bundle of the project config with the given
+// endpoints, built for this machine.
+func testBundle(t *testing.T, config string, endpoints ...string) string {
+	return testBundleFor(t, runtime.GOOS, runtime.GOARCH, config, endpoints...)
+}
+
+// testBundleFor archives a bundle built for another platform.
+func testBundleFor(t *testing.T, goos, goarch, config string, endpoints ...string) string {
+	binaries := make(map[string]string, len(endpoints))
+	for _, endpoint := range endpoints {
+		binaries[endpoint] = "#!/bin/sh\n# " + endpoint + "\n"
+	}
+	return archiveTestBundle(t, goos, goarch, config, binaries)
+}
+
+// archiveTestBundle archives a bundle of the project config with the given
+// endpoint binaries by their name.
+func archiveTestBundle(t *testing.T, goos, goarch, config string, binaries map[string]string) string {
+	staging, err := ioutil.TempDir("", "brute")
+	assert.NoError(t, err)
+	defer os.RemoveAll(staging)
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(staging, bundleEndpoints), 0700))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(staging, bundleConfig), []byte(config), 0600))
+	for endpoint, binary := range binaries {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(staging, bundleEndpoints, endpoint), []byte(binary), 0700))
+	}
+	assert.NoError(t, writeManifest(staging, &Manifest{Project: "shop", Version: "1", GOOS: goos, GOARCH: goarch}))
+
+	f, err := ioutil.TempFile("", "brute-bundle-")
+	assert.NoError(t, err)
+	defer f.Close()
+
+	assert.NoError(t, WriteBundle(f, staging))
+	return f.Name()
+}
+
+// startRemote starts the remote control of a second master serving the
+// project in dir.
+func startRemote(t *testing.T, dir string, reloaded chan<- []Route) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	control := &RemoteControl{Dir: dir, Token: "secret", Reload: func(routes []Route) {
+		reloaded <- routes
+	}}
+	go control.Serve(l)
+	return l.Addr().String(), func() { l.Close() }
+}
+
+const remoteProject = `name: shop
+routes:
+- path: /
+  directory: home
+- path: /users
+  directory: users
+`
+
+func TestPushActivatesTheBundleOnTheRemote(t *testing.T) {
+	remote := testMaster(t, "home")
+	defer os.RemoveAll(remote)
+
+	activeConfig = &Config{Routes: []Route{{Path: "/", Directory: "home"}}}
+	defer func() {
+		activeConfig = nil
+		prebuilt = 0
+	}()
+
+	reloaded := make(chan []Route, 1)
+	address, stop := startRemote(t, remote, reloaded)
+	defer stop()
+
+	reply, err := CheckRemote(address, "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, RemoteVersion, reply.Version)
+
+	bundle := testBundle(t, remoteProject, "home", "users")
+	defer os.Remove(bundle)
+
+	reply, err = PushBundle(address, "secret", bundle)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, reply.Release, 12)
+	assert.Equal(t, []string{"home"}, reply.Restarted)
+	assert.Equal(t, []string{"users"}, reply.Pending)
+	routes := <-reloaded
+	assert.Equal(t, "home", routes[0].Directory)
+
+	current := filepath.Join(remote, "bin", currentRelease)
+	target, err := os.Readlink(current)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join("releases", reply.Release), target)
+
+	data, err := ioutil.ReadFile(filepath.Join(current, "endpoints", "users"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "# users")
+
+	// The endpoints the remote built itself are left where they are
+	data, err = ioutil.ReadFile(filepath.Join(remote, "bin", "endpoints", "home"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "# built")
+
+	// Pushing the same bundle again switches to the same release
+	again, err := PushBundle(address, "secret", bundle)
+	assert.NoError(t, err)
+	assert.Equal(t, reply.Release, again.Release)
+	<-reloaded
+}
+
+func TestPushRestartsTheRootEndpointAndTheAuthorizer(t *testing.T) {
+	remote := testMaster(t, "home", "users", "auth", "root")
+	defer os.RemoveAll(remote)
+
+	authorizer := "auth"
+	activeConfig = &Config{Authorizer: &authorizer, Routes: []Route{
+		{Path: "/", Directory: "home"},
+		{Path: "/users", Directory: "users", RouteConfig: &RouteConfig{Protected: true}},
+	}}
+	endpoints.Store("root", newReplicaSet(Route{Directory: "root"}))
+	defer func() {
+		activeConfig = nil
+		prebuilt = 0
+		endpoints.Delete("root")
+	}()
+
+	reloaded := make(chan []Route, 1)
+	address, stop := startRemote(t, remote, reloaded)
+	defer stop()
+
+	project := `name: shop
+authorizer: auth
+routes:
+- path: /
+  directory: home
+  config:
+    replicas: 2
+- path: /accounts
+  directory: users
+`
+	bundle := testBundle(t, project, "home", "users", "auth", "root")
+	defer os.Remove(bundle)
+
+	reply, err := PushBundle(address, "secret", bundle)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"home", "users", "auth", "root"}, reply.Restarted)
+	assert.Equal(t, []string{"home (replicas changed)", "users (path, protection changed)"}, reply.Pending)
+
+	routes := <-reloaded
+	if assert.Len(t, routes, 4) {
+		// The routes keep the settings they are served with
+		assert.Equal(t, "/users", routes[1].Path)
+		assert.Equal(t, activeConfig, routes[2].config)
+		assert.Equal(t, Route{Directory: "root"}, routes[3])
+	}
+}
+
+func TestRemoteRejectsUnauthenticatedRequests(t *testing.T) {
+	remote := testMaster(t, "home", "users")
+	defer os.RemoveAll(remote)
+
+	address, stop := startRemote(t, remote, nil)
+	defer stop()
+
+	_, err := CheckRemote(address, "guess")
+	assert.Error(t, err)
+
+	bundle := testBundle(t, remoteProject, "home", "users")
+	defer os.Remove(bundle)
+	_, err = PushBundle(address, "guess", bundle)
+	assert.Error(t, err)
+
+	_, err = os.Stat(filepath.Join(remote, "bin", "releases"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestIncompleteBundlesAreNotActivated(t *testing.T) {
+	remote := testMaster(t, "home", "users")
+	defer os.RemoveAll(remote)
+
+	address, stop := startRemote(t, remote, nil)
+	defer stop()
+
+	bundle := testBundle(t, remoteProject, "home")
+	defer os.Remove(bundle)
+
+	_, err := PushBundle(address, "secret", bundle)
+	assert.Error(t, err)
+
+	_, err = os.Lstat(filepath.Join(remote, "bin", currentRelease))
+	assert.True(t, os.IsNotExist(err))
+	assert.False(t, runsPrebuilt())
+}
+
+func TestBundlesOfAnotherPlatformAreNotActivated(t *testing.T) {
+	remote := testMaster(t, "home", "users")
+	defer os.RemoveAll(remote)
+
+	address, stop := startRemote(t, remote, nil)
+	defer stop()
+
+	goos := "linux"
+	if runtime.GOOS == goos {
+		goos = "darwin"
+	}
+	bundle := testBundleFor(t, goos, runtime.GOARCH, remoteProject, "home", "users")
+	defer os.Remove(bundle)
+
+	_, err := PushBundle(address, "secret", bundle)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "built for "+goos+"/"+runtime.GOARCH)
+	}
+
+	_, err = os.Lstat(filepath.Join(remote, "bin", currentRelease))
+	assert.True(t, os.IsNotExist(err))
+	releases, err := ioutil.ReadDir(filepath.Join(remote, "bin", "releases"))
+	assert.NoError(t, err)
+	assert.Len(t, releases, 0)
+}
+
+func TestOnlyBuiltBundlesArePushed(t *testing.T) {
+	remote := testMaster(t, "home", "users")
+	defer os.RemoveAll(remote)
+
+	reloaded := make(chan []Route, 1)
+	address, stop := startRemote(t, remote, reloaded)
+	defer stop()
+
+	staging, err := ioutil.TempDir("", "brute")
+	assert.NoError(t, err)
+	defer os.RemoveAll(staging)
+	assert.NoError(t, os.MkdirAll(filepath.Join(staging, bundleEndpoints), 0700))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(staging, bundleConfig), []byte(remoteProject), 0600))
+
+	f, err := ioutil.TempFile("", "brute-bundle-")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	assert.NoError(t, WriteBundle(f, staging))
+	f.Close()
+
+	_, err = PushBundle(address, "secret", f.Name())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "not a bundle built by brute build")
+	}
+	assert.Len(t, reloaded, 0)
+
+	_, err = os.Stat(filepath.Join(remote, "bin", "releases"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRemoteAddress(t *testing.T) {
+	for url, expected := range map[string]string{
+		"192.168.1.152":          "192.168.1.152:" + DefaultRemotePort,
+		"example.com:9000":       "example.com:9000",
+		"tcp://example.com:9000": "example.com:9000",
+		"[::1]":                  "[::1]:" + DefaultRemotePort,
+	} {
+		address, err := RemoteAddress(url)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, address)
+	}
+
+	_, err := RemoteAddress("http://example.com/deploy")
+	assert.Error(t, err)
+}
+
+// releaseEnv tells the test binary to run as an endpoint answering with
+// the release it belongs to.
+const releaseEnv = "BRUTE_TEST_RELEASE"
+
+func TestHelperEndpoint(t *testing.T) {
+	release := os.Getenv(releaseEnv)
+	if release == "" {
+		t.Skip("runs as an endpoint of TestPushToARunningMaster")
+	}
+
+	client.RunHTTP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(release))
+	}))
+}
+
+// endpointBundle archives a bundle serving / with the test binary, as
+// release.
+func endpointBundle(t *testing.T, release string) string {
+	executable, err := os.Executable()
+	assert.NoError(t, err)
+
+	home := fmt.Sprintf("#!/bin/sh\n%s=%s exec %s -test.run='^TestHelperEndpoint$'\n", releaseEnv, release, executable)
+	return archiveTestBundle(t, runtime.GOOS, runtime.GOARCH, "name: shop\nroutes:\n- path: /\n  directory: home\n", map[string]string{"home": home})
+}
+
+func TestPushToARunningMaster(t *testing.T) {
+	dir, err := ioutil.TempDir("", "brute")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	previous := cwd
+	cwd = dir
+	defer func() {
+		cwd = previous
+		prebuilt = 0
+		activeConfig = nil
+		resetRouteHealths()
+	}()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	address := l.Addr().String()
+	l.Close()
+
+	// The second master runs from a first release
+	v1 := endpointBundle(t, "v1")
+	defer os.Remove(v1)
+	config, err := OpenBundle(v1)
+	if !assert.NoError(t, err) {
+		return
+	}
+	config.RemoteControl = &RemoteControlConfig{Listen: address}
+
+	New(config)
+	RunEndpointService()
+	StartEndpoints(config)
+	serveRemoteControl(config)
+	defer func() {
+		RemoveEndpoint("home")
+		removedEndpoints.Delete("home")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		children.Wait(ctx)
+	}()
+
+	home := &ControllerEndpoint{Route: config.Routes[0]}
+	get := func() string {
+		w := httptest.NewRecorder()
+		home.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		return w.Body.String()
+	}
+	waitFor := func(release string) bool {
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+			if RouteStateOf("home") == StateConnected && get() == release {
+				return true
+			}
+		}
+		return false
+	}
+	if !assert.True(t, waitFor("v1")) {
+		return
+	}
+
+	// Requests keep being served by either release during the push
+	stop := make(chan struct{})
+	answers := make(chan string, 1024)
+	go func() {
+		defer close(answers)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				answers <- get()
+			}
+		}
+	}()
+
+	token, err := ioutil.ReadFile(defaultRemoteTokenFile)
+	assert.NoError(t, err)
+
+	v2 := endpointBundle(t, "v2")
+	defer os.Remove(v2)
+	reply, err := PushBundle(address, strings.TrimSpace(string(token)), v2)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"home"}, reply.Restarted)
+		assert.True(t, waitFor("v2"))
+	}
+
+	close(stop)
+	for answer := range answers {
+		if answer != "v1" && answer != "v2" {
+			t.Errorf("Unexpected answer %q while activating the release", answer)
+			break
+		}
+	}
+
+	// The replica of the first release exits once replaced
+	for deadline := time.Now().Add(5 * time.Second); children.Len() > 1 && time.Now().Before(deadline); {
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Equal(t, 1, children.Len())
+}
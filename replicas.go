@@ -0,0 +1,248 @@
+package brute
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/rrborja/brute/log"
+)
+
+const (
+	BalanceRoundRobin    = "round_robin"
+	BalanceLeastInFlight = "least_in_flight"
+)
+
+// replicaCookiePrefix names the cookie pinning a client to a replica of a
+// route when the route is sticky.
+const replicaCookiePrefix = "brute-replica-"
+
+var replicaSetWriteError = errors.New("write to one of the replicas instead of the replica set")
+
+// ReplicaSet holds the connected processes of one route and spreads the
+// sessions of the route across them.
+type ReplicaSet struct {
+	// next is the round robin counter. It comes first to stay 64-bit
+	// aligned for sync/atomic.
+	next uint64
+
+	Route
+
+	replicas []*ConnWrite
+	lastId   uint64
+	mutex    sync.RWMutex
+}
+
+func newReplicaSet(route Route) *ReplicaSet {
+	return &ReplicaSet{Route: route}
+}
+
+// replicas is the number of processes started for route.
+func (route Route) replicas() int {
+	if route.RouteConfig == nil || route.Replicas < 1 {
+		return 1
+	}
+	return route.Replicas
+}
+
+// Add registers a replica. When the set is already complete the oldest
+// replica is replaced, as happens when an endpoint process is restarted.
+func (set *ReplicaSet) Add(replica *ConnWrite) {
+	set.mutex.Lock()
+
+	set.lastId++
+	replica.id = strconv.FormatUint(set.lastId, 10)
+	replica.connected = time.Now()
+
+	var evicted *ConnWrite
+	if len(set.replicas) >= set.Route.replicas() {
+		evicted = set.replicas[0]
+		set.replicas = set.replicas[1:]
+	}
+	set.replicas = append(set.replicas, replica)
+
+	set.mutex.Unlock()
+
+	if evicted != nil {
+		Log(fmt.Sprintf("Endpoint %s registered again. Replacing its replica %s", set.Directory, evicted.id))
+		evicted.Close()
+	}
+}
+
+// Remove drops a replica, e.g. once its connection closed.
+func (set *ReplicaSet) Remove(replica *ConnWrite) {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	for i, candidate := range set.replicas {
+		if candidate == replica {
+			set.replicas = append(set.replicas[:i:i], set.replicas[i+1:]...)
+			Log(fmt.Sprintf("Removed replica %s of endpoint %s (pid %d)", replica.id, set.Directory, replica.pid()))
+			return
+		}
+	}
+}
+
+func (set *ReplicaSet) Len() int {
+	set.mutex.RLock()
+	defer set.mutex.RUnlock()
+
+	return len(set.replicas)
+}
+
+// InFlight is the number of requests the replicas are serving.
+func (set *ReplicaSet) InFlight() (n int64) {
+	set.mutex.RLock()
+	defer set.mutex.RUnlock()
+
+	for _, replica := range set.replicas {
+		n += atomic.LoadInt64(&replica.inFlight)
+	}
+	return
+}
+
+// Pick chooses the replica serving a request, or returns nil if none is
+// connected. A sticky route keeps the client on the replica named by its
+// cookie for as long as that replica lives.
+func (set *ReplicaSet) Pick(w http.ResponseWriter, r *http.Request) *ConnWrite {
+	set.mutex.RLock()
+	defer set.mutex.RUnlock()
+
+	if len(set.replicas) == 0 {
+		return nil
+	}
+
+	sticky := set.RouteConfig != nil && set.Sticky
+	cookieName := replicaCookiePrefix + set.Directory
+
+	if sticky {
+		if cookie, err := r.Cookie(cookieName); err == nil {
+			for _, replica := range set.replicas {
+				if replica.id == cookie.Value {
+					return replica
+				}
+			}
+		}
+	}
+
+	var replica *ConnWrite
+	if set.RouteConfig != nil && set.Balance == BalanceLeastInFlight {
+		for _, candidate := range set.replicas {
+			if replica == nil || atomic.LoadInt64(&candidate.inFlight) < atomic.LoadInt64(&replica.inFlight) {
+				replica = candidate
+			}
+		}
+	} else {
+		replica = set.replicas[(atomic.AddUint64(&set.next, 1)-1)%uint64(len(set.replicas))]
+	}
+
+	if sticky {
+		path := set.Path
+		if path == "" {
+			path = "/"
+		}
+		http.SetCookie(w, &http.Cookie{Name: cookieName, Value: replica.id, Path: path, HttpOnly: true})
+	}
+
+	return replica
+}
+
+// Close closes every replica of the set.
+func (set *ReplicaSet) Close() error {
+	set.mutex.Lock()
+	replicas := set.replicas
+	set.replicas = nil
+	set.mutex.Unlock()
+
+	var err error
+	for _, replica := range replicas {
+		if closeErr := replica.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (set *ReplicaSet) Write(data []byte) (int, error) {
+	return 0, replicaSetWriteError
+}
+
+func (connWriter *ConnWrite) pid() int {
+	if connWriter.Hello == nil {
+		return 0
+	}
+	return connWriter.Hello.PID
+}
+
+// watchReplica returns once the replica's connection closes and removes the
+// replica from its set. Multiplexed replicas are read by their data plane,
+// the others never send anything after the handshake.
+func watchReplica(set *ReplicaSet, connWriter *ConnWrite) {
+	if connWriter.Multiplexed() {
+		serveDataPlane(set.Directory, connWriter)
+	} else {
+		io.Copy(ioutil.Discard, connWriter.Conn)
+	}
+	set.Remove(connWriter)
+}
+
+// reloading holds, by route, the replica set of the processes started on
+// new binaries while the current ones keep serving. The set replaces the
+// current one once all its replicas are connected.
+var reloading = struct {
+	sync.Mutex
+	sets map[string]*ReplicaSet
+}{sets: make(map[string]*ReplicaSet)}
+
+// reloadReplicas has the next processes started for route join a new
+// replica set instead of the one serving.
+func reloadReplicas(route Route) {
+	reloading.Lock()
+	defer reloading.Unlock()
+
+	reloading.sets[route.Directory] = newReplicaSet(route)
+}
+
+// registerReplica adds a freshly connected endpoint process to the replica
+// set of its route, creating the set if the route was not started with
+// StartEndpoint or only has a debug page so far.
+func registerReplica(routeDirectory string, connWriter *ConnWrite) *ReplicaSet {
+	reloading.Lock()
+	if set, ok := reloading.sets[routeDirectory]; ok {
+		set.Add(connWriter)
+		if set.Len() < set.Route.replicas() {
+			reloading.Unlock()
+			return set
+		}
+		delete(reloading.sets, routeDirectory)
+		previous, _ := endpoints.Map.Load(routeDirectory)
+		endpoints.Store(routeDirectory, set)
+		reloading.Unlock()
+
+		Log(fmt.Sprintf("Endpoint %s serves from its new replicas", routeDirectory))
+		if previous, ok := previous.(*ReplicaSet); ok {
+			// The replaced replicas exit once their sessions are closed
+			previous.Shutdown()
+		}
+		return set
+	}
+	reloading.Unlock()
+
+	var set *ReplicaSet
+	if previous, ok := endpoints.Map.Load(routeDirectory); ok {
+		set, _ = previous.(*ReplicaSet)
+	}
+	if set == nil {
+		set = newReplicaSet(Route{Directory: routeDirectory})
+		endpoints.Store(routeDirectory, set)
+	}
+
+	set.Add(connWriter)
+	return set
+}
@@ -0,0 +1,88 @@
+package brute
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestReplica() *ConnWrite {
+	conn, _ := net.Pipe()
+	return &ConnWrite{Mutex: new(sync.Mutex), Conn: conn}
+}
+
+func pick(set *ReplicaSet, cookies ...*http.Cookie) (*ConnWrite, *httptest.ResponseRecorder) {
+	r := httptest.NewRequest(http.MethodGet, "/home", nil)
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	return set.Pick(w, r), w
+}
+
+func TestReplicasAreRoundRobin(t *testing.T) {
+	set := newReplicaSet(Route{Directory: "home", RouteConfig: &RouteConfig{Replicas: 2}})
+	first, second := newTestReplica(), newTestReplica()
+	set.Add(first)
+	set.Add(second)
+
+	var picked []*ConnWrite
+	for i := 0; i < 4; i++ {
+		replica, _ := pick(set)
+		picked = append(picked, replica)
+	}
+	assert.Equal(t, []*ConnWrite{first, second, first, second}, picked)
+
+	set.Remove(first)
+	replica, _ := pick(set)
+	assert.Equal(t, second, replica)
+
+	set.Remove(second)
+	replica, _ = pick(set)
+	assert.Nil(t, replica)
+}
+
+func TestLeastInFlightReplica(t *testing.T) {
+	set := newReplicaSet(Route{Directory: "home", RouteConfig: &RouteConfig{Replicas: 2, Balance: BalanceLeastInFlight}})
+	busy, idle := newTestReplica(), newTestReplica()
+	busy.inFlight = 3
+	set.Add(busy)
+	set.Add(idle)
+
+	replica, _ := pick(set)
+	assert.Equal(t, idle, replica)
+}
+
+func TestStickyReplica(t *testing.T) {
+	set := newReplicaSet(Route{Path: "/home", Directory: "home", RouteConfig: &RouteConfig{Replicas: 2, Sticky: true}})
+	set.Add(newTestReplica())
+	set.Add(newTestReplica())
+
+	replica, w := pick(set)
+	cookies := w.Result().Cookies()
+	assert.Len(t, cookies, 1)
+	assert.Equal(t, replica.id, cookies[0].Value)
+
+	for i := 0; i < 3; i++ {
+		pinned, _ := pick(set, cookies[0])
+		assert.Equal(t, replica, pinned)
+	}
+}
+
+func TestExtraReplicaReplacesOldest(t *testing.T) {
+	set := newReplicaSet(Route{Directory: "home"})
+	old, restarted := newTestReplica(), newTestReplica()
+	set.Add(old)
+	set.Add(restarted)
+
+	assert.Equal(t, 1, set.Len())
+	replica, _ := pick(set)
+	assert.Equal(t, restarted, replica)
+
+	_, err := old.Write([]byte("closed"))
+	assert.Error(t, err)
+}
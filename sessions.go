@@ -0,0 +1,180 @@
+package brute
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	. "github.com/rrborja/brute/log"
+)
+
+var (
+	noSuchSessionError  = errors.New("no such request session")
+	sessionClosedError  = errors.New("request session is closed")
+	sessionExpiredError = errors.New("request session expired before the endpoint answered")
+)
+
+// defaultSessionTimeout applies to routes without a timeout in their config.
+const defaultSessionTimeout = 2 * time.Minute
+
+const sessionShards = 32
+
+// RequestSession keeps the sessions in flight between ServeHTTP and the
+// endpoints. Session IDs are random, so the first byte spreads them evenly
+// over the shards, each with its own lock.
+type RequestSession struct {
+	shards [sessionShards]sessionShard
+}
+
+type sessionShard struct {
+	store map[[32]byte]*ContextHolder
+	mutex sync.RWMutex
+}
+
+func (sessions *RequestSession) shard(id [32]byte) *sessionShard {
+	return &sessions.shards[int(id[0])%sessionShards]
+}
+
+func (sessions *RequestSession) Add(id [32]byte, session *ContextHolder) {
+	shard := sessions.shard(id)
+
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if shard.store == nil {
+		shard.store = make(map[[32]byte]*ContextHolder)
+	}
+	shard.store[id] = session
+}
+
+func (sessions *RequestSession) Get(id [32]byte) (*ContextHolder, error) {
+	shard := sessions.shard(id)
+
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+
+	session, ok := shard.store[id]
+	if !ok {
+		return nil, noSuchSessionError
+	}
+	return session, nil
+}
+
+func (sessions *RequestSession) Remove(id [32]byte) {
+	shard := sessions.shard(id)
+
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	delete(shard.store, id)
+}
+
+// Len counts the sessions in flight.
+func (sessions *RequestSession) Len() (n int) {
+	for i := range sessions.shards {
+		shard := &sessions.shards[i]
+		shard.mutex.RLock()
+		n += len(shard.store)
+		shard.mutex.RUnlock()
+	}
+	return
+}
+
+// NewSessionId returns 256 random bits.
+func NewSessionId() (sid [32]byte, err error) {
+	_, err = rand.Read(sid[:])
+	return
+}
+
+func newContextHolder(route Route) *ContextHolder {
+	return &ContextHolder{Route: route, Stream: make(chan *EchoPacket, 100), done: make(chan struct{})}
+}
+
+// send passes a packet to Delegate, giving up once the session ends.
+func (session *ContextHolder) send(packet *EchoPacket) error {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	if session.closed {
+		return sessionClosedError
+	}
+
+	select {
+	case session.Stream <- packet:
+	case <-session.done:
+		return sessionClosedError
+	}
+
+	if session.timer != nil {
+		session.timer.Reset(session.timeout)
+	}
+	return nil
+}
+
+// end closes the stream so Delegate returns once it has written what was
+// sent so far. It reports whether this call ended the session.
+func (session *ContextHolder) end(expired bool) bool {
+	ended := false
+	session.once.Do(func() {
+		session.expired = expired
+		close(session.done)
+		ended = true
+	})
+	if !ended {
+		return false
+	}
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	session.closed = true
+	close(session.Stream)
+	return true
+}
+
+// expire ends the session without the endpoint closing it, which happens
+// when the endpoint stays silent for longer than the route timeout or the
+// HTTP client goes away.
+func (session *ContextHolder) expire(reason string) {
+	if session.end(true) {
+		Log(fmt.Sprintf("Request session of endpoint %s ended: %s", session.Route.Directory, reason))
+	}
+}
+
+// watch ends the session when it idles for longer than the route timeout
+// or the HTTP client disconnects.
+func (session *ContextHolder) watch(clientGone <-chan struct{}) (stop func()) {
+	session.timeout = session.Route.timeout()
+	session.timer = time.AfterFunc(session.timeout, func() {
+		session.expire(fmt.Sprintf("no response for %v", session.timeout))
+	})
+
+	go func() {
+		select {
+		case <-clientGone:
+			session.expire("client disconnected")
+		case <-session.done:
+		}
+	}()
+
+	return func() {
+		session.timer.Stop()
+		session.end(false)
+	}
+}
+
+// timeout is how long a session of the route may wait for its endpoint.
+func (route Route) timeout() time.Duration {
+	if route.RouteConfig == nil || route.Timeout == "" {
+		return defaultSessionTimeout
+	}
+
+	timeout, err := time.ParseDuration(route.Timeout)
+	if err != nil || timeout <= 0 {
+		LogError(ErrorLog{err, fmt.Sprintf("Invalid timeout %q for endpoint %s", route.Timeout, route.Directory)})
+		return defaultSessionTimeout
+	}
+	return timeout
+}
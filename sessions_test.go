@@ -0,0 +1,70 @@
+package brute
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnknownSessionIsAnError(t *testing.T) {
+	var sessions RequestSession
+	var ack bool
+
+	sid, err := NewSessionId()
+	assert.NoError(t, err)
+
+	assert.Equal(t, noSuchSessionError, sessions.Write(&EchoPacket{SessionId: sid}, &ack))
+	assert.Equal(t, noSuchSessionError, sessions.Close(&EchoPacket{SessionId: sid}, &ack))
+	assert.Equal(t, noSuchSessionError, sessions.AcceptRpc(sid, new(RpcRequest)))
+}
+
+func TestSessionLifecycle(t *testing.T) {
+	var sessions RequestSession
+	var ack bool
+
+	sid, _ := NewSessionId()
+	session := newContextHolder(Route{Directory: "home"})
+	sessions.Add(sid, session)
+	assert.Equal(t, 1, sessions.Len())
+
+	assert.NoError(t, sessions.Write(&EchoPacket{SessionId: sid, Body: []byte("brute")}, &ack))
+	assert.NoError(t, sessions.Close(&EchoPacket{SessionId: sid}, &ack))
+
+	assert.Equal(t, sessionClosedError, sessions.Close(&EchoPacket{SessionId: sid}, &ack))
+	assert.Equal(t, sessionClosedError, sessions.Write(&EchoPacket{SessionId: sid}, &ack))
+
+	var packets int
+	for range session.Stream {
+		packets++
+	}
+	assert.Equal(t, 1, packets)
+	assert.False(t, session.expired)
+
+	sessions.Remove(sid)
+	assert.Equal(t, 0, sessions.Len())
+}
+
+func TestSilentSessionExpires(t *testing.T) {
+	session := newContextHolder(Route{Directory: "home", RouteConfig: &RouteConfig{Timeout: "10ms"}})
+	stop := session.watch(nil)
+	defer stop()
+
+	select {
+	case _, open := <-session.Stream:
+		assert.False(t, open)
+	case <-time.After(time.Second):
+		t.Fatal("the session did not expire")
+	}
+	assert.True(t, session.expired)
+}
+
+func TestSessionIdsAreDistinct(t *testing.T) {
+	seen := make(map[[32]byte]bool)
+	for i := 0; i < 1000; i++ {
+		sid, err := NewSessionId()
+		assert.NoError(t, err)
+		assert.False(t, seen[sid])
+		seen[sid] = true
+	}
+}
@@ -0,0 +1,233 @@
+package brute
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/rrborja/brute/protocol"
+	. "github.com/rrborja/brute/log"
+)
+
+// ShutdownTimeout bounds how long the master waits for sessions to drain
+// and endpoints to exit before killing them.
+var ShutdownTimeout = 30 * time.Second
+
+// killGrace is how long an endpoint may take to exit after SIGTERM.
+const killGrace = 2 * time.Second
+
+var (
+	shuttingDown int32
+	shutdownDone = make(chan struct{})
+)
+
+var (
+	servers      []*http.Server
+	listeners    []net.Listener
+	serversMutex sync.Mutex
+)
+
+// children holds the endpoint processes spawned by this master.
+var children = &Children{running: make(map[int]*exec.Cmd), exited: make(chan struct{}, 1)}
+
+type Children struct {
+	running map[int]*exec.Cmd
+	mutex   sync.Mutex
+	exited  chan struct{}
+}
+
+// Track reaps cmd once it exits, keeping it until then for Wait, and calls
+// exited, if any, with the error of the exit.
+func (children *Children) Track(cmd *exec.Cmd, exited func(err error)) {
+	pid := cmd.Process.Pid
+
+	children.mutex.Lock()
+	children.running[pid] = cmd
+	children.mutex.Unlock()
+
+	go func() {
+		err := cmd.Wait()
+		if exited != nil {
+			exited(err)
+		}
+
+		children.mutex.Lock()
+		delete(children.running, pid)
+		children.mutex.Unlock()
+
+		select {
+		case children.exited <- struct{}{}:
+		default:
+		}
+	}()
+}
+
+func (children *Children) Len() int {
+	children.mutex.Lock()
+	defer children.mutex.Unlock()
+
+	return len(children.running)
+}
+
+// Wait waits for every child to exit until ctx is done, then sends SIGTERM
+// to the remaining ones and kills those still running after killGrace.
+func (children *Children) Wait(ctx context.Context) {
+	for children.Len() > 0 {
+		select {
+		case <-children.exited:
+		case <-ctx.Done():
+			children.signal(syscall.SIGTERM)
+
+			grace, cancel := context.WithTimeout(context.Background(), killGrace)
+			for children.Len() > 0 && grace.Err() == nil {
+				select {
+				case <-children.exited:
+				case <-grace.Done():
+				}
+			}
+			cancel()
+
+			children.signal(os.Kill)
+			return
+		}
+	}
+}
+
+func (children *Children) signal(sig os.Signal) {
+	children.mutex.Lock()
+	defer children.mutex.Unlock()
+
+	for pid, cmd := range children.running {
+		Log(fmt.Sprintf("Sending %v to endpoint process %d", sig, pid))
+		if err := cmd.Process.Signal(sig); err != nil && sig != os.Kill {
+			cmd.Process.Kill()
+		}
+	}
+}
+
+// ShuttingDown tells whether Shutdown was called. Accept loops use it to
+// stop once their listener is closed.
+func ShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+func trackServer(srv *http.Server) {
+	serversMutex.Lock()
+	servers = append(servers, srv)
+	serversMutex.Unlock()
+}
+
+func closeOnShutdown(l net.Listener) {
+	serversMutex.Lock()
+	listeners = append(listeners, l)
+	serversMutex.Unlock()
+}
+
+// HandleSignals shuts the master down gracefully on SIGINT or SIGTERM.
+func HandleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		Log(fmt.Sprintf("Received %v", sig))
+		signal.Stop(signals)
+		Shutdown(ShutdownTimeout)
+	}()
+}
+
+// Shutdown stops accepting requests, lets the sessions in flight finish
+// for at most timeout, asks the endpoints to exit and waits for them, then
+// removes the temporary build output.
+func Shutdown(timeout time.Duration) {
+	if !atomic.CompareAndSwapInt32(&shuttingDown, 0, 1) {
+		return
+	}
+	defer close(shutdownDone)
+
+	Log("Shutting down...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	serversMutex.Lock()
+	shutdownServers := servers
+	serversMutex.Unlock()
+
+	var wg sync.WaitGroup
+	for _, srv := range shutdownServers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				LogError(ErrorLog{err, fmt.Sprintf("Could not drain the connections of %s: %v", srv.Addr, err)})
+			}
+		}(srv)
+	}
+	wg.Wait()
+
+	for requestSession.Len() > 0 && ctx.Err() == nil {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := requestSession.Len(); n > 0 {
+		Log(fmt.Sprintf("Abandoning %d request sessions", n))
+	}
+
+	endpoints.Range(func(key, value interface{}) bool {
+		if set, ok := value.(*ReplicaSet); ok {
+			set.Shutdown()
+		}
+		return true
+	})
+
+	children.Wait(ctx)
+
+	serversMutex.Lock()
+	for _, l := range listeners {
+		l.Close()
+	}
+	serversMutex.Unlock()
+
+	if accessLog != nil {
+		accessLog.Close()
+	}
+	tracer.Close()
+
+	CleanUp()
+	Log("Bye!")
+}
+
+// awaitShutdown blocks a returning server until Shutdown completes.
+func awaitShutdown(err error) {
+	if err == http.ErrServerClosed {
+		<-shutdownDone
+	}
+}
+
+// Shutdown asks every replica to exit once its sessions are closed.
+func (set *ReplicaSet) Shutdown() {
+	set.mutex.RLock()
+	defer set.mutex.RUnlock()
+
+	for _, replica := range set.replicas {
+		protocol.WriteFrame(replica, protocol.FrameShutdown, nil)
+	}
+}
+
+// CleanUp removes the temporary build output.
+func CleanUp() {
+	for _, temporary := range []string{filepath.Join("bin", "build"), filepath.Join("bin", "temp", "broken")} {
+		if err := os.RemoveAll(temporary); err != nil {
+			LogError(ErrorLog{err, fmt.Sprintf("Could not remove %s: %v", temporary, err)})
+		}
+	}
+}
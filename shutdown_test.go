@@ -0,0 +1,86 @@
+package brute
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rrborja/brute/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "brute")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	assert.NoError(t, os.MkdirAll(filepath.Join("bin", "build", "home"), 0700))
+	assert.NoError(t, os.MkdirAll(filepath.Join("bin", "endpoints"), 0700))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	started := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("drained"))
+	})}
+	trackServer(srv)
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+
+	master, endpoint := net.Pipe()
+	set := newReplicaSet(Route{Directory: "shutdown"})
+	set.Add(&ConnWrite{Mutex: new(sync.Mutex), Conn: master})
+	endpoints.Store("shutdown", set)
+	defer endpoints.Delete("shutdown")
+
+	frames := make(chan protocol.FrameType, 1)
+	go func() {
+		if frame, err := protocol.ReadFrame(endpoint); err == nil {
+			frames <- frame.Type
+		}
+	}()
+
+	child := exec.Command("sleep", "30")
+	if assert.NoError(t, child.Start()) {
+		children.Track(child, nil)
+	}
+
+	response := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String())
+		if err == nil {
+			response <- resp
+		}
+		close(response)
+	}()
+
+	<-started
+	Shutdown(500 * time.Millisecond)
+
+	resp := <-response
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	assert.Equal(t, http.ErrServerClosed, <-served)
+	assert.Equal(t, protocol.FrameShutdown, <-frames)
+	assert.Equal(t, 0, children.Len())
+
+	_, err = os.Stat(filepath.Join("bin", "build"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join("bin", "endpoints"))
+	assert.NoError(t, err)
+	assert.True(t, ShuttingDown())
+}
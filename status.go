@@ -0,0 +1,209 @@
+package brute
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// started is when the master started, for its uptime.
+var started = time.Now()
+
+// activeConfig is the project the master serves.
+var activeConfig *Config
+
+// recordBuild keeps the hash of the binary just built for a route.
+func recordBuild(directory, binary string) {
+	hash, err := hashFile(binary)
+	if err != nil {
+		return
+	}
+
+	routeHealthsMutex.Lock()
+	defer routeHealthsMutex.Unlock()
+
+	healthOf(directory).build = hash
+}
+
+func hashFile(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ReplicaStatus is a connected process of an endpoint.
+type ReplicaStatus struct {
+	Id          string        `json:"id"`
+	Pid         int           `json:"pid"`
+	Uptime      time.Duration `json:"uptime"`
+	InFlight    int64         `json:"in_flight"`
+	Multiplexed bool          `json:"multiplexed"`
+}
+
+// Replicas describes the connected processes of the set.
+func (set *ReplicaSet) Replicas() []ReplicaStatus {
+	set.mutex.RLock()
+	defer set.mutex.RUnlock()
+
+	replicas := make([]ReplicaStatus, 0, len(set.replicas))
+	for _, replica := range set.replicas {
+		replicas = append(replicas, ReplicaStatus{
+			Id:          replica.id,
+			Pid:         replica.pid(),
+			Uptime:      time.Since(replica.connected),
+			InFlight:    atomic.LoadInt64(&replica.inFlight),
+			Multiplexed: replica.Multiplexed(),
+		})
+	}
+	return replicas
+}
+
+// EndpointStatus is what brute status reports of an endpoint.
+type EndpointStatus struct {
+	Route    string          `json:"route"`
+	State    RouteState      `json:"state"`
+	Detail   string          `json:"detail,omitempty"`
+	Since    time.Time       `json:"since"`
+	Build    string          `json:"build,omitempty"`
+	Restarts uint64          `json:"restarts"`
+	Exits    uint64          `json:"exits"`
+	InFlight int64           `json:"in_flight"`
+	Replicas []ReplicaStatus `json:"replicas"`
+}
+
+// MasterStatus is what brute status reports of the running master.
+type MasterStatus struct {
+	Pid       int              `json:"pid"`
+	Uptime    time.Duration    `json:"uptime"`
+	Ready     bool             `json:"ready"`
+	Endpoints []EndpointStatus `json:"endpoints"`
+}
+
+// Status reports the master and its endpoints, sorted by route.
+func Status() MasterStatus {
+	readiness := CheckReadiness()
+
+	status := MasterStatus{
+		Pid:       os.Getpid(),
+		Uptime:    time.Since(started),
+		Ready:     readiness.Ready,
+		Endpoints: make([]EndpointStatus, 0, len(readiness.Routes)),
+	}
+
+	routeHealthsMutex.Lock()
+	builds := make(map[string]string, len(routeHealths))
+	for directory, health := range routeHealths {
+		builds[directory] = health.build
+	}
+	routeHealthsMutex.Unlock()
+
+	for directory, route := range readiness.Routes {
+		endpoint := EndpointStatus{
+			Route:    directory,
+			State:    route.State,
+			Detail:   route.Detail,
+			Since:    route.Since,
+			Build:    builds[directory],
+			Restarts: endpointRestarts.Value(directory),
+			Exits:    endpointExits.Value(directory),
+			Replicas: []ReplicaStatus{},
+		}
+		if val, ok := endpoints.Map.Load(directory); ok {
+			if set, ok := val.(*ReplicaSet); ok {
+				endpoint.Replicas = set.Replicas()
+			}
+		}
+		for _, replica := range endpoint.Replicas {
+			endpoint.InFlight += replica.InFlight
+		}
+		status.Endpoints = append(status.Endpoints, endpoint)
+	}
+
+	sort.Slice(status.Endpoints, func(i, j int) bool {
+		return status.Endpoints[i].Route < status.Endpoints[j].Route
+	})
+	return status
+}
+
+// RouteEntry is a route as the master serves it.
+type RouteEntry struct {
+	Route      string        `json:"route"`
+	Path       string        `json:"path"`
+	Authorizer string        `json:"authorizer,omitempty"`
+	Protected  bool          `json:"protected"`
+	Timeout    time.Duration `json:"timeout"`
+	Replicas   int           `json:"replicas"`
+	// Conflicts are the other routes whose path pattern matches some of
+	// the same paths. The route listed first in the table serves them.
+	Conflicts []string `json:"conflicts,omitempty"`
+}
+
+// RouteTable lists the routes of the project in the order they are
+// matched, without those removed while the master runs.
+func RouteTable() []RouteEntry {
+	if activeConfig == nil {
+		return []RouteEntry{}
+	}
+	return routeTable(activeConfig)
+}
+
+func routeTable(config *Config) []RouteEntry {
+	table := make([]RouteEntry, 0, len(config.Routes))
+	for _, route := range config.Routes {
+		if _, removed := removedEndpoints.Load(route.Directory); removed {
+			continue
+		}
+
+		entry := RouteEntry{
+			Route:    route.Directory,
+			Path:     route.Path,
+			Timeout:  route.timeout(),
+			Replicas: route.replicas(),
+		}
+		// The authorizer is put in front of the routes with a config
+		if config.Authorizer != nil && route.RouteConfig != nil {
+			entry.Authorizer = *config.Authorizer
+			entry.Protected = route.Protected
+		}
+		table = append(table, entry)
+	}
+
+	for i := range table {
+		for j := range table {
+			if i != j && pathsOverlap(table[i].Path, table[j].Path) {
+				table[i].Conflicts = append(table[i].Conflicts, table[j].Route)
+			}
+		}
+	}
+	return table
+}
+
+// pathsOverlap tells whether some path matches both path templates of the
+// router. A segment with a variable is taken to match any segment.
+func pathsOverlap(a, b string) bool {
+	as := strings.Split(a, "/")
+	bs := strings.Split(b, "/")
+	if len(as) != len(bs) {
+		return false
+	}
+
+	for i := range as {
+		if as[i] != bs[i] && !strings.Contains(as[i], "{") && !strings.Contains(bs[i], "{") {
+			return false
+		}
+	}
+	return true
+}
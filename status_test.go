@@ -0,0 +1,100 @@
+package brute
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatusReportsTheReplicas(t *testing.T) {
+	resetRouteHealths()
+	defer resetRouteHealths()
+	defer endpoints.Delete("status-home")
+
+	dir, err := ioutil.TempDir("", "brute")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	binary := filepath.Join(dir, "status-home")
+	assert.NoError(t, ioutil.WriteFile(binary, []byte("binary"), 0700))
+
+	recordBuild("status-home", binary)
+	set := newReplicaSet(Route{Directory: "status-home"})
+	set.Add(newTestReplica())
+	endpoints.Store("status-home", set)
+	startingRoute("status-home")
+	endpointRestarts.Inc("status-home")
+
+	status := Status()
+	assert.Equal(t, os.Getpid(), status.Pid)
+	if !assert.Len(t, status.Endpoints, 1) {
+		return
+	}
+
+	endpoint := status.Endpoints[0]
+	assert.Equal(t, "status-home", endpoint.Route)
+	assert.Equal(t, StateConnected, endpoint.State)
+	assert.Equal(t, "9a3a45d01531a20e89ac6ae10b0b0beb0492acd7216a368aa062d1a5fecaf9cd", endpoint.Build)
+	assert.NotEqual(t, uint64(0), endpoint.Restarts)
+	assert.Len(t, endpoint.Replicas, 1)
+	assert.Equal(t, "1", endpoint.Replicas[0].Id)
+}
+
+func TestStatusCountsExitedReplicas(t *testing.T) {
+	resetRouteHealths()
+	defer resetRouteHealths()
+
+	// Exits are not counted once the master shuts down
+	defer atomic.StoreInt32(&shuttingDown, atomic.SwapInt32(&shuttingDown, 0))
+
+	generation := startingRoute("status-crashing")
+	routeExited("status-crashing", generation, nil)
+	routeExited("status-crashing", generation, nil)
+
+	// A replica replaced by a restart does not count
+	routeExited("status-crashing", generation-1, nil)
+
+	status := Status()
+	if assert.Len(t, status.Endpoints, 1) {
+		assert.Equal(t, StateCrashed, status.Endpoints[0].State)
+		assert.Equal(t, uint64(2), status.Endpoints[0].Exits)
+		assert.Equal(t, uint64(0), status.Endpoints[0].Restarts)
+	}
+}
+
+func TestRouteTableFindsConflicts(t *testing.T) {
+	authorizer := "auth"
+	config := &Config{
+		Authorizer: &authorizer,
+		Routes: []Route{
+			{Path: "/users/{id}", Directory: "user", RouteConfig: &RouteConfig{Protected: true, Timeout: "5s"}},
+			{Path: "/users/new", Directory: "signup"},
+			{Path: "/users/{id}/posts", Directory: "posts", RouteConfig: &RouteConfig{Replicas: 2}},
+			{Path: "/about", Directory: "about"},
+		},
+	}
+
+	table := routeTable(config)
+	if !assert.Len(t, table, 4) {
+		return
+	}
+	assert.Equal(t, "auth", table[0].Authorizer)
+	assert.True(t, table[0].Protected)
+	assert.Equal(t, 5*time.Second, table[0].Timeout)
+	assert.Equal(t, []string{"signup"}, table[0].Conflicts)
+	assert.Equal(t, "", table[1].Authorizer)
+	assert.Equal(t, []string{"user"}, table[1].Conflicts)
+	assert.Equal(t, "auth", table[2].Authorizer)
+	assert.False(t, table[2].Protected)
+	assert.Equal(t, 2, table[2].Replicas)
+	assert.Empty(t, table[2].Conflicts)
+	assert.Empty(t, table[3].Conflicts)
+
+	removedEndpoints.Store("signup", true)
+	defer removedEndpoints.Delete("signup")
+	assert.Len(t, routeTable(config), 3)
+}
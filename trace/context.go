@@ -0,0 +1,142 @@
+// Package trace records the spans of a request as it goes through the
+// master and its endpoint, and propagates their context in the W3C Trace
+// Context format:
+//
+//	traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+//
+// The master forwards the context of its spans to the endpoint serving the
+// request, whose spans become their children. Spans are exported in
+// batches over OTLP/HTTP or to a file of JSON lines.
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Header is the HTTP header carrying the trace context.
+const Header = "traceparent"
+
+// The master configures the exporter of the endpoints it spawns through
+// these environment variables.
+const (
+	ExporterEnv = "BRUTE_TRACE_EXPORTER"
+	EndpointEnv = "BRUTE_TRACE_ENDPOINT"
+	FileEnv     = "BRUTE_TRACE_FILE"
+	ServiceEnv  = "BRUTE_TRACE_SERVICE"
+	// HeadersEnv holds the headers of the OTLP requests as k=v,k=v
+	HeadersEnv = "BRUTE_TRACE_HEADERS"
+)
+
+const flagSampled = 0x01
+
+var InvalidTraceparentError = errors.New("invalid traceparent")
+
+type TraceID [16]byte
+
+type SpanID [8]byte
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id TraceID) IsValid() bool {
+	return id != TraceID{}
+}
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id SpanID) IsValid() bool {
+	return id != SpanID{}
+}
+
+func newTraceID() (id TraceID) {
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return
+}
+
+func newSpanID() (id SpanID) {
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return
+}
+
+// SpanContext identifies a span across processes.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   byte
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Sampled tells whether the spans of the trace are recorded.
+func (sc SpanContext) Sampled() bool {
+	return sc.Flags&flagSampled != 0
+}
+
+// Traceparent formats sc as the value of the traceparent header, or returns
+// an empty string if sc is not valid.
+func (sc SpanContext) Traceparent() string {
+	if !sc.IsValid() {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+// ParseTraceparent reads the value of a traceparent header. Versions above
+// 00 are read as far as the fields version 00 defines.
+func ParseTraceparent(value string) (SpanContext, error) {
+	var sc SpanContext
+
+	value = strings.TrimSpace(value)
+	if len(value) < 55 || (len(value) > 55 && (value[:2] == "00" || value[55] != '-')) {
+		return sc, InvalidTraceparentError
+	}
+	if value[2] != '-' || value[35] != '-' || value[52] != '-' {
+		return sc, InvalidTraceparentError
+	}
+
+	version, err := decodeHex(value[:2], 1)
+	if err != nil || version[0] == 0xff {
+		return sc, InvalidTraceparentError
+	}
+	traceID, err := decodeHex(value[3:35], 16)
+	if err != nil {
+		return sc, InvalidTraceparentError
+	}
+	spanID, err := decodeHex(value[36:52], 8)
+	if err != nil {
+		return sc, InvalidTraceparentError
+	}
+	flags, err := decodeHex(value[53:55], 1)
+	if err != nil {
+		return sc, InvalidTraceparentError
+	}
+
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Flags = flags[0]
+	if !sc.IsValid() {
+		return SpanContext{}, InvalidTraceparentError
+	}
+	return sc, nil
+}
+
+// decodeHex decodes exactly size bytes of lowercase hex.
+func decodeHex(s string, size int) ([]byte, error) {
+	if len(s) != 2*size || strings.ToLower(s) != s {
+		return nil, InvalidTraceparentError
+	}
+	return hex.DecodeString(s)
+}
@@ -0,0 +1,277 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ExporterOTLP = "otlp"
+	ExporterFile = "file"
+)
+
+// DefaultOTLPEndpoint is where a local OpenTelemetry collector receives
+// traces over HTTP.
+const DefaultOTLPEndpoint = "http://localhost:4318/v1/traces"
+
+var noTraceFileError = errors.New("the file trace exporter needs a file")
+
+// Exporter sends finished spans somewhere.
+type Exporter interface {
+	Export(spans []*Span) error
+	Close() error
+}
+
+// NewExporter returns the exporter named kind, or nil if kind is empty.
+func NewExporter(kind, endpoint, file string, headers map[string]string) (Exporter, error) {
+	switch strings.ToLower(kind) {
+	case "":
+		return nil, nil
+	case ExporterOTLP:
+		return NewOTLPExporter(endpoint, headers), nil
+	case ExporterFile:
+		exporter, err := OpenFileExporter(file)
+		if err != nil {
+			return nil, err
+		}
+		return exporter, nil
+	}
+	return nil, fmt.Errorf("unknown trace exporter %q", kind)
+}
+
+// OTLPExporter posts spans to a collector in the JSON encoding of
+// OTLP/HTTP.
+type OTLPExporter struct {
+	URL     string
+	Headers map[string]string
+	Client  *http.Client
+}
+
+func NewOTLPExporter(url string, headers map[string]string) *OTLPExporter {
+	if url == "" {
+		url = DefaultOTLPEndpoint
+	}
+	return &OTLPExporter{URL: url, Headers: headers, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (exporter *OTLPExporter) Export(spans []*Span) error {
+	data, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, exporter.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range exporter.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := exporter.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector %s answered %s", exporter.URL, resp.Status)
+	}
+	return nil
+}
+
+func (exporter *OTLPExporter) Close() error {
+	return nil
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              Kind            `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// otlpRequest groups spans by service, the resource of OTLP.
+func otlpRequest(spans []*Span) otlpTraces {
+	var request otlpTraces
+	byService := make(map[string]int)
+
+	for _, span := range spans {
+		i, ok := byService[span.Service]
+		if !ok {
+			var resource otlpResourceSpans
+			resource.Resource.Attributes = []otlpAttribute{{"service.name", otlpValue{span.Service}}}
+			scope := otlpScopeSpans{}
+			scope.Scope.Name = "github.com/rrborja/brute/trace"
+			resource.ScopeSpans = []otlpScopeSpans{scope}
+
+			i = len(request.ResourceSpans)
+			byService[span.Service] = i
+			request.ResourceSpans = append(request.ResourceSpans, resource)
+		}
+
+		scope := &request.ResourceSpans[i].ScopeSpans[0]
+		scope.Spans = append(scope.Spans, span.otlp())
+	}
+	return request
+}
+
+func (span *Span) otlp() otlpSpan {
+	span.mutex.Lock()
+	defer span.mutex.Unlock()
+
+	encoded := otlpSpan{
+		TraceId:           span.Context.TraceID.String(),
+		SpanId:            span.Context.SpanID.String(),
+		Name:              span.Name,
+		Kind:              span.Kind,
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+	}
+	if span.Parent.IsValid() {
+		encoded.ParentSpanId = span.Parent.String()
+	}
+	for _, attribute := range span.Attributes {
+		encoded.Attributes = append(encoded.Attributes, otlpAttribute{attribute.Key, otlpValue{attribute.Value}})
+	}
+	if span.Error != "" {
+		encoded.Status = otlpStatus{Code: 2, Message: span.Error}
+	}
+	return encoded
+}
+
+// FileExporter appends one JSON object per span to a file. Several
+// processes may share the file.
+type FileExporter struct {
+	file  *os.File
+	mutex sync.Mutex
+}
+
+func OpenFileExporter(name string) (*FileExporter, error) {
+	if name == "" {
+		return nil, noTraceFileError
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{file: file}, nil
+}
+
+// FileSpan is a line of the file exporter.
+type FileSpan struct {
+	Service    string            `json:"service"`
+	TraceId    string            `json:"trace_id"`
+	SpanId     string            `json:"span_id"`
+	ParentId   string            `json:"parent_id,omitempty"`
+	Name       string            `json:"name"`
+	Kind       Kind              `json:"kind"`
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+func (exporter *FileExporter) Export(spans []*Span) error {
+	var buf bytes.Buffer
+	e := json.NewEncoder(&buf)
+	for _, span := range spans {
+		if err := e.Encode(span.file()); err != nil {
+			return err
+		}
+	}
+
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+
+	// Spans are written in a single call so that the lines of other
+	// processes do not interleave with them
+	_, err := exporter.file.Write(buf.Bytes())
+	return err
+}
+
+func (span *Span) file() FileSpan {
+	span.mutex.Lock()
+	defer span.mutex.Unlock()
+
+	line := FileSpan{
+		Service: span.Service,
+		TraceId: span.Context.TraceID.String(),
+		SpanId:  span.Context.SpanID.String(),
+		Name:    span.Name,
+		Kind:    span.Kind,
+		Start:   span.Start,
+		End:     span.End,
+		Error:   span.Error,
+	}
+	if span.Parent.IsValid() {
+		line.ParentId = span.Parent.String()
+	}
+	if len(span.Attributes) > 0 {
+		line.Attributes = make(map[string]string, len(span.Attributes))
+		for _, attribute := range span.Attributes {
+			line.Attributes[attribute.Key] = attribute.Value
+		}
+	}
+	return line
+}
+
+func (exporter *FileExporter) Close() error {
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+
+	return exporter.file.Close()
+}
@@ -0,0 +1,100 @@
+package trace
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Kind tells the role of a span in the request, as OTLP numbers it.
+type Kind int
+
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+type Attribute struct {
+	Key   string
+	Value string
+}
+
+// Span is a timed operation of a trace. A span of a trace that is not
+// sampled, or of a nil tracer, still carries a context to propagate but is
+// not exported.
+type Span struct {
+	Name    string
+	Kind    Kind
+	Service string
+	Context SpanContext
+	Parent  SpanID
+	Start   time.Time
+	End     time.Time
+
+	Attributes []Attribute
+	Error      string
+
+	tracer *Tracer
+	once   sync.Once
+	mutex  sync.Mutex
+}
+
+// SetAttribute records key and value, formatted with fmt.Sprint.
+func (span *Span) SetAttribute(key string, value interface{}) {
+	if span == nil {
+		return
+	}
+
+	span.mutex.Lock()
+	defer span.mutex.Unlock()
+
+	span.Attributes = append(span.Attributes, Attribute{key, fmt.Sprint(value)})
+}
+
+// SetError marks the span as failed by err, if err is not nil.
+func (span *Span) SetError(err error) {
+	if span == nil || err == nil {
+		return
+	}
+
+	span.mutex.Lock()
+	defer span.mutex.Unlock()
+
+	span.Error = err.Error()
+}
+
+// Finish ends the span and hands it to the exporter. Only the first call
+// counts.
+func (span *Span) Finish() {
+	if span == nil {
+		return
+	}
+
+	span.once.Do(func() {
+		span.mutex.Lock()
+		span.End = time.Now()
+		span.mutex.Unlock()
+
+		if span.tracer != nil && span.Context.Sampled() {
+			span.tracer.enqueue(span)
+		}
+	})
+}
+
+// Traceparent is the value of the traceparent header making the receiver
+// a child of span.
+func (span *Span) Traceparent() string {
+	if span == nil {
+		return ""
+	}
+	return span.Context.Traceparent()
+}
+
+// Child starts a span whose parent is span.
+func (span *Span) Child(name string) *Span {
+	if span == nil {
+		return nil
+	}
+	return span.tracer.Start(name, KindInternal, span.Context)
+}
@@ -0,0 +1,159 @@
+package trace
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestParseTraceparent(t *testing.T) {
+	sc, err := ParseTraceparent(traceparent)
+	assert.NoError(t, err)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+	assert.True(t, sc.Sampled())
+	assert.Equal(t, traceparent, sc.Traceparent())
+
+	// Later versions may append fields
+	_, err = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra")
+	assert.NoError(t, err)
+
+	for _, invalid := range []string{
+		"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00_4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		_, err := ParseTraceparent(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestSpansAreChildrenOfTheirParent(t *testing.T) {
+	parent, _ := ParseTraceparent(traceparent)
+
+	var tracer *Tracer
+	span := tracer.Start("GET", KindServer, parent)
+	assert.Equal(t, parent.TraceID, span.Context.TraceID)
+	assert.Equal(t, parent.SpanID, span.Parent)
+	assert.NotEqual(t, parent.SpanID, span.Context.SpanID)
+
+	child := span.Child("query")
+	assert.Equal(t, span.Context.SpanID, child.Parent)
+
+	root := tracer.Start("GET", KindServer, SpanContext{})
+	assert.True(t, root.Context.IsValid())
+	assert.False(t, root.Parent.IsValid())
+
+	var none *Span
+	assert.Nil(t, none.Child("query"))
+	assert.Equal(t, "", none.Traceparent())
+	none.Finish()
+}
+
+// collector stands in for an OpenTelemetry collector.
+type collector struct {
+	requests []otlpTraces
+	headers  []http.Header
+	mutex    sync.Mutex
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var request otlpTraces
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || r.URL.Path != "/v1/traces" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	c.mutex.Lock()
+	c.requests = append(c.requests, request)
+	c.headers = append(c.headers, r.Header)
+	c.mutex.Unlock()
+}
+
+func TestOTLPExporter(t *testing.T) {
+	c := &collector{}
+	server := httptest.NewServer(c)
+	defer server.Close()
+
+	tracer := NewTracer("shop", NewOTLPExporter(server.URL+"/v1/traces", map[string]string{"Authorization": "Bearer 1234"}))
+	parent, _ := ParseTraceparent(traceparent)
+
+	span := tracer.Start("GET", KindServer, parent)
+	span.SetAttribute("http.status_code", 502)
+	span.SetError(os.ErrClosed)
+	span.Child("dispatch").Finish()
+	span.Finish()
+
+	unsampled, _ := ParseTraceparent(strings.TrimSuffix(traceparent, "01") + "00")
+	tracer.Start("GET", KindServer, unsampled).Finish()
+
+	assert.NoError(t, tracer.Close())
+
+	if !assert.Len(t, c.requests, 1) {
+		return
+	}
+	assert.Equal(t, "Bearer 1234", c.headers[0].Get("Authorization"))
+
+	resource := c.requests[0].ResourceSpans[0]
+	assert.Equal(t, "shop", resource.Resource.Attributes[0].Value.StringValue)
+
+	spans := resource.ScopeSpans[0].Spans
+	if assert.Len(t, spans, 2) {
+		dispatch, server := spans[0], spans[1]
+		assert.Equal(t, "dispatch", dispatch.Name)
+		assert.Equal(t, server.SpanId, dispatch.ParentSpanId)
+		assert.Equal(t, "00f067aa0ba902b7", server.ParentSpanId)
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", server.TraceId)
+		assert.Equal(t, KindServer, server.Kind)
+		assert.Equal(t, 2, server.Status.Code)
+		assert.Equal(t, []otlpAttribute{{"http.status_code", otlpValue{"502"}}}, server.Attributes)
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "brute")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "bin", "traces.json")
+	exporter, err := NewExporter(ExporterFile, "", name, nil)
+	assert.NoError(t, err)
+
+	tracer := NewTracer("shop/home", exporter)
+	span := tracer.Start("GET home", KindServer, SpanContext{})
+	span.SetAttribute("brute.route", "home")
+	span.Finish()
+	assert.NoError(t, tracer.Close())
+
+	data, err := ioutil.ReadFile(name)
+	assert.NoError(t, err)
+
+	var line FileSpan
+	assert.NoError(t, json.Unmarshal(data, &line))
+	assert.Equal(t, "shop/home", line.Service)
+	assert.Equal(t, span.Context.SpanID.String(), line.SpanId)
+	assert.Equal(t, map[string]string{"brute.route": "home"}, line.Attributes)
+
+	_, err = NewExporter("zipkin", "", "", nil)
+	assert.Error(t, err)
+}
+
+func TestHeadersEnv(t *testing.T) {
+	headers := map[string]string{"Authorization": "Bearer a=b,c", "X-Team": "shop"}
+	assert.Equal(t, headers, ParseHeaders(FormatHeaders(headers)))
+	assert.Nil(t, ParseHeaders(""))
+}
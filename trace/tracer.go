@@ -0,0 +1,179 @@
+package trace
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	queueSize     = 2048
+	batchSize     = 256
+	flushInterval = 2 * time.Second
+)
+
+// Tracer starts spans and exports them in batches. A nil *Tracer starts
+// spans that propagate their context without being exported.
+type Tracer struct {
+	Service string
+
+	exporter Exporter
+	queue    chan *Span
+	flushed  chan struct{}
+	closed   bool
+	mutex    sync.RWMutex
+
+	// Errors receives the errors of the exporter, logged to stderr when nil
+	Errors func(err error)
+}
+
+// NewTracer exports the spans of service with exporter.
+func NewTracer(service string, exporter Exporter) *Tracer {
+	tracer := &Tracer{
+		Service:  service,
+		exporter: exporter,
+		queue:    make(chan *Span, queueSize),
+		flushed:  make(chan struct{}),
+	}
+	go tracer.run()
+	return tracer
+}
+
+// FromEnv returns the tracer configured by the master in the environment,
+// or nil if tracing is off.
+func FromEnv() (*Tracer, error) {
+	exporter, err := NewExporter(os.Getenv(ExporterEnv), os.Getenv(EndpointEnv), os.Getenv(FileEnv), ParseHeaders(os.Getenv(HeadersEnv)))
+	if exporter == nil || err != nil {
+		return nil, err
+	}
+	return NewTracer(os.Getenv(ServiceEnv), exporter), nil
+}
+
+// FormatHeaders encodes headers for HeadersEnv.
+func FormatHeaders(headers map[string]string) string {
+	pairs := make([]string, 0, len(headers))
+	for key, value := range headers {
+		pairs = append(pairs, url.QueryEscape(key)+"="+url.QueryEscape(value))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// ParseHeaders decodes the value of HeadersEnv.
+func ParseHeaders(value string) map[string]string {
+	if value == "" {
+		return nil
+	}
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		i := strings.IndexByte(pair, '=')
+		if i < 0 {
+			continue
+		}
+		key, err := url.QueryUnescape(pair[:i])
+		if err != nil {
+			continue
+		}
+		if value, err := url.QueryUnescape(pair[i+1:]); err == nil {
+			headers[key] = value
+		}
+	}
+	return headers
+}
+
+// Start starts a span, the child of parent if parent is valid or the root
+// of a new sampled trace otherwise.
+func (tracer *Tracer) Start(name string, kind Kind, parent SpanContext) *Span {
+	span := &Span{Name: name, Kind: kind, Start: time.Now(), tracer: tracer}
+	if tracer != nil {
+		span.Service = tracer.Service
+	}
+
+	if parent.IsValid() {
+		span.Context = SpanContext{TraceID: parent.TraceID, SpanID: newSpanID(), Flags: parent.Flags}
+		span.Parent = parent.SpanID
+	} else {
+		span.Context = SpanContext{TraceID: newTraceID(), SpanID: newSpanID(), Flags: flagSampled}
+	}
+	return span
+}
+
+func (tracer *Tracer) enqueue(span *Span) {
+	tracer.mutex.RLock()
+	defer tracer.mutex.RUnlock()
+
+	if tracer.closed {
+		return
+	}
+
+	select {
+	case tracer.queue <- span:
+	default:
+		// The exporter is behind; dropping spans beats holding requests
+	}
+}
+
+func (tracer *Tracer) run() {
+	defer close(tracer.flushed)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := tracer.exporter.Export(batch); err != nil {
+			tracer.fail(err)
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case span, ok := <-tracer.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (tracer *Tracer) fail(err error) {
+	if tracer.Errors != nil {
+		tracer.Errors(err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "trace: %v\n", err)
+}
+
+// Close exports the spans finished so far and closes the exporter.
+func (tracer *Tracer) Close() error {
+	if tracer == nil {
+		return nil
+	}
+
+	tracer.mutex.Lock()
+	if tracer.closed {
+		tracer.mutex.Unlock()
+		return nil
+	}
+	tracer.closed = true
+	close(tracer.queue)
+	tracer.mutex.Unlock()
+
+	<-tracer.flushed
+	return tracer.exporter.Close()
+}
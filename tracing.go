@@ -0,0 +1,153 @@
+package brute
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	. "github.com/rrborja/brute/log"
+	"github.com/rrborja/brute/trace"
+)
+
+// TracingConfig is the tracing section of .brute.yml. Spans are exported
+// over OTLP/HTTP to Endpoint, a local collector by default, or appended to
+// File as JSON lines. The endpoints export their own spans the same way,
+// under the service name followed by the route:
+//
+//	tracing:
+//	  exporter: otlp
+//	  endpoint: http://collector:4318/v1/traces
+//	  headers:
+//	    authorization: Bearer 1234
+//	  service: shop
+type TracingConfig struct {
+	Exporter string            `yaml:"exporter"`
+	Endpoint string            `yaml:"endpoint"`
+	File     string            `yaml:"file"`
+	Headers  map[string]string `yaml:"headers"`
+	Service  string            `yaml:"service"`
+}
+
+const defaultTraceService = "brute"
+
+var defaultTraceFile = filepath.Join("bin", "traces.json")
+
+var (
+	// tracer and tracing are set by New when tracing is configured.
+	tracer  *trace.Tracer
+	tracing *TracingConfig
+)
+
+func (config *TracingConfig) service() string {
+	if config.Service == "" {
+		return defaultTraceService
+	}
+	return config.Service
+}
+
+func (config *TracingConfig) file() string {
+	if config.File == "" {
+		return defaultTraceFile
+	}
+	return config.File
+}
+
+func startTracing(config *TracingConfig) error {
+	exporter, err := trace.NewExporter(config.Exporter, config.Endpoint, config.file(), config.Headers)
+	if err != nil || exporter == nil {
+		return err
+	}
+
+	tracer = trace.NewTracer(config.service(), exporter)
+	tracer.Errors = func(err error) {
+		Warn("Could not export spans", "error", err)
+	}
+	tracing = config
+	return nil
+}
+
+// endpointEnv configures the exporter of the endpoint named route, in the
+// form StartRootEndpoint passes the environment.
+func (config *TracingConfig) endpointEnv(route string) string {
+	return fmt.Sprintf(";%s=%s;%s=%s;%s=%s;%s=%s;%s=%s",
+		trace.ExporterEnv, config.Exporter,
+		trace.EndpointEnv, config.Endpoint,
+		trace.FileEnv, config.file(),
+		trace.ServiceEnv, config.service()+"/"+route,
+		trace.HeadersEnv, trace.FormatHeaders(config.Headers))
+}
+
+type spanKey struct{}
+
+// spanOf returns the span of r, nil when tracing is off.
+func spanOf(r *http.Request) *trace.Span {
+	span, _ := r.Context().Value(spanKey{}).(*trace.Span)
+	return span
+}
+
+func withSpan(r *http.Request, span *trace.Span) *http.Request {
+	if span == nil {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), spanKey{}, span))
+}
+
+// traceRequests starts the server span of every request, continuing the
+// trace of its traceparent header if it has a valid one.
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parent, _ := trace.ParseTraceparent(r.Header.Get(trace.Header))
+
+		span := tracer.Start(r.Method, trace.KindServer, parent)
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.target", r.URL.RequestURI())
+		span.SetAttribute("http.host", r.Host)
+		defer span.Finish()
+
+		record := &AccessRecord{Time: span.Start}
+		next.ServeHTTP(&accessWriter{ResponseWriter: w, record: record}, withSpan(r, span))
+
+		if record.Status == 0 {
+			record.Status = http.StatusOK
+		}
+		span.SetAttribute("http.status_code", record.Status)
+		if record.Status >= 500 {
+			span.SetError(fmt.Errorf("%d %s", record.Status, http.StatusText(record.Status)))
+		}
+	})
+}
+
+// traceRoute records the routing of a request to route, from the start of
+// the request to the call of next.
+func traceRoute(route Route, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if span := spanOf(r); span != nil {
+			span.SetAttribute("http.route", route.Path)
+
+			routing := tracer.Start("route", trace.KindInternal, span.Context)
+			routing.Start = span.Start
+			routing.SetAttribute("brute.route", route.Directory)
+			routing.Finish()
+		}
+		next(w, r)
+	}
+}
+
+// forwardedHeader is header with the traceparent of the endpoint's parent
+// span in place of the client's.
+func forwardedHeader(header http.Header, traceparent string) http.Header {
+	if traceparent == "" {
+		return header
+	}
+
+	forwarded := make(http.Header, len(header)+1)
+	for key, values := range header {
+		if !strings.EqualFold(key, trace.Header) {
+			forwarded[key] = values
+		}
+	}
+	forwarded.Set(trace.Header, traceparent)
+	return forwarded
+}
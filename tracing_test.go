@@ -0,0 +1,78 @@
+package brute
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/rrborja/brute/trace"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingExporter struct {
+	spans []*trace.Span
+	mutex sync.Mutex
+}
+
+func (exporter *recordingExporter) Export(spans []*trace.Span) error {
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+
+	exporter.spans = append(exporter.spans, spans...)
+	return nil
+}
+
+func (exporter *recordingExporter) Close() error {
+	return nil
+}
+
+func TestRequestsAreTraced(t *testing.T) {
+	exporter := &recordingExporter{}
+	tracer = trace.NewTracer("shop", exporter)
+	defer func() { tracer = nil }()
+
+	route := Route{Path: "/users/{id}", Directory: "users"}
+	var forwarded string
+	handler := traceRequests(traceRoute(route, func(w http.ResponseWriter, r *http.Request) {
+		dispatch := spanOf(r).Child("dispatch")
+		forwarded = forwardedHeader(r.Header, dispatch.Traceparent()).Get(trace.Header)
+		dispatch.Finish()
+
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+
+	r := httptest.NewRequest("GET", "/users/42", nil)
+	r.Header.Set(trace.Header, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	assert.NoError(t, tracer.Close())
+
+	spans := make(map[string]*trace.Span)
+	for _, span := range exporter.spans {
+		spans[span.Name] = span
+	}
+	if !assert.Len(t, spans, 3) {
+		return
+	}
+
+	server, routing, dispatch := spans["GET"], spans["route"], spans["dispatch"]
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", server.Context.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", server.Parent.String())
+	assert.Equal(t, server.Context.SpanID, routing.Parent)
+	assert.Equal(t, server.Context.SpanID, dispatch.Parent)
+	assert.Equal(t, dispatch.Context.Traceparent(), forwarded)
+	assert.Contains(t, server.Attributes, trace.Attribute{Key: "http.route", Value: "/users/{id}"})
+	assert.Contains(t, server.Attributes, trace.Attribute{Key: "http.status_code", Value: "502"})
+	assert.Equal(t, "502 Bad Gateway", server.Error)
+}
+
+func TestForwardedHeaderReplacesTheClientTraceparent(t *testing.T) {
+	header := http.Header{"Traceparent": {"client"}, "Accept": {"text/html"}}
+
+	assert.Equal(t, header, forwardedHeader(header, ""))
+
+	forwarded := forwardedHeader(header, "endpoint")
+	assert.Equal(t, "endpoint", forwarded.Get(trace.Header))
+	assert.Equal(t, "text/html", forwarded.Get("Accept"))
+	assert.Equal(t, "client", header.Get(trace.Header))
+}